@@ -7,16 +7,21 @@ toolchain go1.22.10
 require (
 	github.com/VU-ASE/rovercom v1.7.0
 	github.com/VU-ASE/roverlib-go v1.2.7
+	github.com/eclipse/paho.mqtt.golang v1.4.3
+	github.com/mattn/go-sqlite3 v1.14.22
 	github.com/rs/zerolog v1.33.0
 	gocv.io/x/gocv v0.39.0
 	google.golang.org/protobuf v1.34.2
+	periph.io/x/conn/v3 v3.7.2
+	periph.io/x/host/v3 v3.8.4
 )
 
 require (
+	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/pebbe/zmq4 v1.2.11 // indirect
+	golang.org/x/net v0.8.0 // indirect
+	golang.org/x/sync v0.1.0 // indirect
 	golang.org/x/sys v0.14.0 // indirect
-	periph.io/x/conn/v3 v3.7.2 // indirect
-	periph.io/x/host/v3 v3.8.4 // indirect
 )
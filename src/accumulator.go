@@ -0,0 +1,55 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Integrates power and current over time into the cumulative energy and charge since the service started.
+// Both use the signed values, so that energy returned during regeneration is subtracted from the totals.
+type energyAccumulator struct {
+	// Currents below this magnitude are treated as zero, so that measurement noise while the rover
+	// is idle does not slowly add up to phantom consumption
+	deadbandAmps float64
+	energyWh     float64
+	chargeAh     float64
+	last         time.Time // timestamp of the previous sample, zero before the first sample
+}
+
+// Continues from previously accumulated totals (e.g. restored after a restart)
+func (a *energyAccumulator) restore(energyWh float64, chargeAh float64) {
+	a.energyWh = energyWh
+	a.chargeAh = chargeAh
+}
+
+// Restarts the integration after the sensor was lost, keeping the totals. Nothing is known about the current
+// while the sensor was gone, so the interval up to the next sample is not integrated.
+func (a *energyAccumulator) resume() {
+	a.last = time.Time{}
+}
+
+// Continues after the sensor was reconnected. The totals represent the whole run rather than the connection to
+// the sensor, so with a warm restart they continue, otherwise a swapped sensor starts a new measurement.
+func (a *energyAccumulator) reconnected(warmRestart bool) {
+	if !warmRestart {
+		log.Info().Float64("energyWh", a.energyWh).Float64("chargeAh", a.chargeAh).Msg("Resetting the accumulated totals for the reconnected sensor")
+		a.restore(0, 0)
+	}
+	a.resume()
+}
+
+// Adds the sample to the totals and fills in its cumulative fields
+func (a *energyAccumulator) add(sample *CurrentSensorOutput) {
+	if !a.last.IsZero() && math.Abs(sample.CurrentAmps) >= a.deadbandAmps {
+		// Both timestamps carry Go's monotonic clock reading, so the interval is immune to steps of the wall clock
+		hours := sample.Timestamp.Sub(a.last).Hours()
+		a.energyWh += sample.SignedPowerWatts * hours
+		a.chargeAh += sample.CurrentAmps * hours
+	}
+	a.last = sample.Timestamp
+
+	sample.EnergyWh = a.energyWh
+	sample.ChargeAh = a.chargeAh
+}
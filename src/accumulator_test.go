@@ -0,0 +1,62 @@
+package main
+
+import (
+	"math"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReconnectContinuesTotals(t *testing.T) {
+	cal, err := NewCalibration(0.002, 10)
+	if err != nil {
+		t.Fatalf("NewCalibration: %v", err)
+	}
+	bus := newFakeBus()
+	ina := newFakeINA226(t, bus, cal)
+
+	for _, warm := range []bool{true, false} {
+		accumulator := &energyAccumulator{}
+		start := time.Now()
+		sample := func(offset time.Duration) *CurrentSensorOutput {
+			s := &CurrentSensorOutput{Timestamp: start.Add(offset), CurrentAmps: 1, SignedPowerWatts: 12}
+			accumulator.add(s)
+			return s
+		}
+		sample(0)
+		sample(time.Hour)
+
+		// The sensor stops responding mid-run and comes back
+		reattached := false
+		monitor := newHotswapMonitor(ina, 1, func() {}, func() { reattached = true })
+		bus.lock.Lock()
+		bus.readErr, bus.readBytes = syscall.ENXIO, 0
+		bus.lock.Unlock()
+		if _, err := ina.ReadSensorData(); err == nil {
+			t.Fatalf("read succeeded on an unplugged sensor")
+		}
+		monitor.readFailed()
+		if monitor.probe() {
+			t.Fatalf("probe succeeded on an unplugged sensor")
+		}
+		bus.lock.Lock()
+		bus.readErr = nil
+		bus.lock.Unlock()
+		monitor.lastProbe = time.Time{}
+		if !monitor.probe() || !reattached {
+			t.Fatalf("the sensor was not re-initialized")
+		}
+		accumulator.reconnected(warm)
+
+		// The outage is not integrated, the hour after the first sample after it is
+		sample(3 * time.Hour)
+		last := sample(4 * time.Hour)
+		want := 24.0
+		if !warm {
+			want = 12
+		}
+		if math.Abs(last.EnergyWh-want) > 1e-9 || math.Abs(last.ChargeAh-want/12) > 1e-9 {
+			t.Errorf("warm restart %v: %v Wh and %v Ah after the reconnect, want %v Wh and %v Ah", warm, last.EnergyWh, last.ChargeAh, want, want/12)
+		}
+	}
+}
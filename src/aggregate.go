@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Minimum, maximum and mean of a quantity over an aggregation interval
+type intervalStats struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+	Avg float64 `json:"avg"`
+	sum float64
+}
+
+func (s *intervalStats) add(value float64, first bool) {
+	if first {
+		*s = intervalStats{Min: value, Max: value}
+	}
+	s.Min = math.Min(s.Min, value)
+	s.Max = math.Max(s.Max, value)
+	s.sum += value
+}
+
+// A summary of the raw samples of one interval, for dashboards that do not need the full rate
+type sampleAggregate struct {
+	SensorID      uint32        `json:"sensorId"`
+	Start         time.Time     `json:"start"`
+	End           time.Time     `json:"end"`
+	Samples       int           `json:"samples"`
+	SupplyVoltage intervalStats `json:"supplyVoltage"`
+	CurrentAmps   intervalStats `json:"currentAmps"`
+	PowerWatts    intervalStats `json:"powerWatts"`
+	// The cumulative values at the end of the interval
+	EnergyWh float64 `json:"energyWh"`
+	ChargeAh float64 `json:"chargeAh"`
+}
+
+// Aggregates the raw samples over consecutive intervals of a fixed length. An interval is closed by the first
+// sample after its end, so an interval without samples produces no aggregate.
+type sampleAggregator struct {
+	interval time.Duration
+	current  sampleAggregate
+}
+
+func newSampleAggregator(interval time.Duration) *sampleAggregator {
+	return &sampleAggregator{interval: interval}
+}
+
+// Adds a raw sample and returns the aggregate of the previous interval when the sample starts a new one
+func (a *sampleAggregator) add(sample *CurrentSensorOutput) *sampleAggregate {
+	var done *sampleAggregate
+	if a.current.Samples > 0 && !sample.Timestamp.Before(a.current.End) {
+		finished := a.current
+		finished.SupplyVoltage.Avg = finished.SupplyVoltage.sum / float64(finished.Samples)
+		finished.CurrentAmps.Avg = finished.CurrentAmps.sum / float64(finished.Samples)
+		finished.PowerWatts.Avg = finished.PowerWatts.sum / float64(finished.Samples)
+		done = &finished
+		a.current.Samples = 0
+	}
+
+	first := a.current.Samples == 0
+	if first {
+		start := sample.Timestamp.Truncate(a.interval)
+		a.current = sampleAggregate{SensorID: sensorID, Start: start, End: start.Add(a.interval)}
+	}
+	a.current.Samples++
+	a.current.SupplyVoltage.add(sample.SupplyVoltage, first)
+	a.current.CurrentAmps.add(sample.CurrentAmps, first)
+	a.current.PowerWatts.add(sample.PowerWatts, first)
+	a.current.EnergyWh = sample.EnergyWh
+	a.current.ChargeAh = sample.ChargeAh
+	return done
+}
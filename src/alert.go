@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/rs/zerolog/log"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpioreg"
+)
+
+// Keeps the ALERT pin and the alert function flag asserted until the mask/enable register is read, so that
+// short alerts are not missed. Reading the register (e.g. by the service) clears the latch.
+func (ina *INA226) EnableAlertLatch() error {
+	ina.maskEnable |= alertLatchEnable
+	return ina.writeRegister(maskEnableReg, ina.maskEnable)
+}
+
+// Returned when reading the mask/enable register would clear a latched alert that is left for an external controller
+var errAlertLatchKept = errors.New("the mask/enable register is not read, since that would clear the latched alert that is left for the external controller")
+
+// Leaves latched alerts for an external controller to clear: the service no longer reads the mask/enable
+// register, also not in the register dump and the register endpoint
+func (ina *INA226) KeepAlertLatched(keep bool) {
+	ina.keepAlertLatched.Store(keep)
+}
+
+// Reports whether the alert function triggered since the last call. Reading the flag clears a latched alert.
+func (ina *INA226) AlertFlag() (bool, error) {
+	value, err := ina.readRegister(maskEnableReg)
+	if err != nil {
+		return false, err
+	}
+	pending := ina.alertPending
+	ina.alertPending = false
+	return pending || value&alertFunctionFlag != 0, nil
+}
+
+// Opens the ALERT pin for reading its level, returns nil when it is not available
+func openAlertPin(name string) gpio.PinIn {
+	pin := gpioreg.ByName(name)
+	if pin == nil {
+		log.Warn().Str("pin", name).Msg("Alert GPIO not available")
+		return nil
+	}
+	if err := pin.In(gpio.PullUp, gpio.NoEdge); err != nil {
+		log.Warn().Str("pin", name).Msgf("Failed to configure alert GPIO: %v", err)
+		return nil
+	}
+	return pin
+}
+
+var (
+	metricAlertLatched   = metrics.gauge("rover_energy_alert_latched", "Whether a latched alert is asserted (1) or not (0), -1 when unknown")
+	metricAlertAutoClear = metrics.gauge("rover_energy_alert_auto_clear", "Whether latched alerts are cleared by the service (1) or externally (0)")
+	metricAlerts         = metrics.counter("rover_energy_alerts_total", "Number of latched alerts that were cleared by the service")
+)
+
+// Handles latched alerts. With auto-clear, the alert flag is read (and thereby cleared) after every sample, so
+// that a stuck-asserted ALERT pin does not mask subsequent events. Without it, the alert is left for an external
+// controller to clear, and its state can only be observed on the ALERT pin (without clearing it).
+type alertMonitor struct {
+	ina       *INA226
+	autoClear bool
+	pin       gpio.PinIn // the ALERT pin (active low), nil when not available
+	latched   bool
+}
+
+func newAlertMonitor(ina *INA226, autoClear bool, pin gpio.PinIn) (*alertMonitor, error) {
+	if err := ina.EnableAlertLatch(); err != nil {
+		return nil, err
+	}
+	ina.KeepAlertLatched(!autoClear)
+	m := &alertMonitor{ina: ina, autoClear: autoClear, pin: pin}
+	metricAlertAutoClear.Set(0)
+	if autoClear {
+		metricAlertAutoClear.Set(1)
+	}
+	metricAlertLatched.Set(-1)
+	log.Info().Bool("autoClear", autoClear).Bool("pin", pin != nil).Msg("Alert latch enabled")
+	return m, nil
+}
+
+// Updates the latched state after a sample, and clears the alert when auto-clear is enabled. Returns whether
+// an alert was raised (with auto-clear) or is latched (without).
+func (m *alertMonitor) observe() bool {
+	if m.autoClear {
+		flag, err := m.ina.AlertFlag()
+		if err != nil {
+			log.Debug().Msgf("unable to read the alert flag: %v", err)
+			return false
+		}
+		if flag {
+			log.Warn().Msg("Alert was raised, cleared it")
+			metricAlerts.Add(1)
+		}
+		// Reading the flag cleared the latch
+		m.latched = false
+		metricAlertLatched.Set(0)
+		return flag
+	}
+
+	if m.pin == nil {
+		return false
+	}
+	latched := m.pin.Read() == gpio.Low
+	if latched && !m.latched {
+		log.Warn().Msg("Alert is latched, waiting for it to be cleared externally")
+	}
+	m.latched = latched
+	if latched {
+		metricAlertLatched.Set(1)
+	} else {
+		metricAlertLatched.Set(0)
+	}
+	return latched
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Switch to the high range when the current exceeds this fraction of the low range's maximum
+	autoRangeUpFraction = 0.9
+	// Switch back to the low range when the current stays below this fraction of the low range's maximum
+	autoRangeDownFraction = 0.5
+)
+
+// Names of the calibration ranges, published with every sample in auto-ranging mode
+const (
+	rangeLow  = "low"
+	rangeHigh = "high"
+)
+
+// Switches the calibration between a high-resolution profile for low currents and a coarse profile for
+// high currents, for rovers with a large dynamic range. Switching up happens as soon as the current
+// approaches the end of the low range, switching down only after the current stayed well within the low
+// range for a number of samples, so that the range does not flap.
+type autoRanger struct {
+	ina         *INA226
+	low         Calibration
+	high        Calibration
+	holdSamples int // consecutive samples below the down threshold before switching down
+	below       int
+	active      string
+}
+
+// Starts in the high range, which never clips
+func newAutoRanger(ina *INA226, high Calibration, lowMaxAmps float64, holdSamples int) (*autoRanger, error) {
+	if lowMaxAmps <= 0 || lowMaxAmps >= high.MaxCurrentAmps {
+		return nil, fmt.Errorf("auto-range-low-max-amps must be between 0 and the maximum current (%v A), got %v", high.MaxCurrentAmps, lowMaxAmps)
+	}
+	low, err := NewCalibration(high.ShuntOhms, lowMaxAmps)
+	if err != nil {
+		return nil, fmt.Errorf("invalid low range: %v", err)
+	}
+	r := &autoRanger{ina: ina, low: low, high: high, holdSamples: max(holdSamples, 1), active: rangeHigh}
+	if err := ina.Calibrate(high); err != nil {
+		return nil, fmt.Errorf("failed to select the high range: %v", err)
+	}
+	return r, nil
+}
+
+// Tags the sample with the active range and switches the range for the next samples if needed
+func (r *autoRanger) observe(sample *CurrentSensorOutput) {
+	sample.Range = r.active
+	amps := math.Abs(sample.CurrentAmps)
+
+	switch r.active {
+	case rangeLow:
+		if amps >= autoRangeUpFraction*r.low.MaxCurrentAmps {
+			r.switchTo(rangeHigh, r.high)
+		}
+	case rangeHigh:
+		if amps < autoRangeDownFraction*r.low.MaxCurrentAmps {
+			r.below++
+		} else {
+			r.below = 0
+		}
+		if r.below >= r.holdSamples {
+			r.switchTo(rangeLow, r.low)
+		}
+	}
+}
+
+func (r *autoRanger) switchTo(name string, cal Calibration) {
+	if err := r.ina.Calibrate(cal); err != nil {
+		log.Warn().Str("range", name).Msgf("unable to switch calibration range: %v", err)
+		return
+	}
+	r.active = name
+	r.below = 0
+	// The next read waits for the new calibration to settle, see INA226.Calibrate
+	log.Debug().Str("range", name).Float64("currentLSB", cal.CurrentLSB).Msg("Switched calibration range")
+}
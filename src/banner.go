@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+
+	roverlib "github.com/VU-ASE/roverlib-go/src"
+	"github.com/rs/zerolog/log"
+)
+
+// Logs the configuration that is actually in use (after applying defaults and presets), as structured fields,
+// so that the logs of a unit show what it runs without having to read its service.yaml
+func logStartupBanner(ina *INA226, bus busOpener, configuration *roverlib.ServiceConfiguration, sinks []string) {
+	cal := ina.Calibration()
+	event := log.Info().
+		Str("bus", bus.String()).
+		Str("address", fmt.Sprintf("0x%02x", ina.dev.Addr)).
+		Float64("shuntOhms", cal.ShuntOhms).
+		Float64("maxCurrentAmps", cal.MaxCurrentAmps).
+		Float64("currentLSB", cal.CurrentLSB).
+		Float64("powerLSB", cal.PowerLSB).
+		Uint16("calibration", cal.Register)
+	if revision, ok := ina.DieRevision(); ok {
+		event = event.Uint8("dieRevision", revision)
+	}
+
+	// The configuration register may have been written by another controller (skip-init), so read it back
+	if value, err := ina.readRegister(configReg); err == nil {
+		decoded := decodeConfig(value)
+		event = event.
+			Int("averaging", decoded.averaging).
+			Int("busConversionUsec", decoded.busConversionUsec).
+			Int("shuntConversionUsec", decoded.shuntConversionUsec).
+			Str("mode", decoded.mode)
+	} else {
+		event = event.Str("configReadError", err.Error())
+	}
+
+	event.
+		Float64("updatesPerSecond", getFloatOr(configuration, "updates-per-second", defaultUpdatesPerSecond)).
+		Str("sampleTrigger", getStringOr(configuration, "sample-trigger", "timer")).
+		Str("powerSource", string(ina.powerSource)).
+		Str("currentMode", string(ina.currentMode)).
+		Str("shuntPlacement", string(ina.shuntPlacement)).
+		Strs("sinks", sinks).
+		Msg("Energy service started")
+}
@@ -0,0 +1,86 @@
+package main
+
+import "time"
+
+// Battery voltage levels, from good to bad
+type batteryLevel int
+
+const (
+	batteryOK batteryLevel = iota
+	batteryLow
+	batteryCritical
+)
+
+// Signals a low battery from the bus voltage alone, since voltage sag is the most reliable predictor of a
+// brownout. The voltage must stay below the low threshold for the debounce time before the battery is reported
+// low (and above it for the debounce time before it is reported ok again), so that sag during a short current
+// spike does not trigger it. Below the critical threshold the battery is reported critical immediately.
+type lowBatteryDetector struct {
+	lowVolts      float64
+	criticalVolts float64 // 0 disables the critical level
+	debounce      time.Duration
+	level         batteryLevel
+	candidate     batteryLevel
+	since         time.Time
+}
+
+func newLowBatteryDetector(lowVolts float64, criticalVolts float64, debounce time.Duration) *lowBatteryDetector {
+	return &lowBatteryDetector{lowVolts: lowVolts, criticalVolts: criticalVolts, debounce: debounce}
+}
+
+// Flags the sample with the battery level and returns the event to publish when the level changed, or an empty string
+func (d *lowBatteryDetector) observe(sample *CurrentSensorOutput) string {
+	event := ""
+	if sample.ValidFields.Has(FieldVoltage) {
+		event = d.update(sample)
+	}
+	sample.LowBattery = d.level >= batteryLow
+	sample.CriticalBattery = d.level == batteryCritical
+	return event
+}
+
+// The status code to publish with the measurements
+func (d *lowBatteryDetector) status() uint32 {
+	switch d.level {
+	case batteryCritical:
+		return statusBatteryCritical
+	case batteryLow:
+		return statusBatteryLow
+	default:
+		return statusOK
+	}
+}
+
+func (d *lowBatteryDetector) update(sample *CurrentSensorOutput) string {
+	volts := sample.SupplyVoltage
+	measured := batteryOK
+	switch {
+	case d.criticalVolts > 0 && volts < d.criticalVolts:
+		measured = batteryCritical
+	case volts < d.lowVolts:
+		measured = batteryLow
+	}
+
+	if measured == d.level {
+		d.candidate = d.level
+		return ""
+	}
+	if measured != d.candidate {
+		d.candidate = measured
+		d.since = sample.Timestamp
+	}
+	// Critical requires immediate action, all other changes are debounced
+	if measured != batteryCritical && sample.Timestamp.Sub(d.since) < d.debounce {
+		return ""
+	}
+
+	d.level = measured
+	switch measured {
+	case batteryCritical:
+		return "battery-critical"
+	case batteryLow:
+		return "battery-low"
+	default:
+		return "battery-ok"
+	}
+}
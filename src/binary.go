@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// Size of an encoded sample in bytes
+	binarySampleSize = 32
+	// The first byte of every binary sample. Protobuf messages on the same stream (e.g. status events) start with
+	// the tag of their first field instead (0x08 for the sensor ID, or 0x10 for the timestamp with sensor ID 0),
+	// so consumers can tell both apart.
+	binarySampleVersion = 1
+)
+
+// The flags of a binary sample
+const (
+	binaryFlagStale        = 1 << 0
+	binaryFlagVoltageValid = 1 << 1
+	binaryFlagCurrentValid = 1 << 2
+	binaryFlagPowerValid   = 1 << 3
+)
+
+// A sample in the fixed-width binary encoding of the stream, selected with stream-encoding. All values are
+// little-endian:
+//
+//	0   uint8   version, 1
+//	1   uint8   status, as in the protobuf messages (e.g. 4 for stale)
+//	2   uint8   flags: bit 0 stale, bit 1 voltage valid, bit 2 current valid, bit 3 power valid
+//	3   uint8   reserved, 0
+//	4   uint32  sensor ID
+//	8   uint32  sequence number, incremented for every sample, so that dropped messages can be detected
+//	12  int64   timestamp in unix microseconds
+//	20  float32 current in amps
+//	24  float32 supply voltage in volts
+//	28  float32 power in watts
+type BinarySample struct {
+	Status        uint8
+	Flags         uint8
+	SensorID      uint32
+	Sequence      uint32
+	Timestamp     time.Time
+	CurrentAmps   float32
+	SupplyVoltage float32
+	PowerWatts    float32
+}
+
+// Encodes the sample into buf, which must hold at least binarySampleSize bytes, and returns the encoded bytes
+func encodeBinarySample(buf []byte, sample BinarySample) []byte {
+	buf = buf[:binarySampleSize]
+	buf[0] = binarySampleVersion
+	buf[1] = sample.Status
+	buf[2] = sample.Flags
+	buf[3] = 0
+	binary.LittleEndian.PutUint32(buf[4:8], sample.SensorID)
+	binary.LittleEndian.PutUint32(buf[8:12], sample.Sequence)
+	binary.LittleEndian.PutUint64(buf[12:20], uint64(sample.Timestamp.UnixMicro()))
+	binary.LittleEndian.PutUint32(buf[20:24], math.Float32bits(sample.CurrentAmps))
+	binary.LittleEndian.PutUint32(buf[24:28], math.Float32bits(sample.SupplyVoltage))
+	binary.LittleEndian.PutUint32(buf[28:32], math.Float32bits(sample.PowerWatts))
+	return buf
+}
+
+// Decodes a message of the stream in the binary encoding. Consumers that receive both encodings check the
+// first byte, see binarySampleVersion.
+func DecodeBinarySample(data []byte) (BinarySample, error) {
+	if len(data) != binarySampleSize {
+		return BinarySample{}, fmt.Errorf("a binary sample has %d bytes, got %d", binarySampleSize, len(data))
+	}
+	if data[0] != binarySampleVersion {
+		return BinarySample{}, fmt.Errorf("unsupported binary sample version %d", data[0])
+	}
+	return BinarySample{
+		Status:        data[1],
+		Flags:         data[2],
+		SensorID:      binary.LittleEndian.Uint32(data[4:8]),
+		Sequence:      binary.LittleEndian.Uint32(data[8:12]),
+		Timestamp:     time.UnixMicro(int64(binary.LittleEndian.Uint64(data[12:20]))),
+		CurrentAmps:   math.Float32frombits(binary.LittleEndian.Uint32(data[20:24])),
+		SupplyVoltage: math.Float32frombits(binary.LittleEndian.Uint32(data[24:28])),
+		PowerWatts:    math.Float32frombits(binary.LittleEndian.Uint32(data[28:32])),
+	}, nil
+}
+
+// Reads the encoding of the samples on the stream, true for the binary encoding
+func readStreamEncoding(encoding string) (bool, error) {
+	switch encoding {
+	case "protobuf":
+		return false, nil
+	case "binary":
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid stream-encoding %q, must be \"protobuf\" or \"binary\"", encoding)
+	}
+}
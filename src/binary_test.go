@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBinarySampleRoundTrip(t *testing.T) {
+	samples := []BinarySample{
+		{},
+		{
+			Status:        4,
+			Flags:         binaryFlagStale | binaryFlagVoltageValid | binaryFlagCurrentValid | binaryFlagPowerValid,
+			SensorID:      math.MaxUint32,
+			Sequence:      12345,
+			Timestamp:     time.Date(2024, 5, 1, 10, 0, 0, 123456000, time.UTC),
+			CurrentAmps:   -1.25,
+			SupplyVoltage: 12.6,
+			PowerWatts:    -15.75,
+		},
+	}
+	for _, sample := range samples {
+		sample.Timestamp = time.UnixMicro(sample.Timestamp.UnixMicro())
+		buf := make([]byte, binarySampleSize)
+		data := encodeBinarySample(buf, sample)
+		if len(data) != binarySampleSize || data[0] != binarySampleVersion {
+			t.Fatalf("encoded %d bytes with version %d, want %d bytes with version %d", len(data), data[0], binarySampleSize, binarySampleVersion)
+		}
+		decoded, err := DecodeBinarySample(data)
+		if err != nil {
+			t.Fatalf("DecodeBinarySample: %v", err)
+		}
+		if decoded != sample {
+			t.Errorf("decoded %+v, want %+v", decoded, sample)
+		}
+	}
+}
+
+func TestBinarySampleLayout(t *testing.T) {
+	data := encodeBinarySample(make([]byte, binarySampleSize), BinarySample{
+		Status:      4,
+		Flags:       binaryFlagCurrentValid,
+		SensorID:    0x01020304,
+		Sequence:    0x05060708,
+		Timestamp:   time.UnixMicro(0x1112131415161718),
+		CurrentAmps: 1,
+	})
+	want := []byte{
+		1, 4, binaryFlagCurrentValid, 0,
+		0x04, 0x03, 0x02, 0x01,
+		0x08, 0x07, 0x06, 0x05,
+		0x18, 0x17, 0x16, 0x15, 0x14, 0x13, 0x12, 0x11,
+		0x00, 0x00, 0x80, 0x3f,
+		0, 0, 0, 0,
+		0, 0, 0, 0,
+	}
+	if !bytes.Equal(data, want) {
+		t.Errorf("encoded % x, want % x", data, want)
+	}
+}
+
+func TestDecodeBinarySampleInvalid(t *testing.T) {
+	valid := encodeBinarySample(make([]byte, binarySampleSize), BinarySample{})
+	wrongVersion := append([]byte{}, valid...)
+	wrongVersion[0] = 2
+	for name, data := range map[string][]byte{
+		"short":    valid[:binarySampleSize-1],
+		"long":     append(append([]byte{}, valid...), 0),
+		"version":  wrongVersion,
+		"protobuf": {0x08, 0x01},
+	} {
+		if _, err := DecodeBinarySample(data); err == nil {
+			t.Errorf("%s: decoded without an error", name)
+		}
+	}
+}
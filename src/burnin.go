@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	roverlib "github.com/VU-ASE/roverlib-go/src"
+	"github.com/rs/zerolog/log"
+)
+
+// Tracks the drift of one quantity over a burn-in run, as the deviation of the window means from the mean
+// of the first window after the warm-up
+type burnInTrack struct {
+	quantity string
+	value    transformQuantity
+	limit    float64 // maximum drift that passes, 0 does not check the quantity
+	// The window in progress
+	sum     float64
+	samples int
+	// The completed windows
+	reference     float64
+	haveReference bool
+	maxDrift      float64 // signed, the window mean that deviated most from the reference
+	// Welford's running mean and variance of all samples after the warm-up, for the noise
+	count int
+	mean  float64
+	m2    float64
+}
+
+func (t *burnInTrack) add(sample *CurrentSensorOutput) {
+	value, ok := t.value(sample)
+	if !ok {
+		return
+	}
+	t.sum += *value
+	t.samples++
+	t.count++
+	delta := *value - t.mean
+	t.mean += delta / float64(t.count)
+	t.m2 += delta * (*value - t.mean)
+}
+
+// Completes the window in progress, returns the drift of its mean
+func (t *burnInTrack) closeWindow() float64 {
+	if t.samples == 0 {
+		return 0
+	}
+	mean := t.sum / float64(t.samples)
+	t.sum = 0
+	t.samples = 0
+	if !t.haveReference {
+		t.reference = mean
+		t.haveReference = true
+		return 0
+	}
+	drift := mean - t.reference
+	if math.Abs(drift) > math.Abs(t.maxDrift) {
+		t.maxDrift = drift
+	}
+	return drift
+}
+
+func (t *burnInTrack) noise() float64 {
+	if t.count < 2 {
+		return 0
+	}
+	return math.Sqrt(t.m2 / float64(t.count-1))
+}
+
+func (t *burnInTrack) passed() bool {
+	return t.limit <= 0 || math.Abs(t.maxDrift) <= t.limit
+}
+
+// The result of a quantity in the burn-in report
+type burnInResult struct {
+	Reference float64 `json:"reference"`
+	MaxDrift  float64 `json:"maxDrift"`
+	Limit     float64 `json:"limit"`
+	Noise     float64 `json:"noise"`
+	Passed    bool    `json:"passed"`
+}
+
+// The burn-in report as it is written to burn-in-report-path
+type burnInReport struct {
+	Start           time.Time               `json:"start"`
+	DurationSeconds float64                 `json:"durationSeconds"`
+	SamplesPerSec   float64                 `json:"samplesPerSecond"`
+	Windows         int                     `json:"windows"`
+	Passed          bool                    `json:"passed"`
+	Quantities      map[string]burnInResult `json:"quantities"`
+}
+
+// Runs the incoming inspection of a sensor board: at a fixed rate and a constant (or no) load, the readings
+// are averaged over windows after a warm-up, and the board passes when no window mean of the current, voltage
+// and power drifts from the first one by more than its limit.
+type burnIn struct {
+	start       time.Time
+	duration    time.Duration
+	warmup      time.Duration
+	window      time.Duration
+	rate        float64 // the fixed updates-per-second of the run
+	path        string
+	windowStart time.Time
+	windows     int // completed windows, including the reference window
+	tracks      []*burnInTrack
+}
+
+// Reads the burn-in configuration, nil when burn-in-seconds is 0. The rate is the updates-per-second at startup.
+func readBurnIn(configuration *roverlib.ServiceConfiguration, rate float64) (*burnIn, error) {
+	seconds := getFloatOr(configuration, "burn-in-seconds", 0)
+	if seconds <= 0 {
+		return nil, nil
+	}
+
+	b := &burnIn{
+		start:    time.Now(),
+		duration: time.Duration(seconds * float64(time.Second)),
+		warmup:   time.Duration(getFloatOr(configuration, "burn-in-warmup-seconds", 300) * float64(time.Second)),
+		window:   time.Duration(getFloatOr(configuration, "burn-in-window-seconds", 600) * float64(time.Second)),
+		rate:     rate,
+		path:     getStringOr(configuration, "burn-in-report-path", ""),
+	}
+	if b.warmup < 0 {
+		return nil, fmt.Errorf("burn-in-warmup-seconds must not be negative, got %v", b.warmup.Seconds())
+	}
+	if b.window <= 0 {
+		return nil, fmt.Errorf("burn-in-window-seconds must be positive, got %v", b.window.Seconds())
+	}
+	if b.duration < b.warmup+2*b.window {
+		return nil, fmt.Errorf("burn-in-seconds must cover the warm-up and at least two windows (%v)", (b.warmup + 2*b.window).Seconds())
+	}
+
+	limits := []struct {
+		quantity string
+		option   string
+		fallback float64
+	}{
+		{"current", "burn-in-max-drift-amps", 0.001},
+		{"voltage", "burn-in-max-drift-volts", 0.01},
+		{"power", "burn-in-max-drift-watts", 0.01},
+	}
+	for _, l := range limits {
+		limit := getFloatOr(configuration, l.option, l.fallback)
+		if limit < 0 {
+			return nil, fmt.Errorf("%s must not be negative, got %v", l.option, limit)
+		}
+		b.tracks = append(b.tracks, &burnInTrack{quantity: l.quantity, value: transformQuantities[l.quantity], limit: limit})
+	}
+
+	log.Info().
+		Dur("duration", b.duration).
+		Dur("warmup", b.warmup).
+		Dur("window", b.window).
+		Float64("samplesPerSecond", rate).
+		Msg("Starting the burn-in, keep the load constant for the whole run")
+	return b, nil
+}
+
+// Records a sample, completing a window when it has elapsed
+func (b *burnIn) observe(sample *CurrentSensorOutput) {
+	if sample.Timestamp.Sub(b.start) < b.warmup {
+		return
+	}
+	if b.windowStart.IsZero() {
+		b.windowStart = sample.Timestamp
+	}
+	if sample.Timestamp.Sub(b.windowStart) >= b.window {
+		event := log.Info().Int("window", b.windows)
+		for _, track := range b.tracks {
+			event = event.Float64(track.quantity+"Drift", track.closeWindow())
+		}
+		event.Msg("Burn-in window completed")
+		b.windows++
+		b.windowStart = sample.Timestamp
+	}
+	for _, track := range b.tracks {
+		track.add(sample)
+	}
+}
+
+func (b *burnIn) done() bool {
+	return time.Since(b.start) >= b.duration
+}
+
+// Logs the drift statistics and the verdict, and writes them to the report path if configured. The window in
+// progress is left out, so that every window mean covers the same time.
+func (b *burnIn) report() bool {
+	report := burnInReport{
+		Start:           b.start,
+		DurationSeconds: time.Since(b.start).Seconds(),
+		SamplesPerSec:   b.rate,
+		Windows:         b.windows,
+		// Without a window to compare against the reference, nothing was shown about the drift
+		Passed:     b.windows >= 2,
+		Quantities: map[string]burnInResult{},
+	}
+	for _, track := range b.tracks {
+		result := burnInResult{
+			Reference: track.reference,
+			MaxDrift:  track.maxDrift,
+			Limit:     track.limit,
+			Noise:     track.noise(),
+			Passed:    track.passed(),
+		}
+		report.Quantities[track.quantity] = result
+		report.Passed = report.Passed && result.Passed
+
+		log.Info().
+			Str("quantity", track.quantity).
+			Float64("reference", result.Reference).
+			Float64("maxDrift", result.MaxDrift).
+			Float64("limit", result.Limit).
+			Float64("noise", result.Noise).
+			Bool("passed", result.Passed).
+			Msg("Burn-in drift")
+	}
+	if report.Passed {
+		log.Info().Int("windows", report.Windows).Msg("Burn-in passed")
+	} else {
+		log.Error().Int("windows", report.Windows).Msg("Burn-in failed, the readings drifted beyond the limits")
+	}
+
+	if b.path != "" {
+		payload, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			log.Warn().Msgf("unable to encode burn-in report: %v", err)
+			return report.Passed
+		}
+		if err := os.WriteFile(b.path, append(payload, '\n'), 0o644); err != nil {
+			log.Warn().Str("path", b.path).Msgf("unable to write burn-in report: %v", err)
+			return report.Passed
+		}
+		log.Info().Str("path", b.path).Msg("Wrote burn-in report")
+	}
+	return report.Passed
+}
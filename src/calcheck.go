@@ -0,0 +1,71 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Readings below this many current LSBs are dominated by quantization and not compared
+	calibrationCheckMinLSBs = 10
+	// Minimum number of compared readings in a window for a verdict
+	calibrationCheckMinSamples = 100
+)
+
+// Cross-checks the current register against the current derived from the shunt voltage register (shunt voltage
+// divided by the shunt resistance). The chip computes the current register from the same shunt voltage and the
+// calibration register, so a persistent mismatch means that the calibration register does not hold what the
+// service wrote (e.g. it was corrupted). The registers are read one after the other and may come from different
+// conversions, so the magnitudes are summed over a window before they are compared.
+type calibrationChecker struct {
+	tolerance   float64 // relative difference that triggers a warning, 0 disables
+	window      detectorWindow
+	compared    int
+	sumRegister float64
+	sumDerived  float64
+}
+
+func newCalibrationChecker(tolerance float64) *calibrationChecker {
+	return &calibrationChecker{tolerance: tolerance}
+}
+
+func (c *calibrationChecker) enabled() bool {
+	return c.tolerance > 0
+}
+
+// Records a reading, the current before the zero-current offset is subtracted. Warns once per window while
+// the register and the derived current diverge by more than the tolerance.
+func (c *calibrationChecker) observe(now time.Time, currentAmps float64, shuntVolts float64, cal Calibration) {
+	derived := shuntVolts / cal.ShuntOhms
+	if math.Abs(derived) >= calibrationCheckMinLSBs*cal.CurrentLSB {
+		c.sumRegister += math.Abs(currentAmps)
+		c.sumDerived += math.Abs(derived)
+		c.compared++
+	}
+	if !c.window.add(now) {
+		return
+	}
+
+	if c.compared >= calibrationCheckMinSamples {
+		ratio := c.sumRegister / c.sumDerived
+		if math.Abs(ratio-1) <= c.tolerance {
+			faults.clear(faultCalibrationMismatch)
+		} else {
+			faults.raise(faultCalibrationMismatch)
+			log.Warn().
+				Float64("registerAmps", c.sumRegister/float64(c.compared)).
+				Float64("shuntDerivedAmps", c.sumDerived/float64(c.compared)).
+				Float64("ratio", ratio).
+				Uint16("expectedCalibration", cal.Register).
+				Float64("impliedCalibration", math.Round(float64(cal.Register)*ratio)).
+				Msg("The current register does not match the current derived from the shunt voltage, the calibration register is probably wrong or corrupted")
+		}
+	}
+
+	c.window.reset()
+	c.compared = 0
+	c.sumRegister = 0
+	c.sumDerived = 0
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"math"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Resolution of the distribution of the observed current, in buckets over the calibrated range
+	adviceBuckets = 1024
+	// The percentile of the observed current that the suggested range is based on, so that rare spikes
+	// do not cost resolution for the rest of the run
+	advicePercentile = 0.99
+	// Fewer samples than this do not say enough about the current that flows
+	adviceMinSamples = 100
+)
+
+// Analyzes the current that was observed over the run and suggests the max-current-amps that maximizes the
+// resolution without clipping. Purely advisory, the calibration is never changed.
+type calibrationAdvisor struct {
+	cal      Calibration
+	buckets  [adviceBuckets]int
+	samples  int
+	clipped  int
+	peakAmps float64
+	// Observed by the loop, advised on from the termination handler
+	lock sync.Mutex
+}
+
+func newCalibrationAdvisor(cal Calibration) *calibrationAdvisor {
+	return &calibrationAdvisor{cal: cal}
+}
+
+func (a *calibrationAdvisor) observe(currentAmps float64) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	amps := math.Abs(currentAmps)
+	bucket := int(amps / a.cal.MaxCurrentAmps * adviceBuckets)
+	a.buckets[min(bucket, adviceBuckets-1)]++
+	if amps >= clipFullScaleFraction*a.cal.MaxCurrentAmps {
+		a.clipped++
+	}
+	a.peakAmps = math.Max(a.peakAmps, amps)
+	a.samples++
+}
+
+// The upper edge of the bucket that holds the given percentile of the observed current
+func (a *calibrationAdvisor) percentile(p float64) float64 {
+	target := int(math.Ceil(p * float64(a.samples)))
+	seen := 0
+	for i, count := range a.buckets {
+		seen += count
+		if seen >= target {
+			return float64(i+1) / adviceBuckets * a.cal.MaxCurrentAmps
+		}
+	}
+	return a.cal.MaxCurrentAmps
+}
+
+// Logs the suggested max-current-amps for the current that was observed so far
+func (a *calibrationAdvisor) advise() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.samples < adviceMinSamples {
+		return
+	}
+
+	p99 := a.percentile(advicePercentile)
+	clippedFraction := float64(a.clipped) / float64(a.samples)
+	suggested := roundUpSignificant(p99*clipSuggestionHeadroom, 2)
+
+	// The range cannot exceed what the shunt ADC can measure, nor be so small that the calibration register overflows
+	shuntLimit := shuntVoltageFullScale / a.cal.ShuntOhms
+	registerLimit := calibrationScale * currentLSBDivisor / (maxCalibrationValue * a.cal.ShuntOhms)
+	suggested = min(max(suggested, registerLimit), shuntLimit)
+
+	event := log.Info().
+		Int("samples", a.samples).
+		Float64("p99Amps", p99).
+		Float64("peakAmps", a.peakAmps).
+		Float64("clippedFraction", clippedFraction).
+		Float64("maxCurrentAmps", a.cal.MaxCurrentAmps).
+		Float64("suggestedMaxCurrentAmps", suggested)
+	switch {
+	case clippedFraction > 1-advicePercentile:
+		// The real current is hidden by the saturation, so the observed distribution says too little
+		event.Msgf("The current often clips at full scale, increase max-current-amps beyond %.3f A (up to %.3f A for this shunt)", a.cal.MaxCurrentAmps, shuntLimit)
+	case suggested == shuntLimit && p99*clipSuggestionHeadroom > shuntLimit:
+		event.Msgf("The observed current is close to what the shunt can measure, set max-current-amps to %.3f A or use a smaller shunt", suggested)
+	default:
+		event.Msgf("Calibration advice: set max-current-amps to %.3f A for a resolution of %.1f uA/bit (now %.1f uA/bit)",
+			suggested, suggested/currentLSBDivisor*1e6, a.cal.CurrentLSB*1e6)
+	}
+}
+
+// Rounds up to the given number of significant digits, so that the advice is a value that is easy to type
+func roundUpSignificant(v float64, digits int) float64 {
+	if v <= 0 {
+		return v
+	}
+	scale := math.Pow10(digits - 1 - int(math.Floor(math.Log10(v))))
+	return math.Ceil(v*scale) / scale
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Samples waiting for the callbacks, if the callbacks cannot keep up newer samples are dropped
+const sampleCallbackQueueSize = 64
+
+// Callbacks that are invoked with every successfully read sample, so that applications embedding the driver can
+// plug in their own processing. The callbacks run in a separate goroutine, so a slow callback never delays reading.
+type sampleCallbacks struct {
+	lock    sync.Mutex
+	fns     []func(CurrentSensorOutput)
+	queue   chan CurrentSensorOutput
+	dropped int
+	// The callbacks with the raw register bytes, see OnRawSample
+	rawFns     []func(RawSample)
+	rawQueue   chan RawSample
+	rawDropped int
+}
+
+// A register read of a sample, with the two bytes in the order they were transferred on the bus
+type RawRead struct {
+	Register uint8
+	Bytes    [2]byte
+}
+
+// A sample together with the register reads it was decoded from, in the order they were read. Registers that
+// were not read for the sample (e.g. the bus voltage that is reused with voltage-sample-divisor) are left out.
+type RawSample struct {
+	Sample CurrentSensorOutput
+	Reads  []RawRead
+}
+
+// Registers a callback that is invoked with a copy of every sample that is handed to DispatchSample, which the
+// service does for every published sample. Callbacks are invoked one after the other, in registration order,
+// from a single goroutine.
+func (ina *INA226) OnSample(fn func(CurrentSensorOutput)) {
+	c := &ina.callbacks
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.queue == nil {
+		c.queue = make(chan CurrentSensorOutput, sampleCallbackQueueSize)
+		go c.run()
+	}
+	c.fns = append(c.fns, fn)
+}
+
+// Registers a callback that is invoked with every sample that DispatchSample hands on as read, and the raw bytes
+// of the register reads it was decoded from, e.g. to capture the exact wire data for offline analysis or a byte-accurate replay.
+// The reads are only recorded while a raw callback is registered. Invoked like the OnSample callbacks, from a
+// goroutine of their own.
+func (ina *INA226) OnRawSample(fn func(RawSample)) {
+	c := &ina.callbacks
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.rawQueue == nil {
+		c.rawQueue = make(chan RawSample, sampleCallbackQueueSize)
+		go c.runRaw()
+	}
+	c.rawFns = append(c.rawFns, fn)
+}
+
+// Hands a sample to the callbacks, as it is published (e.g. with the corrections applied). Set read when it is the
+// sample of the last ReadSensorDataInto, rather than e.g. a gap-fill or interpolated sample, which then also
+// goes to the raw callbacks together with the register reads of that read.
+func (ina *INA226) DispatchSample(sample *CurrentSensorOutput, read bool) {
+	ina.callbacks.dispatch(sample)
+	if !read {
+		return
+	}
+	ina.sampleLock.Lock()
+	defer ina.sampleLock.Unlock()
+	// Nothing was recorded when no raw callback was registered at the time of the read
+	if len(ina.rawReads) > 0 {
+		ina.callbacks.dispatchRaw(sample, ina.rawReads)
+	}
+}
+
+func (c *sampleCallbacks) run() {
+	for sample := range c.queue {
+		c.lock.Lock()
+		fns := c.fns
+		c.lock.Unlock()
+
+		for _, fn := range fns {
+			fn(sample)
+		}
+	}
+}
+
+// Hands the sample to the callbacks without blocking
+func (c *sampleCallbacks) dispatch(sample *CurrentSensorOutput) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.queue == nil {
+		return
+	}
+	select {
+	case c.queue <- detachSample(sample):
+	default:
+		c.dropped++
+		if c.dropped%sampleCallbackQueueSize == 1 {
+			log.Warn().Int("dropped", c.dropped).Msg("Sample callbacks cannot keep up, dropping samples")
+		}
+	}
+}
+
+func (c *sampleCallbacks) runRaw() {
+	for sample := range c.rawQueue {
+		c.lock.Lock()
+		fns := c.rawFns
+		c.lock.Unlock()
+
+		for _, fn := range fns {
+			fn(sample)
+		}
+	}
+}
+
+// Copies the sample together with the values of its pointer fields, which point into the sensor and the
+// estimators and are overwritten by the next sample, so that the copy can be handed to another goroutine. The
+// faults are shared, the fault tracker replaces the list rather than modifying it.
+func detachSample(sample *CurrentSensorOutput) CurrentSensorOutput {
+	out := *sample
+	out.RemainingRuntimeMinutes = copyValue(sample.RemainingRuntimeMinutes)
+	out.RemainingRuntimeMinutesLow = copyValue(sample.RemainingRuntimeMinutesLow)
+	out.RemainingRuntimeMinutesHigh = copyValue(sample.RemainingRuntimeMinutesHigh)
+	out.StateOfChargePercent = copyValue(sample.StateOfChargePercent)
+	out.OCVStateOfChargePercent = copyValue(sample.OCVStateOfChargePercent)
+	out.RemainingChargeAh = copyValue(sample.RemainingChargeAh)
+	out.InputPowerWatts = copyValue(sample.InputPowerWatts)
+	out.EfficiencyPercent = copyValue(sample.EfficiencyPercent)
+	out.Raw = copyValue(sample.Raw)
+	return out
+}
+
+// A pointer to a copy of the value, nil for nil
+func copyValue[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+// Whether raw callbacks are registered, so that the register reads need to be recorded
+func (c *sampleCallbacks) wantRaw() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.rawQueue != nil
+}
+
+// Hands the sample and a copy of its reads to the raw callbacks without blocking
+func (c *sampleCallbacks) dispatchRaw(sample *CurrentSensorOutput, reads []RawRead) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.rawQueue == nil {
+		return
+	}
+	select {
+	case c.rawQueue <- RawSample{Sample: detachSample(sample), Reads: append([]RawRead(nil), reads...)}:
+	default:
+		c.rawDropped++
+		if c.rawDropped%sampleCallbackQueueSize == 1 {
+			log.Warn().Int("dropped", c.rawDropped).Msg("Raw sample callbacks cannot keep up, dropping samples")
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+
+	"periph.io/x/conn/v3/i2c"
+)
+
+func TestRawSampleReads(t *testing.T) {
+	tests := []struct {
+		name  string
+		order binary.ByteOrder
+		wrap  func(*fakeBus) i2c.BusCloser
+		// The bytes of the registers as transferred on the bus
+		want []RawRead
+	}{
+		{"big", binary.BigEndian, func(b *fakeBus) i2c.BusCloser { return b }, []RawRead{
+			{Register: currentReg, Bytes: [2]byte{0x12, 0x34}},
+			{Register: busVoltReg, Bytes: [2]byte{0x25, 0x80}},
+			{Register: powerReg, Bytes: [2]byte{0x01, 0xf4}},
+		}},
+		{"little", binary.LittleEndian, func(b *fakeBus) i2c.BusCloser { return swappingBus{b} }, []RawRead{
+			{Register: currentReg, Bytes: [2]byte{0x34, 0x12}},
+			{Register: busVoltReg, Bytes: [2]byte{0x80, 0x25}},
+			{Register: powerReg, Bytes: [2]byte{0xf4, 0x01}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cal, err := NewCalibration(0.002, 10)
+			if err != nil {
+				t.Fatalf("NewCalibration: %v", err)
+			}
+			bus := newFakeBus()
+			ina, err := NewINA226(tt.wrap(bus), INA226Options{Calibration: cal, ByteOrder: tt.order})
+			if err != nil {
+				t.Fatalf("NewINA226: %v", err)
+			}
+			ina.SetReadPlan(ReadPlan{BusVoltage: true, Power: true})
+			bus.set(currentReg, 0x1234)
+			bus.set(busVoltReg, 0x2580)
+			bus.set(powerReg, 0x01f4)
+
+			received := make(chan RawSample, 1)
+			ina.OnRawSample(func(sample RawSample) {
+				received <- sample
+			})
+			sample, err := ina.ReadSensorData()
+			if err != nil {
+				t.Fatalf("ReadSensorData: %v", err)
+			}
+			// Reading alone does not invoke the callbacks, publishing does
+			ina.DispatchSample(sample, true)
+
+			select {
+			case raw := <-received:
+				if !reflect.DeepEqual(raw.Reads, tt.want) {
+					t.Errorf("reads %+v, want %+v", raw.Reads, tt.want)
+				}
+				if raw.Sample.CurrentAmps != sample.CurrentAmps || !raw.Sample.Timestamp.Equal(sample.Timestamp) {
+					t.Errorf("raw callback got sample %+v, want %+v", raw.Sample, *sample)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("the raw callback was not invoked")
+			}
+		})
+	}
+}
+
+func TestDispatchSample(t *testing.T) {
+	cal, err := NewCalibration(0.002, 10)
+	if err != nil {
+		t.Fatalf("NewCalibration: %v", err)
+	}
+	ina := newFakeINA226(t, newFakeBus(), cal)
+	samples := make(chan CurrentSensorOutput, 2)
+	raws := make(chan RawSample, 2)
+	ina.OnSample(func(sample CurrentSensorOutput) {
+		samples <- sample
+	})
+	ina.OnRawSample(func(sample RawSample) {
+		raws <- sample
+	})
+
+	read, err := ina.ReadSensorData()
+	if err != nil {
+		t.Fatalf("ReadSensorData: %v", err)
+	}
+	// The callbacks get the sample as published, e.g. after the cumulative energy was added
+	published := *read
+	published.EnergyWh = 1.5
+	ina.DispatchSample(&published, true)
+	// A gap-fill sample is no read, so it does not reach the raw callbacks
+	ina.DispatchSample(&CurrentSensorOutput{Stale: true}, false)
+
+	for i, want := range []CurrentSensorOutput{published, {Stale: true}} {
+		select {
+		case sample := <-samples:
+			if sample.EnergyWh != want.EnergyWh || sample.Stale != want.Stale {
+				t.Errorf("sample %d is %+v, want %+v", i, sample, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("the sample callback was not invoked for sample %d", i)
+		}
+	}
+	select {
+	case raw := <-raws:
+		if raw.Sample.EnergyWh != published.EnergyWh || len(raw.Reads) == 0 {
+			t.Errorf("raw callback got %+v, want the published sample with its reads", raw)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the raw callback was not invoked")
+	}
+	select {
+	case raw := <-raws:
+		t.Errorf("raw callback got the gap-fill sample %+v", raw)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// Run with -race: the estimators overwrite the values behind the pointer fields with the next sample, while the
+// callbacks may still read the previous one
+func TestDispatchSampleCopiesPointerFields(t *testing.T) {
+	cal, err := NewCalibration(0.002, 10)
+	if err != nil {
+		t.Fatalf("NewCalibration: %v", err)
+	}
+	ina := newFakeINA226(t, newFakeBus(), cal)
+	received := make(chan CurrentSensorOutput, 1)
+	ina.OnSample(func(sample CurrentSensorOutput) {
+		received <- sample
+	})
+
+	minutes, percent, raw := 42.0, 80.0, RawRegisters{Current: 1000}
+	ina.DispatchSample(&CurrentSensorOutput{RemainingRuntimeMinutes: &minutes, StateOfChargePercent: &percent, Raw: &raw}, false)
+	// The next estimate, made while the callback runs
+	minutes, percent, raw.Current = 41, 79, 999
+
+	select {
+	case sample := <-received:
+		if *sample.RemainingRuntimeMinutes != 42 || *sample.StateOfChargePercent != 80 || sample.Raw.Current != 1000 {
+			t.Errorf("callback got %v min, %v %% and current register %d, want the values at dispatch",
+				*sample.RemainingRuntimeMinutes, *sample.StateOfChargePercent, sample.Raw.Current)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the sample callback was not invoked")
+	}
+}
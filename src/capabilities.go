@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// Describes what this sensor publishes, so that downstream tooling can set up its schema without
+// hard-coding assumptions about the sensor
+type sensorCapabilities struct {
+	SensorID         uint32                  `json:"sensorId"`
+	SensorName       string                  `json:"sensorName"`
+	Version          string                  `json:"version"`
+	SchemaVersion    int                     `json:"schemaVersion"`
+	Fields           []string                `json:"fields"`
+	Units            map[string]string       `json:"units"`
+	SamplesPerSecond float64                 `json:"samplesPerSecond"`
+	PowerSource      PowerSource             `json:"powerSource"`
+	Calibration      capabilitiesCalibration `json:"calibration"`
+	AutoRange        bool                    `json:"autoRange"`
+}
+
+type capabilitiesCalibration struct {
+	ShuntOhms      float64 `json:"shuntOhms"`
+	MaxCurrentAmps float64 `json:"maxCurrentAmps"`
+	CurrentLSB     float64 `json:"currentLSB"`
+	PowerLSB       float64 `json:"powerLSB"`
+}
+
+// The units of the published fields, the cumulative ones follow energy-unit and charge-unit
+func capabilitiesUnits(units unitConverter) map[string]string {
+	return map[string]string{
+		"supplyVoltage": "V",
+		"currentAmps":   "A",
+		"powerWatts":    "W",
+		"shuntVoltage":  "V",
+		"energy":        units.energy.symbol,
+		"charge":        units.charge.symbol,
+	}
+}
+
+// The last announced capabilities as JSON, re-sent to consumers that (re)connect
+type capabilitiesStore struct {
+	payload []byte
+	lock    sync.Mutex
+}
+
+var announcedCapabilities = &capabilitiesStore{}
+
+func (s *capabilitiesStore) set(capabilities sensorCapabilities) error {
+	payload, err := json.Marshal(capabilities)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.payload = payload
+	return nil
+}
+
+// Returns the capabilities as JSON, nil until they are announced
+func (s *capabilitiesStore) get() []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.payload
+}
+
+// Serves the capabilities on GET /capabilities
+func registerCapabilitiesEndpoint() {
+	httpMux.HandleFunc("GET /capabilities", func(w http.ResponseWriter, _ *http.Request) {
+		payload := announcedCapabilities.get()
+		if payload == nil {
+			http.Error(w, "capabilities are not known yet", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(payload)
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Supplies the published state of charge, either estimated in software or read from a fuel gauge IC
+type ChargeSource interface {
+	// Identifies the source in the samples, e.g. "software" or "bq27441"
+	Name() string
+	// Returns the state of charge in percent and the remaining charge in Ah (NaN when the source does not
+	// provide it). ok is false while the source has no estimate yet.
+	ReadCharge() (percent float64, remainingAh float64, ok bool, err error)
+}
+
+// The state of charge that is estimated by the socEstimator
+type softwareChargeSource struct {
+	estimator *socEstimator
+}
+
+func (s softwareChargeSource) Name() string {
+	return "software"
+}
+
+func (s softwareChargeSource) ReadCharge() (float64, float64, bool, error) {
+	return s.estimator.percent, math.NaN(), s.estimator.valid, nil
+}
+
+// Publishes the state of charge of the first source that has an estimate, so that a fuel gauge is preferred
+// over the software estimate, which takes over while the fuel gauge cannot be read
+type chargeSelector struct {
+	sources     []ChargeSource
+	percent     float64
+	remainingAh float64
+	// The source that was used for the previous sample, to log when it changes
+	current string
+}
+
+func newChargeSelector(sources ...ChargeSource) *chargeSelector {
+	return &chargeSelector{sources: sources}
+}
+
+// Fills in the state of charge of the sample, after the software estimate was made
+func (c *chargeSelector) apply(sample *CurrentSensorOutput) {
+	sample.StateOfChargePercent = nil
+	sample.RemainingChargeAh = nil
+	sample.ChargeSource = ""
+	for _, source := range c.sources {
+		percent, remainingAh, ok, err := source.ReadCharge()
+		if err != nil {
+			log.Debug().Str("source", source.Name()).Msgf("unable to read the state of charge: %v", err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		if source.Name() != c.current {
+			log.Info().Str("source", source.Name()).Msg("Publishing the state of charge from a different source")
+			c.current = source.Name()
+		}
+		// Points into the selector, which overwrites it with the next sample (see detachSample)
+		c.percent = percent
+		c.remainingAh = remainingAh
+		sample.StateOfChargePercent = &c.percent
+		if !math.IsNaN(remainingAh) {
+			sample.RemainingChargeAh = &c.remainingAh
+		}
+		sample.ChargeSource = source.Name()
+		metricStateOfCharge.Set(percent)
+		return
+	}
+	metricStateOfCharge.Set(-1)
+}
+
+// Limits how often a source is read, since fuel gauges only update their estimates about once per second
+type throttledChargeSource struct {
+	ChargeSource
+	interval    time.Duration
+	last        time.Time
+	percent     float64
+	remainingAh float64
+	ok          bool
+	err         error
+}
+
+func (t *throttledChargeSource) ReadCharge() (float64, float64, bool, error) {
+	if time.Since(t.last) >= t.interval {
+		t.percent, t.remainingAh, t.ok, t.err = t.ChargeSource.ReadCharge()
+		t.last = time.Now()
+	}
+	return t.percent, t.remainingAh, t.ok, t.err
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Decoded values of the configuration register fields (datasheet section 7.6.1)
+var (
+	averagingCounts     = []int{1, 4, 16, 64, 128, 256, 512, 1024}
+	conversionTimesUsec = []int{140, 204, 332, 588, 1100, 2116, 4156, 8244}
+	operatingModes      = []string{
+		"power-down",
+		"shunt voltage, triggered",
+		"bus voltage, triggered",
+		"shunt and bus voltage, triggered",
+		"power-down",
+		"shunt voltage, continuous",
+		"bus voltage, continuous",
+		"shunt and bus voltage, continuous",
+	}
+)
+
+// The decoded fields of the configuration register
+type chipConfig struct {
+	averaging           int
+	busConversionUsec   int
+	shuntConversionUsec int
+	mode                string
+	modeBits            uint16
+}
+
+func decodeConfig(value uint16) chipConfig {
+	return chipConfig{
+		averaging:           averagingCounts[(value>>9)&0x7],
+		busConversionUsec:   conversionTimesUsec[(value>>6)&0x7],
+		shuntConversionUsec: conversionTimesUsec[(value>>3)&0x7],
+		mode:                operatingModes[value&0x7],
+		modeBits:            value & 0x7,
+	}
+}
+
+// The time between two fresh conversions in continuous mode: every averaged sample takes one conversion of each
+// enabled channel. Returns 0 when the chip does not convert continuously (power-down or triggered).
+func (c chipConfig) conversionPeriod() time.Duration {
+	perSample := 0
+	switch c.modeBits {
+	case 5: // shunt voltage, continuous
+		perSample = c.shuntConversionUsec
+	case 6: // bus voltage, continuous
+		perSample = c.busConversionUsec
+	case 7: // shunt and bus voltage, continuous
+		perSample = c.shuntConversionUsec + c.busConversionUsec
+	}
+	return time.Duration(c.averaging*perSample) * time.Microsecond
+}
+
+// Reads the configuration register and returns the time between two fresh conversions, see chipConfig.conversionPeriod
+func (ina *INA226) ConversionPeriod() (time.Duration, error) {
+	value, err := ina.readRegister(configReg)
+	if err != nil {
+		return 0, err
+	}
+	return decodeConfig(value).conversionPeriod(), nil
+}
+
+// The quantities that the operating mode keeps converting. The current (and shunt voltage) need the shunt
+// channel and the bus voltage the bus channel, while the power register is the product of the current and the
+// bus voltage, so it is only fresh when both channels are enabled. In the other modes it keeps multiplying a
+// stale reading of the disabled channel. Nothing is converted in power-down.
+func (c chipConfig) convertedFields() FieldMask {
+	fields := FieldMask(0)
+	if c.modeBits&0x1 != 0 {
+		fields |= FieldCurrent | FieldShuntVoltage
+	}
+	if c.modeBits&0x2 != 0 {
+		fields |= FieldVoltage
+	}
+	if c.modeBits&0x3 == 0x3 {
+		fields |= FieldPower
+	}
+	return fields
+}
+
+// Reads the configuration register and returns the decoded operating mode, see chipConfig.convertedFields
+func (ina *INA226) OperatingMode() (chipConfig, error) {
+	value, err := ina.readRegister(configReg)
+	if err != nil {
+		return chipConfig{}, err
+	}
+	return decodeConfig(value), nil
+}
+
+// Reads the configuration register and returns the number of samples that the chip averages per conversion
+func (ina *INA226) Averaging() (int, error) {
+	value, err := ina.readRegister(configReg)
+	if err != nil {
+		return 0, err
+	}
+	return decodeConfig(value).averaging, nil
+}
+
+// Flags of the mask/enable register, from the most to the least significant bit (datasheet section 7.6.7)
+var maskEnableFlags = []struct {
+	bit  uint
+	name string
+}{
+	{15, "shunt over-voltage (SOL)"},
+	{14, "shunt under-voltage (SUL)"},
+	{13, "bus over-voltage (BOL)"},
+	{12, "bus under-voltage (BUL)"},
+	{11, "power over-limit (POL)"},
+	{10, "conversion ready alert (CNVR)"},
+	{4, "alert function flag (AFF)"},
+	{3, "conversion ready flag (CVRF)"},
+	{2, "math overflow flag (OVF)"},
+	{1, "alert polarity active-high (APOL)"},
+	{0, "alert latch enable (LEN)"},
+}
+
+// Returns a human-readable dump of all registers of the chip, decoded, together with the calibration that the
+// service uses to convert the readings. Meant to be copied into support tickets. Reading the mask/enable register
+// clears a latched alert, so it is skipped while the latch is left for an external controller.
+func (ina *INA226) DumpState() string {
+	// The calibration may be switched by the read loop meanwhile (auto-ranging)
+	ina.sampleLock.Lock()
+	defer ina.sampleLock.Unlock()
+
+	b := &strings.Builder{}
+	registers := []struct {
+		name string
+		reg  uint8
+	}{
+		{"configuration", configReg},
+		{"shunt voltage", shuntVoltReg},
+		{"bus voltage", busVoltReg},
+		{"power", powerReg},
+		{"current", currentReg},
+		{"calibration", calibrationReg},
+		{"mask/enable", maskEnableReg},
+		{"alert limit", alertLimitReg},
+		{"manufacturer ID", manufIDReg},
+		{"die ID", dieIDReg},
+	}
+
+	values := map[uint8]uint16{}
+	fmt.Fprintf(b, "INA226 at address 0x%02x\n", ina.dev.Addr)
+	for _, r := range registers {
+		if r.reg == maskEnableReg && ina.keepAlertLatched.Load() {
+			fmt.Fprintf(b, "  0x%02x %-16s not read, would clear the latched alert\n", r.reg, r.name)
+			continue
+		}
+		value, err := ina.readRegister(r.reg)
+		if err != nil {
+			fmt.Fprintf(b, "  0x%02x %-16s read failed: %v\n", r.reg, r.name, err)
+			continue
+		}
+		values[r.reg] = value
+		fmt.Fprintf(b, "  0x%02x %-16s 0x%04x\n", r.reg, r.name, value)
+	}
+
+	if config, ok := values[configReg]; ok {
+		decoded := decodeConfig(config)
+		fmt.Fprintf(b, "configuration:\n")
+		fmt.Fprintf(b, "  averaging:                %d samples\n", decoded.averaging)
+		fmt.Fprintf(b, "  bus conversion time:      %d us\n", decoded.busConversionUsec)
+		fmt.Fprintf(b, "  shunt conversion time:    %d us\n", decoded.shuntConversionUsec)
+		fmt.Fprintf(b, "  mode:                     %s\n", decoded.mode)
+		if config != configValue {
+			fmt.Fprintf(b, "  (differs from the configuration written by the service, 0x%04x)\n", configValue)
+		}
+	}
+	if mask, ok := values[maskEnableReg]; ok {
+		set := []string{}
+		for _, f := range maskEnableFlags {
+			if mask&(1<<f.bit) != 0 {
+				set = append(set, f.name)
+			}
+		}
+		if len(set) == 0 {
+			set = append(set, "none")
+		}
+		fmt.Fprintf(b, "mask/enable flags:          %s\n", strings.Join(set, ", "))
+	}
+	if limit, ok := values[alertLimitReg]; ok {
+		fmt.Fprintf(b, "alert limit:                %d (raw, its unit depends on the enabled alert function)\n", limit)
+	}
+	if manuf, ok := values[manufIDReg]; ok {
+		fmt.Fprintf(b, "manufacturer ID:            0x%04x (expected 0x%04x)\n", manuf, manufID)
+	}
+	if die, ok := values[dieIDReg]; ok {
+		fmt.Fprintf(b, "die ID:                     0x%03x, revision %d (expected 0x%03x)\n", die>>4, die&0xF, dieID)
+	}
+
+	cal := ina.cal
+	fmt.Fprintf(b, "calibration used by the service:\n")
+	fmt.Fprintf(b, "  shunt:                    %v ohm\n", cal.ShuntOhms)
+	fmt.Fprintf(b, "  max current:              %v A\n", cal.MaxCurrentAmps)
+	fmt.Fprintf(b, "  current LSB:              %g A/bit\n", cal.CurrentLSB)
+	fmt.Fprintf(b, "  power LSB:                %g W/bit\n", cal.PowerLSB)
+	fmt.Fprintf(b, "  calibration register:     %d", cal.Register)
+	if written, ok := values[calibrationReg]; ok && written != cal.Register {
+		fmt.Fprintf(b, " (but the chip holds %d)", written)
+	}
+	fmt.Fprintf(b, "\n")
+	fmt.Fprintf(b, "  current offset:           %g A\n", ina.currentOffset)
+	fmt.Fprintf(b, "  bus correction:           %g * measured + %g V\n", ina.busGain, ina.busOffset)
+	fmt.Fprintf(b, "  bus voltage divider:      %g\n", ina.busDivider)
+	if ina.actualShuntOhms != 0 {
+		fmt.Fprintf(b, "  fitted shunt:             %v ohm (readings scaled by %g)\n", ina.actualShuntOhms, ina.shuntRatio())
+	}
+	return b.String()
+}
+
+// Registers an endpoint (GET /snapshot) that returns the decoded chip state, see DumpState
+func registerSnapshotEndpoint(ina *INA226) {
+	httpMux.HandleFunc("GET /snapshot", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, ina.DumpState())
+	})
+}
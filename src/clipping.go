@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// A reading within 2% of the current register's full scale is considered clipped
+	clipFullScaleFraction = 0.98
+	// Time over which the detectors evaluate their readings, so that a window covers the same time at any
+	// sample rate (updates-per-second can be retuned while running)
+	detectorWindowDuration = time.Minute
+	// Minimum number of readings in a window, which is extended at very low sample rates
+	detectorWindowMinSamples = 100
+	// Headroom added on top of the observed peak when suggesting a new max-current-amps
+	clipSuggestionHeadroom = 1.25
+)
+
+// A time-based evaluation window of the detectors
+type detectorWindow struct {
+	start   time.Time
+	samples int
+}
+
+// Adds a reading, returns whether the window is complete
+func (w *detectorWindow) add(now time.Time) bool {
+	if w.samples == 0 {
+		w.start = now
+	}
+	w.samples++
+	return now.Sub(w.start) >= detectorWindowDuration && w.samples >= detectorWindowMinSamples
+}
+
+// Starts the next window with the next reading
+func (w *detectorWindow) reset() {
+	w.samples = 0
+}
+
+// Detects when the current register saturates because the calibration range is too small for the
+// current that actually flows through the shunt, since clipped readings are otherwise reported silently
+type clipDetector struct {
+	warnFraction float64 // fraction of clipped samples in a window that triggers a warning, 0 disables
+	window       detectorWindow
+	clipped      int
+	peakAmps     float64
+}
+
+func newClipDetector(warnFraction float64) *clipDetector {
+	return &clipDetector{warnFraction: warnFraction}
+}
+
+// Records a current reading and warns once per window when too many readings were at full scale
+func (c *clipDetector) observe(now time.Time, currentAmps float64, cal Calibration) {
+	if c.warnFraction <= 0 {
+		return
+	}
+
+	amps := math.Abs(currentAmps)
+	c.peakAmps = math.Max(c.peakAmps, amps)
+	if amps >= clipFullScaleFraction*cal.MaxCurrentAmps {
+		c.clipped++
+	}
+	if !c.window.add(now) {
+		return
+	}
+
+	fraction := float64(c.clipped) / float64(c.window.samples)
+	if fraction < c.warnFraction {
+		faults.clear(faultCurrentClipping)
+	} else {
+		faults.raise(faultCurrentClipping)
+		// The real peak is hidden by the saturation, so the suggestion is a lower bound
+		log.Warn().
+			Float64("clippedFraction", fraction).
+			Float64("peakAmps", c.peakAmps).
+			Float64("maxCurrentAmps", cal.MaxCurrentAmps).
+			Float64("suggestedMinMaxCurrentAmps", c.peakAmps*clipSuggestionHeadroom).
+			Msgf("Current readings are clipping at full scale, the calibration range is too small. Increase max-current-amps to at least %.3f A", c.peakAmps*clipSuggestionHeadroom)
+	}
+
+	c.window.reset()
+	c.clipped = 0
+	c.peakAmps = 0
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// Shrinks the JSON samples that are published over MQTT and the Unix domain socket, for bandwidth-limited links.
+// Floats are rounded to a fixed number of decimals, and the measured quantities that are not valid for the sample
+// (see FieldMask) and the optional fields that are not set are left out. Zeros of valid quantities are kept.
+type compactEncoding struct {
+	decimals  int // -1 keeps the full precision
+	omitEmpty bool
+}
+
+// The JSON fields of the measured quantities, by the field that makes them valid
+var quantityJSONFields = map[string]FieldMask{
+	"supplyVoltage":    FieldVoltage,
+	"currentAmps":      FieldCurrent,
+	"powerWatts":       FieldPower,
+	"signedPowerWatts": FieldPower,
+	"shuntVoltage":     FieldShuntVoltage,
+}
+
+// How the published samples are encoded, set from json-decimals and json-omit-empty
+var sampleEncoding = compactEncoding{decimals: -1}
+
+// Encodes a (delta) sample as JSON in the sampleSchemaVersion, compacted according to sampleEncoding
+func marshalSample(sample any) ([]byte, error) {
+	payload, err := json.Marshal(sample)
+	if err != nil {
+		return nil, err
+	}
+	if sampleSchemaVersion == currentSchemaVersion && sampleEncoding.decimals < 0 && !sampleEncoding.omitEmpty {
+		// Only the version is added, which keeps the field order of the struct
+		return append([]byte(fmt.Sprintf(`{"schemaVersion":%d,`, currentSchemaVersion)), payload[1:]...), nil
+	}
+
+	// The sample is flat besides the raw register values (integers), so compacting the top-level fields is enough
+	var fields map[string]any
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil, err
+	}
+	// Taken before the schema version, the legacy schema has no validFields
+	valid := validFieldsJSON(fields["validFields"])
+	applySchemaVersion(fields, sampleSchemaVersion)
+	scale := math.Pow10(sampleEncoding.decimals)
+	for name, value := range fields {
+		// The resolution is far below any sensible precision and would round to zero
+		if f, ok := value.(float64); ok && sampleEncoding.decimals >= 0 && name != "currentLSB" {
+			value = math.Round(f*scale) / scale
+			fields[name] = value
+		}
+		if !sampleEncoding.omitEmpty || name == "validFields" {
+			continue
+		}
+		if field, ok := quantityJSONFields[name]; ok {
+			if !valid.Has(field) {
+				delete(fields, name)
+			}
+		} else if isUnsetJSON(value) {
+			delete(fields, name)
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// Decodes the validFields of a JSON sample, a list of field names
+func validFieldsJSON(value any) FieldMask {
+	valid := FieldMask(0)
+	names, _ := value.([]any)
+	for _, name := range names {
+		for _, f := range fieldNames {
+			if f.name == name {
+				valid |= f.field
+			}
+		}
+	}
+	return valid
+}
+
+// Whether an optional field is not set: null, an empty string or an empty list. Numbers and booleans are values.
+func isUnsetJSON(value any) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case []any:
+		return len(v) == 0
+	}
+	return false
+}
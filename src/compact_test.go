@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMarshalSampleOmitEmpty(t *testing.T) {
+	defer func(encoding compactEncoding) { sampleEncoding = encoding }(sampleEncoding)
+	sampleEncoding = compactEncoding{decimals: -1, omitEmpty: true}
+
+	// A voltage-only sensor at 0 A, which is no current reading
+	sample := &CurrentSensorOutput{
+		SupplyVoltage: 0,
+		CurrentAmps:   0,
+		EnergyWh:      0,
+		ValidFields:   FieldVoltage,
+	}
+	payload, err := marshalSample(sample)
+	if err != nil {
+		t.Fatalf("marshalSample: %v", err)
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		t.Fatalf("invalid JSON %s: %v", payload, err)
+	}
+
+	for _, name := range []string{"supplyVoltage", "energyWh", "lowBattery", "currentLSB", "validFields"} {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("%s is left out of %s", name, payload)
+		}
+	}
+	for _, name := range []string{"currentAmps", "powerWatts", "signedPowerWatts", "shuntVoltage", "remainingRuntimeMinutes", "faults", "range"} {
+		if _, ok := fields[name]; ok {
+			t.Errorf("%s is published in %s", name, payload)
+		}
+	}
+}
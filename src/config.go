@@ -0,0 +1,381 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	roverlib "github.com/VU-ASE/roverlib-go/src"
+	"github.com/rs/zerolog/log"
+)
+
+// Named shunt resistors that are commonly mounted on our sensor boards, so that operators
+// do not have to type (and possibly mistype) the exact resistance
+type shuntPreset struct {
+	ohms           float64
+	maxCurrentAmps float64
+}
+
+var shuntPresets = map[string]shuntPreset{
+	"2mOhm":   {ohms: 0.002, maxCurrentAmps: 32.768}, // 1 mA/bit
+	"5mOhm":   {ohms: 0.005, maxCurrentAmps: 16.384}, // 0.5 mA/bit, shunt ADC full scale
+	"10mOhm":  {ohms: 0.010, maxCurrentAmps: 8.192},  // 0.25 mA/bit, shunt ADC full scale
+	"100mOhm": {ohms: 0.100, maxCurrentAmps: 0.8192}, // 25 uA/bit, shunt ADC full scale
+}
+
+const defaultShuntPreset = "2mOhm"
+
+// The I2C bus that the sensor is connected to
+const i2cBusName = "5"
+
+// Sample rate when running without a configuration
+const defaultUpdatesPerSecond = 10
+
+// Whether the service may run with the built-in defaults when no configuration is provisioned, for minimal
+// test setups. Enabled at build time (-ldflags "-X main.allowDefaultConfig=1") or with the ENERGY_ALLOW_DEFAULT_CONFIG
+// environment variable.
+var allowDefaultConfig = ""
+
+func defaultConfigAllowed() bool {
+	if env, ok := os.LookupEnv("ENERGY_ALLOW_DEFAULT_CONFIG"); ok {
+		return env == "1" || env == "true"
+	}
+	return allowDefaultConfig == "1" || allowDefaultConfig == "true"
+}
+
+// A configuration option that the service knows about, used to validate the service.yaml at startup
+type configOption struct {
+	name     string
+	kind     roverlib.Type
+	required bool // optional options fall back to a default when they are not declared
+}
+
+var configSchema = []configOption{
+	{name: "updates-per-second", kind: roverlib.Number, required: true},
+	{name: "read-first", kind: roverlib.Number},
+	{name: "monotonic-timestamps", kind: roverlib.Number},
+	{name: "event-mode", kind: roverlib.Number},
+	{name: "event-overcurrent-amps", kind: roverlib.Number},
+	{name: "event-undervoltage-volts", kind: roverlib.Number},
+	{name: "event-delta-amps", kind: roverlib.Number},
+	{name: "event-heartbeat-seconds", kind: roverlib.Number},
+	{name: "periph-drivers", kind: roverlib.String},
+	{name: "threshold-rules", kind: roverlib.String},
+	{name: "heartbeat-seconds", kind: roverlib.Number},
+	{name: "calibration-check-tolerance", kind: roverlib.Number},
+	{name: "byte-order", kind: roverlib.String},
+	{name: "run-summary-path", kind: roverlib.String},
+	{name: "include-raw", kind: roverlib.Number},
+	{name: "i2c-device-path", kind: roverlib.String},
+	{name: "i2c-address", kind: roverlib.String},
+	{name: "read-error-log-seconds", kind: roverlib.Number},
+	{name: "actual-shunt-ohms", kind: roverlib.Number},
+	{name: "log-samples", kind: roverlib.Number},
+	{name: "json-stdout", kind: roverlib.Number},
+	{name: "csv-path", kind: roverlib.String},
+	{name: "warm-restart", kind: roverlib.Number},
+	{name: "rate-log-seconds", kind: roverlib.Number},
+	{name: "rate-warn-percent", kind: roverlib.Number},
+	{name: "current-mode", kind: roverlib.String},
+	{name: "influx-url", kind: roverlib.String},
+	{name: "influx-token", kind: roverlib.String},
+	{name: "influx-measurement", kind: roverlib.String},
+	{name: "influx-flush-seconds", kind: roverlib.Number},
+	{name: "transforms", kind: roverlib.String},
+	{name: "rate-change-log-factor", kind: roverlib.Number},
+	{name: "burn-in-seconds", kind: roverlib.Number},
+	{name: "burn-in-warmup-seconds", kind: roverlib.Number},
+	{name: "burn-in-window-seconds", kind: roverlib.Number},
+	{name: "burn-in-max-drift-amps", kind: roverlib.Number},
+	{name: "burn-in-max-drift-volts", kind: roverlib.Number},
+	{name: "burn-in-max-drift-watts", kind: roverlib.Number},
+	{name: "burn-in-report-path", kind: roverlib.String},
+	{name: "calibration-eeprom-address", kind: roverlib.Number},
+	{name: "calibration-eeprom-location", kind: roverlib.Number},
+	{name: "calibration-eeprom-address-bytes", kind: roverlib.Number},
+	{name: "init-timeout-seconds", kind: roverlib.Number},
+	{name: "efficiency-input-socket", kind: roverlib.String},
+	{name: "efficiency-min-input-watts", kind: roverlib.Number},
+	{name: "efficiency-max-skew-ms", kind: roverlib.Number},
+	{name: "stream-encoding", kind: roverlib.String},
+	{name: "die-revision-overrides", kind: roverlib.String},
+	{name: "verify-writes", kind: roverlib.Number},
+	{name: "limit-to-conversion-rate", kind: roverlib.Number},
+	{name: "grafana-stdout", kind: roverlib.Number},
+	{name: "channel-mode-handling", kind: roverlib.String},
+	{name: "stress-test-seconds", kind: roverlib.Number},
+	{name: "stress-test-max-error-percent", kind: roverlib.Number},
+	{name: "stress-test-max-retry-percent", kind: roverlib.Number},
+	{name: "stress-test-max-latency-ms", kind: roverlib.Number},
+	{name: "stress-test-report-path", kind: roverlib.String},
+	{name: "log-rotate-mb", kind: roverlib.Number},
+	{name: "log-rotate-minutes", kind: roverlib.Number},
+	{name: "log-rotate-keep", kind: roverlib.Number},
+	{name: "shunt-placement", kind: roverlib.String},
+	{name: "sensor-id", kind: roverlib.Number},
+	{name: "sensor-name", kind: roverlib.String},
+	{name: "log-format", kind: roverlib.String},
+	{name: "shunt-preset", kind: roverlib.String},
+	{name: "shunt-ohms", kind: roverlib.Number},
+	{name: "max-current-amps", kind: roverlib.Number},
+	{name: "calibration-settle-ms", kind: roverlib.Number},
+	{name: "auto-range", kind: roverlib.Number},
+	{name: "auto-range-low-max-amps", kind: roverlib.Number},
+	{name: "auto-range-hold-samples", kind: roverlib.Number},
+	{name: "clip-warn-fraction", kind: roverlib.Number},
+	{name: "shunt-warn-fraction", kind: roverlib.Number},
+	{name: "calibration-advice", kind: roverlib.Number},
+	{name: "calibration-advice-minutes", kind: roverlib.Number},
+	{name: "sqlite-path", kind: roverlib.String},
+	{name: "sqlite-batch-rows", kind: roverlib.Number},
+	{name: "sqlite-batch-ms", kind: roverlib.Number},
+	{name: "stream-enabled", kind: roverlib.Number},
+	{name: "mqtt-broker", kind: roverlib.String},
+	{name: "mqtt-topic", kind: roverlib.String},
+	{name: "mqtt-publish-mode", kind: roverlib.String},
+	{name: "mqtt-keyframe-seconds", kind: roverlib.Number},
+	{name: "schema-version", kind: roverlib.Number},
+	{name: "json-decimals", kind: roverlib.Number},
+	{name: "json-omit-empty", kind: roverlib.Number},
+	{name: "unix-socket-path", kind: roverlib.String},
+	{name: "interpolate-grid-ms", kind: roverlib.Number},
+	{name: "aggregate-seconds", kind: roverlib.Number},
+	{name: "accumulation-deadband-amps", kind: roverlib.Number},
+	{name: "sensor-lost-after-failures", kind: roverlib.Number},
+	{name: "reset-detection", kind: roverlib.Number},
+	{name: "gap-fill", kind: roverlib.String},
+	{name: "histogram-edges", kind: roverlib.String},
+	{name: "power-source", kind: roverlib.String},
+	{name: "field-mask", kind: roverlib.String},
+	{name: "zero-calibrate", kind: roverlib.Number},
+	{name: "zero-calibrate-samples", kind: roverlib.Number},
+	{name: "zero-calibrate-max-amps", kind: roverlib.Number},
+	{name: "id-check-retries", kind: roverlib.Number},
+	{name: "probe-nack-retries", kind: roverlib.Number},
+	{name: "probe-nack-delay-ms", kind: roverlib.Number},
+	{name: "max-run-seconds", kind: roverlib.Number},
+	{name: "energy-unit", kind: roverlib.String},
+	{name: "charge-unit", kind: roverlib.String},
+	{name: "watchdog-stall-seconds", kind: roverlib.Number},
+	{name: "bus-gain", kind: roverlib.Number},
+	{name: "bus-offset", kind: roverlib.Number},
+	{name: "bus-voltage-divider", kind: roverlib.Number},
+	{name: "current-scale", kind: roverlib.Number},
+	{name: "current-offset", kind: roverlib.Number},
+	{name: "voltage-scale", kind: roverlib.Number},
+	{name: "voltage-offset", kind: roverlib.Number},
+	{name: "power-scale", kind: roverlib.Number},
+	{name: "power-offset", kind: roverlib.Number},
+	{name: "skip-init", kind: roverlib.Number},
+	{name: "verify-id", kind: roverlib.Number},
+	{name: "bus-busy-timeout-ms", kind: roverlib.Number},
+	{name: "smbus", kind: roverlib.Number},
+	{name: "http-listen", kind: roverlib.String},
+	{name: "debug-register-access", kind: roverlib.Number},
+	{name: "tag-samples", kind: roverlib.Number},
+	{name: "otlp-endpoint", kind: roverlib.String},
+	{name: "otlp-interval-seconds", kind: roverlib.Number},
+	{name: "regen-markers", kind: roverlib.Number},
+	{name: "regen-deadband-amps", kind: roverlib.Number},
+	{name: "regen-debounce-ms", kind: roverlib.Number},
+	{name: "accumulator-state-path", kind: roverlib.String},
+	{name: "accumulator-save-seconds", kind: roverlib.Number},
+	{name: "voltage-sample-divisor", kind: roverlib.Number},
+	{name: "sample-trigger", kind: roverlib.String},
+	{name: "alert-gpio", kind: roverlib.String},
+	{name: "alert-debounce-us", kind: roverlib.Number},
+	{name: "alert-latch", kind: roverlib.Number},
+	{name: "alert-auto-clear", kind: roverlib.Number},
+	{name: "power-trend-seconds", kind: roverlib.Number},
+	{name: "battery-capacity-wh", kind: roverlib.Number},
+	{name: "ocv-table", kind: roverlib.String},
+	{name: "ocv-rest-amps", kind: roverlib.Number},
+	{name: "ocv-rest-seconds", kind: roverlib.Number},
+	{name: "ocv-average-seconds", kind: roverlib.Number},
+	{name: "ocv-stddev-percent", kind: roverlib.Number},
+	{name: "coulomb-drift-percent", kind: roverlib.Number},
+	{name: "fuel-gauge", kind: roverlib.String},
+	{name: "fuel-gauge-address", kind: roverlib.Number},
+	{name: "runtime-smoothing-seconds", kind: roverlib.Number},
+	{name: "runtime-smoothing", kind: roverlib.String},
+	{name: "runtime-max-minutes", kind: roverlib.Number},
+	{name: "low-battery-volts", kind: roverlib.Number},
+	{name: "critical-battery-volts", kind: roverlib.Number},
+	{name: "low-battery-debounce-ms", kind: roverlib.Number},
+}
+
+// Checks that all required options are declared and that all declared options have the expected type.
+// Unknown options are most likely typos that would otherwise be silently ignored, so they are reported as well.
+func validateConfiguration(service roverlib.Service, configuration *roverlib.ServiceConfiguration) error {
+	// Running with the built-in defaults, there is nothing to validate
+	if configuration == nil {
+		return nil
+	}
+
+	problems := []string{}
+	known := make(map[string]bool, len(configSchema))
+
+	for _, option := range configSchema {
+		known[option.name] = true
+		_, floatErr := configuration.GetFloat(option.name)
+		_, stringErr := configuration.GetString(option.name)
+
+		switch {
+		case floatErr != nil && stringErr != nil:
+			if option.required {
+				problems = append(problems, fmt.Sprintf("missing required option %q (%s)", option.name, option.kind))
+			}
+		case option.kind == roverlib.Number && floatErr != nil:
+			problems = append(problems, fmt.Sprintf("option %q must be a number, but is a string", option.name))
+		case option.kind == roverlib.String && stringErr != nil:
+			problems = append(problems, fmt.Sprintf("option %q must be a string, but is a number", option.name))
+		}
+	}
+
+	for _, c := range service.Configuration {
+		if c.Name == nil || known[*c.Name] {
+			continue
+		}
+		if suggestion := closestOption(*c.Name); suggestion != "" {
+			problems = append(problems, fmt.Sprintf("unknown option %q (did you mean %q?)", *c.Name, suggestion))
+		} else {
+			log.Warn().Str("option", *c.Name).Msg("Ignoring unknown configuration option")
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration in service.yaml:\n  - %s", strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+// Returns the known option that is closest to the given (unknown) name, or an empty string if none
+// is close enough to be a likely typo
+func closestOption(name string) string {
+	best := ""
+	bestDistance := 4 // more edits than this is not considered a typo
+	for _, option := range configSchema {
+		if d := editDistance(name, option.name); d < bestDistance {
+			best = option.name
+			bestDistance = d
+		}
+	}
+	return best
+}
+
+// Levenshtein distance between two strings
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// Returns the float value of an option, or the fallback if the option is not declared in the service.yaml
+// (or there is no configuration at all)
+func getFloatOr(configuration *roverlib.ServiceConfiguration, name string, fallback float64) float64 {
+	if configuration == nil {
+		return fallback
+	}
+	value, err := configuration.GetFloat(name)
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// Returns the string value of an option, or the fallback if the option is not declared in the service.yaml
+// (or there is no configuration at all)
+func getStringOr(configuration *roverlib.ServiceConfiguration, name string, fallback string) string {
+	if configuration == nil {
+		return fallback
+	}
+	value, err := configuration.GetString(name)
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// Builds the calibration from either a named shunt preset or a custom shunt resistance (but never both)
+func readCalibration(configuration *roverlib.ServiceConfiguration) (Calibration, error) {
+	preset := strings.TrimSpace(getStringOr(configuration, "shunt-preset", defaultShuntPreset))
+	shuntOhms := getFloatOr(configuration, "shunt-ohms", 0)
+	maxCurrent := getFloatOr(configuration, "max-current-amps", 0)
+
+	if preset != "" && shuntOhms > 0 {
+		return Calibration{}, fmt.Errorf("both shunt-preset (%s) and shunt-ohms (%v) are set, choose one of them", preset, shuntOhms)
+	}
+
+	if preset != "" {
+		p, ok := shuntPresets[preset]
+		if !ok {
+			return Calibration{}, fmt.Errorf("unknown shunt-preset %q, valid presets are: %s", preset, strings.Join(shuntPresetNames(), ", "))
+		}
+		shuntOhms = p.ohms
+		// The preset maximum current can still be overridden to trade range for resolution
+		if maxCurrent <= 0 {
+			maxCurrent = p.maxCurrentAmps
+		}
+	} else if shuntOhms <= 0 {
+		return Calibration{}, fmt.Errorf("either shunt-preset or shunt-ohms must be set")
+	} else if maxCurrent <= 0 {
+		return Calibration{}, fmt.Errorf("max-current-amps must be set when using a custom shunt-ohms")
+	}
+
+	return NewCalibration(shuntOhms, maxCurrent)
+}
+
+// Reads whether the reported power comes from the power register or is computed as V x I
+func readPowerSource(configuration *roverlib.ServiceConfiguration) (PowerSource, error) {
+	source := PowerSource(getStringOr(configuration, "power-source", string(PowerFromRegister)))
+	switch source {
+	case PowerFromRegister, PowerComputed:
+		return source, nil
+	default:
+		return "", fmt.Errorf("invalid power-source %q, must be %q or %q", source, PowerFromRegister, PowerComputed)
+	}
+}
+
+func readCurrentMode(configuration *roverlib.ServiceConfiguration) (CurrentMode, error) {
+	mode := CurrentMode(getStringOr(configuration, "current-mode", string(CurrentFromRegister)))
+	switch mode {
+	case CurrentFromRegister, CurrentFromShunt:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid current-mode %q, must be %q or %q", mode, CurrentFromRegister, CurrentFromShunt)
+	}
+}
+
+func readShuntPlacement(configuration *roverlib.ServiceConfiguration) (ShuntPlacement, error) {
+	placement := ShuntPlacement(getStringOr(configuration, "shunt-placement", string(ShuntHighSide)))
+	switch placement {
+	case ShuntHighSide, ShuntLowSide:
+		return placement, nil
+	default:
+		return "", fmt.Errorf("invalid shunt-placement %q, must be %q or %q", placement, ShuntHighSide, ShuntLowSide)
+	}
+}
+
+func shuntPresetNames() []string {
+	names := make([]string, 0, len(shuntPresets))
+	for name := range shuntPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpioreg"
+)
+
+// Configures the ALERT pin to signal that a new conversion is ready, as an alternative to sampling on a timer
+func (ina *INA226) EnableConversionReadyAlert() error {
+	ina.maskEnable |= conversionReadyAlert
+	return ina.writeRegister(maskEnableReg, ina.maskEnable)
+}
+
+// Reports whether a new conversion is ready since the last call. Reading the flag clears it,
+// and also releases the ALERT pin when it signals conversion ready.
+func (ina *INA226) ConversionReady() (bool, error) {
+	value, err := ina.readRegister(maskEnableReg)
+	if err != nil {
+		return false, err
+	}
+	// The read also cleared a latched alert, remember it for AlertFlag
+	if value&alertFunctionFlag != 0 {
+		ina.alertPending = true
+	}
+	return value&conversionReadyFlag != 0, nil
+}
+
+// How long to wait for a conversion before giving up at least, the timeout is longer for slow configurations
+const conversionWaitTimeout = 100 * time.Millisecond
+
+// Interval at which the conversion ready flag is polled when the ALERT pin is not connected
+const conversionPollInterval = 200 * time.Microsecond
+
+// Blocks until the sensor has a new conversion ready, so that every conversion is read exactly once.
+// Waits on a falling edge of the ALERT pin (active low, open drain) when it is wired to a GPIO,
+// or polls the conversion ready flag otherwise.
+type conversionWaiter struct {
+	ina *INA226
+	pin gpio.PinIO // nil when polling
+	// Edges after which the pin is no longer low after this delay are considered glitches
+	debounce time.Duration
+	// Longest time to wait for an edge, after which the flag is checked anyway. The ALERT pin stays low until the
+	// flag is read, so a missed edge would otherwise block forever.
+	timeout time.Duration
+}
+
+// Sets up waiting for conversions, on the given GPIO pin (e.g. "GPIO17") or by polling when pinName is empty
+// or the pin is not available
+func newConversionWaiter(ina *INA226, pinName string, debounce time.Duration, timeout time.Duration) (*conversionWaiter, error) {
+	if err := ina.EnableConversionReadyAlert(); err != nil {
+		return nil, fmt.Errorf("failed to enable the conversion ready alert: %v", err)
+	}
+	w := &conversionWaiter{ina: ina, debounce: debounce, timeout: timeout}
+	if pinName == "" {
+		log.Info().Msg("Waiting for conversions by polling the conversion ready flag")
+		return w, nil
+	}
+
+	pin := gpioreg.ByName(pinName)
+	if pin == nil {
+		log.Warn().Str("pin", pinName).Msg("Alert GPIO not available, falling back to polling the conversion ready flag")
+		return w, nil
+	}
+	if err := pin.In(gpio.PullUp, gpio.FallingEdge); err != nil {
+		log.Warn().Str("pin", pinName).Msgf("Failed to configure alert GPIO, falling back to polling the conversion ready flag: %v", err)
+		return w, nil
+	}
+	w.pin = pin
+	log.Info().Str("pin", pinName).Msg("Waiting for conversions on the alert GPIO")
+	return w, nil
+}
+
+func (w *conversionWaiter) wait() error {
+	if w.pin == nil {
+		return w.poll()
+	}
+
+	deadline := time.Now().Add(w.timeout)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 || !w.pin.WaitForEdge(remaining) {
+			// No (valid) edge in time, the edge may have been missed, so rely on the flag
+			return w.poll()
+		}
+		if w.debounce > 0 {
+			time.Sleep(w.debounce)
+			if w.pin.Read() != gpio.Low {
+				continue
+			}
+		}
+		// Clears the flag, which releases the pin for the next conversion
+		if _, err := w.ina.ConversionReady(); err != nil {
+			return err
+		}
+		return nil
+	}
+}
+
+func (w *conversionWaiter) poll() error {
+	deadline := time.Now().Add(w.timeout)
+	for {
+		ready, err := w.ina.ConversionReady()
+		if err != nil {
+			return err
+		}
+		if ready {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no conversion ready within %v", w.timeout)
+		}
+		time.Sleep(conversionPollInterval)
+	}
+}
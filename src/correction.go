@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+
+	roverlib "github.com/VU-ASE/roverlib-go/src"
+	"github.com/rs/zerolog/log"
+)
+
+// A final linear correction (scale * value + offset) of a published quantity, to match the expectations
+// of an integrator's system. Unlike the bus voltage calibration, it does not affect the accumulated totals.
+type linearCorrection struct {
+	scale  float64
+	offset float64
+}
+
+func (c linearCorrection) apply(value float64) float64 {
+	return c.scale*value + c.offset
+}
+
+func (c linearCorrection) identity() bool {
+	return c.scale == 1 && c.offset == 0
+}
+
+// The corrections of the published current, voltage and power
+type outputCorrections struct {
+	current linearCorrection
+	voltage linearCorrection
+	power   linearCorrection
+}
+
+// Reads the corrections from the configuration and the overrides of the die revision, returns nil when all of
+// them are the identity
+func readOutputCorrections(configuration *roverlib.ServiceConfiguration, overrides optionOverrides) *outputCorrections {
+	read := func(name string) linearCorrection {
+		return linearCorrection{
+			scale:  overrides.float(name+"-scale", getFloatOr(configuration, name+"-scale", 1)),
+			offset: overrides.float(name+"-offset", getFloatOr(configuration, name+"-offset", 0)),
+		}
+	}
+	c := &outputCorrections{
+		current: read("current"),
+		voltage: read("voltage"),
+		power:   read("power"),
+	}
+
+	active := false
+	for _, q := range []struct {
+		name       string
+		correction linearCorrection
+	}{{"current", c.current}, {"voltage", c.voltage}, {"power", c.power}} {
+		if !q.correction.identity() {
+			// Easily forgotten once set, so it is made visible in the logs
+			log.Warn().Str("quantity", q.name).Float64("scale", q.correction.scale).Float64("offset", q.correction.offset).
+				Msg("Output correction is active")
+			active = true
+		}
+	}
+	if !active {
+		return nil
+	}
+	return c
+}
+
+// Returns a corrected copy of the sample. Only the valid quantities are corrected, an offset would turn the zero
+// of an invalid one into a value. Stale samples are returned as they are, they repeat an already corrected sample
+// or hold no measurements.
+func (c *outputCorrections) apply(sample *CurrentSensorOutput) CurrentSensorOutput {
+	out := *sample
+	if sample.Stale {
+		return out
+	}
+	if sample.ValidFields.Has(FieldCurrent) {
+		out.CurrentAmps = c.current.apply(sample.CurrentAmps)
+	}
+	if sample.ValidFields.Has(FieldVoltage) {
+		out.SupplyVoltage = c.voltage.apply(sample.SupplyVoltage)
+	}
+	if sample.ValidFields.Has(FieldPower) {
+		out.PowerWatts = c.power.apply(sample.PowerWatts)
+		out.SignedPowerWatts = math.Copysign(out.PowerWatts, sample.SignedPowerWatts)
+	}
+	return out
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestOutputCorrections(t *testing.T) {
+	c := &outputCorrections{
+		current: linearCorrection{scale: 2, offset: 0.5},
+		voltage: linearCorrection{scale: 1, offset: 0.1},
+		power:   linearCorrection{scale: 1, offset: 1},
+	}
+	tests := []struct {
+		name   string
+		sample CurrentSensorOutput
+		want   CurrentSensorOutput
+	}{
+		{
+			"all valid",
+			CurrentSensorOutput{CurrentAmps: 1, SupplyVoltage: 12, PowerWatts: 12, SignedPowerWatts: -12, ValidFields: AllFields},
+			CurrentSensorOutput{CurrentAmps: 2.5, SupplyVoltage: 12.1, PowerWatts: 13, SignedPowerWatts: -13, ValidFields: AllFields},
+		},
+		{
+			"current only",
+			CurrentSensorOutput{CurrentAmps: 1, ValidFields: FieldCurrent},
+			CurrentSensorOutput{CurrentAmps: 2.5, ValidFields: FieldCurrent},
+		},
+		{
+			"stale",
+			CurrentSensorOutput{CurrentAmps: 2.5, SupplyVoltage: 12.1, PowerWatts: 13, SignedPowerWatts: 13, ValidFields: AllFields, Stale: true},
+			CurrentSensorOutput{CurrentAmps: 2.5, SupplyVoltage: 12.1, PowerWatts: 13, SignedPowerWatts: 13, ValidFields: AllFields, Stale: true},
+		},
+		{
+			"stale without measurements",
+			CurrentSensorOutput{Stale: true},
+			CurrentSensorOutput{Stale: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := c.apply(&tt.sample)
+			if got.CurrentAmps != tt.want.CurrentAmps || got.SupplyVoltage != tt.want.SupplyVoltage ||
+				got.PowerWatts != tt.want.PowerWatts || got.SignedPowerWatts != tt.want.SignedPowerWatts {
+				t.Errorf("corrected %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
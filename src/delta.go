@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// A published sample in delta mode. Keyframes carry absolute values, the other messages carry the change
+// in every measured and accumulated quantity since the previous message. The other fields (e.g. the timestamp,
+// units and remaining runtime) are always absolute. The sequence number is incremented for every encoded
+// message, so that consumers can detect a missed message.
+type deltaSample struct {
+	Keyframe bool   `json:"keyframe"`
+	Sequence uint64 `json:"sequence"`
+	CurrentSensorOutput
+}
+
+// Encodes samples as deltas against the previously encoded sample, with a periodic keyframe so that
+// consumers can (re)establish a baseline
+type deltaEncoder struct {
+	keyframeInterval time.Duration
+	previous         CurrentSensorOutput
+	lastKeyframe     time.Time
+	sequence         uint64
+	// Set when consumers may have missed a message (e.g. after a reconnect), so the next message is a keyframe.
+	// Set from the publishing goroutine, hence atomic.
+	forceKeyframe atomic.Bool
+}
+
+func newDeltaEncoder(keyframeInterval time.Duration) *deltaEncoder {
+	e := &deltaEncoder{keyframeInterval: keyframeInterval}
+	e.forceKeyframe.Store(true)
+	return e
+}
+
+// Makes the next encoded sample a keyframe
+func (e *deltaEncoder) resync() {
+	e.forceKeyframe.Store(true)
+}
+
+func (e *deltaEncoder) encode(sample *CurrentSensorOutput) deltaSample {
+	keyframe := e.forceKeyframe.Swap(false) || sample.Timestamp.Sub(e.lastKeyframe) >= e.keyframeInterval
+	out := deltaSample{Keyframe: keyframe, Sequence: e.sequence, CurrentSensorOutput: *sample}
+	e.sequence++
+	if keyframe {
+		e.lastKeyframe = sample.Timestamp
+	} else {
+		out.SupplyVoltage -= e.previous.SupplyVoltage
+		out.CurrentAmps -= e.previous.CurrentAmps
+		out.PowerWatts -= e.previous.PowerWatts
+		out.SignedPowerWatts -= e.previous.SignedPowerWatts
+		out.ShuntVoltage -= e.previous.ShuntVoltage
+		out.EnergyWh -= e.previous.EnergyWh
+		out.ChargeAh -= e.previous.ChargeAh
+		out.Energy -= e.previous.Energy
+		out.Charge -= e.previous.Charge
+		out.AvgPowerWattsLastMinute -= e.previous.AvgPowerWattsLastMinute
+	}
+	e.previous = *sample
+	return out
+}
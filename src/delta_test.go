@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeltaEncoderSequence(t *testing.T) {
+	e := newDeltaEncoder(time.Hour)
+	start := time.Now()
+	encode := func(i int, amps float64) deltaSample {
+		return e.encode(&CurrentSensorOutput{Timestamp: start.Add(time.Duration(i) * time.Second), CurrentAmps: amps})
+	}
+
+	first := encode(0, 1)
+	second := encode(1, 1.5)
+	if !first.Keyframe || second.Keyframe || second.CurrentAmps != 0.5 {
+		t.Errorf("got %+v and %+v, want a keyframe followed by a delta of 0.5 A", first, second)
+	}
+
+	// A failed publish makes the next message a keyframe, the sequence numbers continue
+	e.resync()
+	third := encode(2, 2)
+	if !third.Keyframe || third.CurrentAmps != 2 {
+		t.Errorf("got %+v after a resync, want a keyframe of 2 A", third)
+	}
+	for i, sample := range []deltaSample{first, second, third} {
+		if sample.Sequence != uint64(i) {
+			t.Errorf("message %d has sequence number %d", i, sample.Sequence)
+		}
+	}
+}
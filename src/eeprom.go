@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+
+	roverlib "github.com/VU-ASE/roverlib-go/src"
+	"github.com/rs/zerolog/log"
+	"periph.io/x/conn/v3/i2c"
+)
+
+const (
+	// Size of the calibration record in the EEPROM
+	eepromRecordSize = 24
+	// Marks a calibration record, so that an empty or differently used EEPROM is not taken for one
+	eepromRecordMagic = "INA1"
+)
+
+// The trimmed calibration of a board, as measured in its factory test and stored in the EEPROM of the board.
+// The record is 24 bytes, all values little-endian:
+//
+//	0   magic "INA1"
+//	4   float32 measured shunt resistance in ohms (0 when not trimmed)
+//	8   float32 current offset in amps, subtracted from every current reading
+//	12  float32 bus voltage gain (0 when not trimmed)
+//	16  float32 bus voltage offset in volts
+//	20  uint32 CRC-32 (IEEE) of bytes 0 to 19
+type boardCalibration struct {
+	shuntOhms      float64
+	currentOffset  float64
+	busGain        float64
+	busOffset      float64
+	hasShunt       bool
+	hasBusGain     bool
+	eepromAddress  uint16
+	memoryLocation uint16
+}
+
+// Reads the calibration record from the EEPROM at address (on the bus of the sensor), stored at the memory
+// location, which is sent as addressBytes bytes (1 for the 24C01 to 24C16, 2 for the larger EEPROMs)
+func readBoardCalibration(bus i2c.Bus, address uint16, location uint16, addressBytes int) (*boardCalibration, error) {
+	var w []byte
+	switch addressBytes {
+	case 1:
+		if location > 0xff {
+			return nil, fmt.Errorf("memory location 0x%x needs 2 address bytes", location)
+		}
+		w = []byte{byte(location)}
+	case 2:
+		w = []byte{byte(location >> 8), byte(location)}
+	default:
+		return nil, fmt.Errorf("the EEPROM memory address must be 1 or 2 bytes, got %d", addressBytes)
+	}
+
+	record := make([]byte, eepromRecordSize)
+	if err := bus.Tx(address, w, record); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(record[0:4], []byte(eepromRecordMagic)) {
+		return nil, fmt.Errorf("no calibration record (magic %q, expected %q)", record[0:4], eepromRecordMagic)
+	}
+	if crc, expected := crc32.ChecksumIEEE(record[0:20]), binary.LittleEndian.Uint32(record[20:24]); crc != expected {
+		return nil, fmt.Errorf("corrupt calibration record (crc 0x%08x, expected 0x%08x)", crc, expected)
+	}
+
+	value := func(offset int) float64 {
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(record[offset : offset+4])))
+	}
+	board := &boardCalibration{
+		shuntOhms:      value(4),
+		currentOffset:  value(8),
+		busGain:        value(12),
+		busOffset:      value(16),
+		eepromAddress:  address,
+		memoryLocation: location,
+	}
+	for _, v := range []float64{board.shuntOhms, board.currentOffset, board.busGain, board.busOffset} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("invalid calibration record, it holds %v", v)
+		}
+	}
+	if board.shuntOhms < 0 || board.busGain < 0 {
+		return nil, fmt.Errorf("invalid calibration record, negative shunt (%v) or bus gain (%v)", board.shuntOhms, board.busGain)
+	}
+	board.hasShunt = board.shuntOhms > 0
+	board.hasBusGain = board.busGain > 0
+	return board, nil
+}
+
+// Reads the board calibration when calibration-eeprom-address is set. An absent or unreadable EEPROM is not
+// fatal, the configured values are used instead, so nil is returned then.
+func readConfiguredBoardCalibration(configuration *roverlib.ServiceConfiguration, bus i2c.Bus) *boardCalibration {
+	address := uint16(getFloatOr(configuration, "calibration-eeprom-address", 0))
+	if address == 0 {
+		return nil
+	}
+	location := uint16(getFloatOr(configuration, "calibration-eeprom-location", 0))
+	addressBytes := int(getFloatOr(configuration, "calibration-eeprom-address-bytes", 1))
+
+	board, err := readBoardCalibration(bus, address, location, addressBytes)
+	if err != nil {
+		log.Warn().Uint16("address", address).Uint16("location", location).
+			Msgf("unable to read the board calibration from the EEPROM, using the configured calibration: %v", err)
+		return nil
+	}
+	return board
+}
+
+// Overrides the configured calibration of the sensor with the trimmed values of the board
+func (b *boardCalibration) apply(ina *INA226) {
+	if b.hasShunt {
+		ina.SetActualShuntOhms(b.shuntOhms)
+	}
+	ina.SetCurrentOffset(b.currentOffset)
+	if b.hasBusGain {
+		ina.SetBusCorrection(b.busGain, b.busOffset)
+	}
+	log.Info().
+		Uint16("address", b.eepromAddress).
+		Uint16("location", b.memoryLocation).
+		Float64("shuntOhms", b.shuntOhms).
+		Float64("currentOffsetAmps", b.currentOffset).
+		Float64("busGain", b.busGain).
+		Float64("busOffset", b.busOffset).
+		Msg("Using the board calibration from the EEPROM, overriding the configured calibration")
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	roverlib "github.com/VU-ASE/roverlib-go/src"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Input samples that are kept to align with the samples of this sensor
+	efficiencyHistory = 1024
+	// Delay before reconnecting to the input rail after its socket closed or could not be opened
+	efficiencyReconnectInterval = time.Second
+)
+
+var metricEfficiency = metrics.gauge("rover_energy_efficiency_percent", "Power conversion efficiency from the input rail to this rail in percent, -1 when unknown")
+
+// A power reading of the input rail
+type inputPower struct {
+	timestamp time.Time
+	watts     float64
+}
+
+// The fields of the JSON samples of the input rail that are needed, the signed power is missing in the legacy schema
+type inputSample struct {
+	Timestamp        time.Time `json:"timestamp"`
+	PowerWatts       float64   `json:"powerWatts"`
+	SignedPowerWatts *float64  `json:"signedPowerWatts"`
+	Stale            bool      `json:"stale"`
+}
+
+// Computes the efficiency of the DC-DC stage between an input rail and the rail of this sensor (its output).
+// The input rail is measured by another instance of the service, whose samples are read from its Unix domain
+// socket, so that both rails keep their own sensor and rate. The input power is interpolated to the time of
+// every sample of this sensor.
+type efficiencyMeter struct {
+	path          string
+	minInputWatts float64       // below this input power the ratio is meaningless, e.g. while the converter idles
+	maxSkew       time.Duration // maximum time between a sample and the nearest input sample
+
+	lock    sync.Mutex
+	history []inputPower // ordered by time
+}
+
+// Pairs this sensor as the output rail with the input rail of efficiency-input-socket, nil when it is not set
+func readEfficiencyMeter(configuration *roverlib.ServiceConfiguration) (*efficiencyMeter, error) {
+	path := getStringOr(configuration, "efficiency-input-socket", "")
+	if path == "" {
+		return nil, nil
+	}
+	if path == getStringOr(configuration, "unix-socket-path", "") {
+		return nil, fmt.Errorf("efficiency-input-socket must be the socket of the instance on the input rail, not the own unix-socket-path")
+	}
+	minInput := getFloatOr(configuration, "efficiency-min-input-watts", 0.5)
+	if minInput <= 0 {
+		return nil, fmt.Errorf("efficiency-min-input-watts must be positive, got %v", minInput)
+	}
+	maxSkew := getFloatOr(configuration, "efficiency-max-skew-ms", 250)
+	if maxSkew <= 0 {
+		return nil, fmt.Errorf("efficiency-max-skew-ms must be positive, got %v", maxSkew)
+	}
+	log.Info().Str("path", path).Msg("Computing the efficiency from the input rail to this rail")
+	return newEfficiencyMeter(path, minInput, time.Duration(maxSkew*float64(time.Millisecond))), nil
+}
+
+func newEfficiencyMeter(path string, minInputWatts float64, maxSkew time.Duration) *efficiencyMeter {
+	m := &efficiencyMeter{path: path, minInputWatts: minInputWatts, maxSkew: maxSkew}
+	metricEfficiency.Set(-1)
+	go m.run()
+	return m
+}
+
+// Reads the samples of the input rail, reconnecting whenever the connection is lost (e.g. while the other
+// instance restarts)
+func (m *efficiencyMeter) run() {
+	connected := true
+	for {
+		conn, err := net.Dial("unix", m.path)
+		if err != nil {
+			if connected {
+				log.Warn().Str("path", m.path).Msgf("unable to connect to the input rail, retrying: %v", err)
+				connected = false
+			}
+			time.Sleep(efficiencyReconnectInterval)
+			continue
+		}
+		log.Info().Str("path", m.path).Msg("Connected to the input rail for the efficiency")
+		connected = true
+
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			var sample inputSample
+			if err := json.Unmarshal(scanner.Bytes(), &sample); err != nil {
+				log.Debug().Msgf("unable to decode input rail sample: %v", err)
+				continue
+			}
+			if sample.Stale {
+				continue
+			}
+			watts := sample.PowerWatts
+			if sample.SignedPowerWatts != nil {
+				watts = *sample.SignedPowerWatts
+			}
+			m.record(inputPower{timestamp: sample.Timestamp, watts: watts})
+		}
+		conn.Close()
+		log.Warn().Str("path", m.path).Msg("Lost the connection to the input rail, reconnecting")
+		time.Sleep(efficiencyReconnectInterval)
+	}
+}
+
+func (m *efficiencyMeter) record(power inputPower) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if n := len(m.history); n > 0 && !power.timestamp.After(m.history[n-1].timestamp) {
+		// Out of order (e.g. the other instance restarted with a stepped clock), start over
+		m.history = m.history[:0]
+	}
+	if len(m.history) == efficiencyHistory {
+		copy(m.history, m.history[1:])
+		m.history = m.history[:efficiencyHistory-1]
+	}
+	m.history = append(m.history, power)
+}
+
+// The input power at the time, interpolated between the input samples around it, or the nearest input sample
+// when the time is past the newest one. False when no input sample is within maxSkew.
+func (m *efficiencyMeter) inputPowerAt(t time.Time) (float64, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	n := len(m.history)
+	if n == 0 {
+		return 0, false
+	}
+	newest := m.history[n-1]
+	if !t.Before(newest.timestamp) {
+		return newest.watts, t.Sub(newest.timestamp) <= m.maxSkew
+	}
+	for i := n - 1; i > 0; i-- {
+		before, after := m.history[i-1], m.history[i]
+		if t.Before(before.timestamp) {
+			continue
+		}
+		if min(t.Sub(before.timestamp), after.timestamp.Sub(t)) > m.maxSkew {
+			// In a gap of the input rail
+			return 0, false
+		}
+		fraction := float64(t.Sub(before.timestamp)) / float64(after.timestamp.Sub(before.timestamp))
+		return before.watts + fraction*(after.watts-before.watts), true
+	}
+	// Older than the kept input samples
+	return 0, false
+}
+
+// Sets the input power and the efficiency of the sample. The efficiency is left out while the input power is
+// below minInputWatts or the power flows back (negative on either rail), where the ratio says nothing about
+// the converter.
+func (m *efficiencyMeter) apply(sample *CurrentSensorOutput) {
+	sample.InputPowerWatts = nil
+	sample.EfficiencyPercent = nil
+	input, ok := m.inputPowerAt(sample.Timestamp)
+	if !ok {
+		metricEfficiency.Set(-1)
+		return
+	}
+	sample.InputPowerWatts = &input
+	if input < m.minInputWatts || sample.SignedPowerWatts < 0 || !sample.ValidFields.Has(FieldPower) {
+		metricEfficiency.Set(-1)
+		return
+	}
+	efficiency := sample.SignedPowerWatts / input * 100
+	sample.EfficiencyPercent = &efficiency
+	metricEfficiency.Set(efficiency)
+}
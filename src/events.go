@@ -0,0 +1,63 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Reasons for publishing a sample in event-driven mode, published in the trigger field
+const (
+	triggerOvercurrent  = "overcurrent"
+	triggerUndervoltage = "undervoltage"
+	triggerDelta        = "delta"
+	triggerAlert        = "alert"
+	triggerHeartbeat    = "heartbeat"
+)
+
+// Decides which samples are published in event-driven mode: only the samples in which a threshold is crossed
+// or a (latched) alert is raised, plus a heartbeat so that consumers know that the service is alive.
+// A threshold of 0 disables that condition.
+type eventTrigger struct {
+	overcurrentAmps   float64
+	undervoltageVolts float64
+	deltaAmps         float64
+	heartbeat         time.Duration
+	lastPublish       time.Time
+	lastCurrent       float64
+	haveLast          bool
+}
+
+func newEventTrigger(overcurrentAmps float64, undervoltageVolts float64, deltaAmps float64, heartbeat time.Duration) *eventTrigger {
+	return &eventTrigger{
+		overcurrentAmps:   overcurrentAmps,
+		undervoltageVolts: undervoltageVolts,
+		deltaAmps:         deltaAmps,
+		heartbeat:         heartbeat,
+	}
+}
+
+// Returns why the sample must be published, or an empty string if it must not be published
+func (t *eventTrigger) check(sample *CurrentSensorOutput, alerted bool) string {
+	delta := math.Abs(sample.CurrentAmps - t.lastCurrent)
+	deltaValid := t.haveLast
+	t.lastCurrent = sample.CurrentAmps
+	t.haveLast = true
+
+	trigger := ""
+	switch {
+	case alerted:
+		trigger = triggerAlert
+	case t.overcurrentAmps > 0 && math.Abs(sample.CurrentAmps) >= t.overcurrentAmps:
+		trigger = triggerOvercurrent
+	case t.undervoltageVolts > 0 && sample.ValidFields&FieldVoltage != 0 && sample.SupplyVoltage <= t.undervoltageVolts:
+		trigger = triggerUndervoltage
+	case t.deltaAmps > 0 && deltaValid && delta >= t.deltaAmps:
+		trigger = triggerDelta
+	case t.heartbeat > 0 && sample.Timestamp.Sub(t.lastPublish) >= t.heartbeat:
+		trigger = triggerHeartbeat
+	default:
+		return ""
+	}
+	t.lastPublish = sample.Timestamp
+	return trigger
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"slices"
+	"sync"
+
+	roverlib "github.com/VU-ASE/roverlib-go/src"
+	"github.com/rs/zerolog/log"
+)
+
+// Identifies a fault in the logs (as the fault field), the status events, the samples and the metrics, so that
+// monitoring can categorize and count faults without matching log messages
+type faultCode string
+
+const (
+	faultBusOpenFailed       faultCode = "bus-open-failed"
+	faultInitFailed          faultCode = "init-failed"
+	faultIDMismatch          faultCode = "id-mismatch"
+	faultWriteVerifyFailed   faultCode = "write-verify-failed"
+	faultReadFailed          faultCode = "read-failed"
+	faultSensorLost          faultCode = "sensor-lost"
+	faultCalibrationReset    faultCode = "calibration-reset"
+	faultCalibrationMismatch faultCode = "calibration-mismatch"
+	faultCurrentClipping     faultCode = "current-clipping"
+	faultShuntSaturated      faultCode = "shunt-saturated"
+	faultUndervoltage        faultCode = "undervoltage"
+	faultLoopStalled         faultCode = "loop-stalled"
+)
+
+// All faults in a fixed order, with the human description that is logged with them
+var faultDescriptions = []struct {
+	code        faultCode
+	description string
+}{
+	{faultBusOpenFailed, "The I2C bus could not be opened"},
+	{faultInitFailed, "The INA226 could not be set up"},
+	{faultIDMismatch, "The device on the I2C bus is not an INA226"},
+	{faultWriteVerifyFailed, "A register of the INA226 did not hold the written value"},
+	{faultReadFailed, "Reading the sensor failed"},
+	{faultSensorLost, "The INA226 stopped responding"},
+	{faultCalibrationReset, "The INA226 lost its calibration (it was reset) and was re-initialized"},
+	{faultCalibrationMismatch, "The current register does not match the current derived from the shunt voltage"},
+	{faultCurrentClipping, "The current readings are clipping at the full scale of the calibration range"},
+	{faultShuntSaturated, "The shunt voltage is saturating at the ADC full scale"},
+	{faultUndervoltage, "The bus voltage is below the low battery threshold"},
+	{faultLoopStalled, "The sensor loop stalled"},
+}
+
+func (c faultCode) description() string {
+	for _, f := range faultDescriptions {
+		if f.code == c {
+			return f.description
+		}
+	}
+	return string(c)
+}
+
+// Keeps track of the active faults. Conditions (e.g. an undervoltage) are raised and cleared, one-off faults
+// (e.g. a reset of the chip) are only recorded. Every fault is counted, and raising, clearing and recording a
+// fault is published as a status event.
+type faultTracker struct {
+	active map[faultCode]bool
+	// The sorted codes of the active faults, replaced (never modified) on every change so that samples can share it
+	codes  []string
+	stream *roverlib.WriteStream
+	counts map[faultCode]*metric
+	gauges map[faultCode]*metric
+	lock   sync.Mutex
+}
+
+var faults = newFaultTracker()
+
+func newFaultTracker() *faultTracker {
+	t := &faultTracker{
+		active: map[faultCode]bool{},
+		counts: map[faultCode]*metric{},
+		gauges: map[faultCode]*metric{},
+	}
+	// Registered per metric name, so that each name has a single HELP and TYPE line
+	for _, f := range faultDescriptions {
+		t.counts[f.code] = metrics.register(&metric{name: "rover_energy_faults_total", help: "Number of times a fault occurred, by fault code",
+			kind: "counter", labels: []label{{"code", string(f.code)}}})
+	}
+	for _, f := range faultDescriptions {
+		t.gauges[f.code] = metrics.register(&metric{name: "rover_energy_fault_active", help: "Whether a fault is active (1) or not (0), by fault code",
+			kind: "gauge", labels: []label{{"code", string(f.code)}}})
+	}
+	return t
+}
+
+// Sets the stream on which the status events are published, nil to only log and count the faults
+func (t *faultTracker) setStream(stream *roverlib.WriteStream) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.stream = stream
+}
+
+// Activates a fault condition, does nothing while it is active already
+func (t *faultTracker) raise(code faultCode) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.active[code] {
+		return
+	}
+	t.active[code] = true
+	t.gauges[code].Set(1)
+	t.update()
+	t.occurred(code)
+}
+
+// Deactivates a fault condition, does nothing while it is not active
+func (t *faultTracker) clear(code faultCode) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if !t.active[code] {
+		return
+	}
+	delete(t.active, code)
+	t.gauges[code].Set(0)
+	t.update()
+	log.Info().Str("fault", string(code)).Msg("Fault cleared")
+	publishStatus(t.stream, statusOK, "fault-cleared:"+string(code))
+}
+
+// Records a fault that is over as soon as it occurred (e.g. a reset of the chip)
+func (t *faultTracker) record(code faultCode) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.occurred(code)
+}
+
+// Records a fault that makes the service exit, and returns err for convenience
+func (t *faultTracker) fatal(code faultCode, err error) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.counts[code].Add(1)
+	log.Error().Str("fault", string(code)).Str("description", code.description()).Msgf("%v", err)
+	return err
+}
+
+// The codes of the active faults, sorted. The slice must not be modified.
+func (t *faultTracker) activeCodes() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.codes
+}
+
+func (t *faultTracker) occurred(code faultCode) {
+	t.counts[code].Add(1)
+	log.Warn().Str("fault", string(code)).Msg(code.description())
+	publishStatus(t.stream, statusOK, "fault:"+string(code))
+}
+
+func (t *faultTracker) update() {
+	codes := make([]string, 0, len(t.active))
+	for code := range t.active {
+		codes = append(codes, string(code))
+	}
+	slices.Sort(codes)
+	if len(codes) == 0 {
+		codes = nil
+	}
+	t.codes = codes
+}
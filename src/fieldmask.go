@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// The measured quantities of a sensor that are meaningful. For example, a sensor on a rail without
+// a meaningful shunt only monitors voltage, and its current and power readings should not be used.
+type FieldMask uint8
+
+const (
+	FieldVoltage FieldMask = 1 << iota
+	FieldCurrent
+	FieldPower
+	FieldShuntVoltage
+
+	AllFields = FieldVoltage | FieldCurrent | FieldPower | FieldShuntVoltage
+)
+
+var fieldNames = []struct {
+	field FieldMask
+	name  string
+}{
+	{FieldVoltage, "voltage"},
+	{FieldCurrent, "current"},
+	{FieldPower, "power"},
+	{FieldShuntVoltage, "shunt-voltage"},
+}
+
+// Parses a comma-separated list of field names (e.g. "voltage,current")
+func parseFieldMask(s string) (FieldMask, error) {
+	mask := FieldMask(0)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, f := range fieldNames {
+			if f.name == name {
+				mask |= f.field
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown field %q, valid fields are voltage, current, power and shunt-voltage", name)
+		}
+	}
+	if mask == 0 {
+		return 0, fmt.Errorf("at least one field must be valid")
+	}
+	return mask, nil
+}
+
+func (m FieldMask) Has(field FieldMask) bool {
+	return m&field != 0
+}
+
+func (m FieldMask) Names() []string {
+	names := []string{}
+	for _, f := range fieldNames {
+		if m.Has(f.field) {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
+// Encodes the mask as a list of field names, which is easier to interpret for consumers than a bitmask
+func (m FieldMask) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.Names())
+}
+
+// Zeroes the fields that are not valid for this sensor and records which fields are valid (and were read)
+func (m FieldMask) apply(sample *CurrentSensorOutput) {
+	sample.ValidFields &= m
+	if !m.Has(FieldVoltage) {
+		sample.SupplyVoltage = 0
+	}
+	if !m.Has(FieldCurrent) {
+		sample.CurrentAmps = 0
+	}
+	if !m.Has(FieldPower) {
+		sample.PowerWatts = 0
+		sample.SignedPowerWatts = 0
+	}
+	if !m.Has(FieldShuntVoltage) {
+		sample.ShuntVoltage = 0
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	roverlib "github.com/VU-ASE/roverlib-go/src"
+	"periph.io/x/conn/v3/i2c"
+)
+
+// A supported fuel gauge IC: where its state of charge and remaining capacity are read
+type fuelGaugeChip struct {
+	name    string
+	address uint16
+	// Reads the state of charge in percent and the remaining charge in Ah (NaN when not provided)
+	read func(dev *i2c.Dev) (float64, float64, error)
+}
+
+var fuelGaugeChips = []fuelGaugeChip{
+	{
+		// TI BQ27441 (and the other BQ27xxx gauges with the same standard commands), 16-bit little-endian
+		name:    "bq27441",
+		address: 0x55,
+		read: func(dev *i2c.Dev) (float64, float64, error) {
+			soc, err := readGaugeWord(dev, 0x1c, false)
+			if err != nil {
+				return 0, 0, fmt.Errorf("failed to read StateOfCharge: %v", err)
+			}
+			remaining, err := readGaugeWord(dev, 0x0c, false)
+			if err != nil {
+				return 0, 0, fmt.Errorf("failed to read RemainingCapacity: %v", err)
+			}
+			return float64(soc), float64(remaining) / 1000, nil
+		},
+	},
+	{
+		// Maxim MAX17048/MAX17049, a voltage-based gauge without a capacity estimate, 16-bit big-endian
+		name:    "max17048",
+		address: 0x36,
+		read: func(dev *i2c.Dev) (float64, float64, error) {
+			soc, err := readGaugeWord(dev, 0x04, true)
+			if err != nil {
+				return 0, 0, fmt.Errorf("failed to read SOC: %v", err)
+			}
+			return min(float64(soc)/256, 100), math.NaN(), nil
+		},
+	},
+}
+
+// Reads the state of charge from a fuel gauge (coulomb counter) IC on the I2C bus, which tracks the charge in
+// hardware more accurately than the software integration
+type fuelGauge struct {
+	chip fuelGaugeChip
+	bus  i2c.BusCloser
+	dev  *i2c.Dev
+}
+
+// Reads the fuel-gauge options, returns nil when no fuel gauge is configured. The gauge gets a bus handle of
+// its own, since the sensor may reopen its bus during bus recovery.
+func openFuelGauge(configuration *roverlib.ServiceConfiguration, openBus func() (i2c.BusCloser, error)) (*fuelGauge, error) {
+	name := getStringOr(configuration, "fuel-gauge", "")
+	if name == "" {
+		return nil, nil
+	}
+	var chip *fuelGaugeChip
+	names := []string{}
+	for i := range fuelGaugeChips {
+		names = append(names, fuelGaugeChips[i].name)
+		if fuelGaugeChips[i].name == name {
+			chip = &fuelGaugeChips[i]
+		}
+	}
+	if chip == nil {
+		return nil, fmt.Errorf("unknown fuel-gauge %q, supported are %v", name, names)
+	}
+	// 0 selects the default address of the chip
+	address := uint16(getFloatOr(configuration, "fuel-gauge-address", 0))
+	if address == 0 {
+		address = chip.address
+	}
+
+	bus, err := openBus()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the I2C bus for the fuel gauge: %v", err)
+	}
+	return &fuelGauge{chip: *chip, bus: bus, dev: &i2c.Dev{Bus: bus, Addr: address}}, nil
+}
+
+func (g *fuelGauge) Name() string {
+	return g.chip.name
+}
+
+func (g *fuelGauge) ReadCharge() (float64, float64, bool, error) {
+	percent, remainingAh, err := g.chip.read(g.dev)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	return percent, remainingAh, true, nil
+}
+
+func (g *fuelGauge) Close() error {
+	return g.bus.Close()
+}
+
+// Reads a 16-bit register (or standard command) of a fuel gauge with a combined transaction
+func readGaugeWord(dev *i2c.Dev, reg uint8, bigEndian bool) (uint16, error) {
+	data := make([]byte, 2)
+	if err := dev.Tx([]byte{reg}, data); err != nil {
+		return 0, err
+	}
+	if bigEndian {
+		return uint16(data[0])<<8 | uint16(data[1]), nil
+	}
+	return uint16(data[1])<<8 | uint16(data[0]), nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	roverlib "github.com/VU-ASE/roverlib-go/src"
+)
+
+// What is published in place of a sample when a read fails
+type gapFillPolicy string
+
+const (
+	// Publish nothing, consumers see a gap
+	gapFillSkip gapFillPolicy = "skip"
+	// Republish the last good sample, flagged as stale
+	gapFillHold gapFillPolicy = "hold"
+	// Publish a sample without valid measurements (NaN on the output stream), flagged as stale, to keep the cadence
+	gapFillNaN gapFillPolicy = "nan"
+)
+
+func readGapFillPolicy(configuration *roverlib.ServiceConfiguration) (gapFillPolicy, error) {
+	policy := gapFillPolicy(getStringOr(configuration, "gap-fill", string(gapFillSkip)))
+	switch policy {
+	case gapFillSkip, gapFillHold, gapFillNaN:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid gap-fill %q, must be %q, %q or %q", policy, gapFillSkip, gapFillHold, gapFillNaN)
+	}
+}
+
+// Produces the samples that fill the gaps of failed reads. The filled samples are only published, they never
+// feed the accumulation, statistics or detectors.
+type gapFiller struct {
+	policy   gapFillPolicy
+	last     CurrentSensorOutput
+	haveLast bool
+}
+
+func newGapFiller(policy gapFillPolicy) *gapFiller {
+	return &gapFiller{policy: policy}
+}
+
+// Remembers the last good sample as it was published (after the corrections and transforms)
+func (g *gapFiller) remember(sample *CurrentSensorOutput) {
+	g.last = *sample
+	g.haveLast = true
+}
+
+// Returns the sample to publish for a failed read, or nil to publish nothing. The cumulative values of the last
+// good sample are kept, since nothing was accumulated in the meantime.
+func (g *gapFiller) fill(now time.Time) *CurrentSensorOutput {
+	if g.policy == gapFillSkip || !g.haveLast {
+		return nil
+	}
+
+	sample := g.last
+	sample.Timestamp = now
+	sample.Stale = true
+	if g.policy == gapFillNaN {
+		sample.SupplyVoltage = 0
+		sample.CurrentAmps = 0
+		sample.PowerWatts = 0
+		sample.SignedPowerWatts = 0
+		sample.ShuntVoltage = 0
+		sample.SkewMicros = 0
+		sample.ValidFields = 0
+	}
+	return &sample
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The latest values that are carried by the heartbeat
+type heartbeatValues struct {
+	Timestamp     time.Time `json:"timestamp"`
+	SupplyVoltage float64   `json:"supplyVoltage"`
+	CurrentAmps   float64   `json:"currentAmps"`
+	PowerWatts    float64   `json:"powerWatts"`
+	EnergyWh      float64   `json:"energyWh"`
+	ChargeAh      float64   `json:"chargeAh"`
+}
+
+type heartbeatMessage struct {
+	Sequence      uint64    `json:"sequence"`
+	Timestamp     time.Time `json:"timestamp"`
+	UptimeSeconds float64   `json:"uptimeSeconds"`
+	// "ok", "degraded" while faults are active, or "sensor-lost"
+	Health string   `json:"health"`
+	Faults []string `json:"faults,omitempty"`
+	// Absent until the first sample was read
+	Latest *heartbeatValues `json:"latest,omitempty"`
+}
+
+// Publishes a heartbeat at a fixed interval, independent of the sample rate and of whether the samples are
+// published at all (e.g. with event-mode), so that watchdogs can tell "no changes" apart from a dead service
+type heartbeat struct {
+	interval   time.Duration
+	start      time.Time
+	sequence   uint64
+	latest     heartbeatValues
+	haveLatest bool
+	publish    func(payload []byte)
+	lock       sync.Mutex
+}
+
+func newHeartbeat(interval time.Duration, start time.Time, publish func(payload []byte)) *heartbeat {
+	return &heartbeat{interval: interval, start: start, publish: publish}
+}
+
+// Remembers the values of the latest sample
+func (h *heartbeat) update(sample *CurrentSensorOutput) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.latest = heartbeatValues{
+		Timestamp:     sample.Timestamp,
+		SupplyVoltage: sample.SupplyVoltage,
+		CurrentAmps:   sample.CurrentAmps,
+		PowerWatts:    sample.PowerWatts,
+		EnergyWh:      sample.EnergyWh,
+		ChargeAh:      sample.ChargeAh,
+	}
+	h.haveLatest = true
+}
+
+// Publishes the heartbeats until the process exits
+func (h *heartbeat) run() {
+	for range time.Tick(h.interval) {
+		payload, err := json.Marshal(h.next())
+		if err != nil {
+			log.Warn().Msgf("unable to encode heartbeat: %v", err)
+			continue
+		}
+		h.publish(payload)
+	}
+}
+
+func (h *heartbeat) next() heartbeatMessage {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.sequence++
+	msg := heartbeatMessage{
+		Sequence:      h.sequence,
+		Timestamp:     time.Now(),
+		UptimeSeconds: time.Since(h.start).Seconds(),
+		Health:        "ok",
+		Faults:        faults.activeCodes(),
+	}
+	switch {
+	case slices.Contains(msg.Faults, string(faultSensorLost)):
+		msg.Health = "sensor-lost"
+	case len(msg.Faults) > 0:
+		msg.Health = "degraded"
+	}
+	if h.haveLatest {
+		latest := h.latest
+		msg.Latest = &latest
+	}
+	return msg
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Accumulates how much time was spent in each current bucket during a run, to characterize duty cycles.
+// With edges e0 < e1 < ... < en, the buckets are (-inf, e0), [e0, e1), ..., [en, +inf).
+type currentHistogram struct {
+	edges     []float64
+	durations []time.Duration // one more than the number of edges
+	last      time.Time       // timestamp of the previous sample, zero before the first sample
+	// The histogram is dumped from the signal and termination handlers, which run concurrently with the loop
+	lock sync.Mutex
+}
+
+// Parses a comma-separated list of bucket edges in amps (e.g. "0,2,5,8")
+func parseHistogramEdges(s string) ([]float64, error) {
+	edges := []float64{}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		edge, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid histogram edge %q: %v", field, err)
+		}
+		edges = append(edges, edge)
+	}
+	if !sort.Float64sAreSorted(edges) {
+		return nil, fmt.Errorf("histogram edges must be in ascending order, got %v", edges)
+	}
+	return edges, nil
+}
+
+func newCurrentHistogram(edges []float64) *currentHistogram {
+	return &currentHistogram{
+		edges:     edges,
+		durations: make([]time.Duration, len(edges)+1),
+	}
+}
+
+// Credits the time since the previous sample to the bucket of this sample's current
+func (h *currentHistogram) add(sample *CurrentSensorOutput) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if !h.last.IsZero() {
+		bucket := sort.Search(len(h.edges), func(i int) bool { return h.edges[i] > sample.CurrentAmps })
+		h.durations[bucket] += sample.Timestamp.Sub(h.last)
+	}
+	h.last = sample.Timestamp
+}
+
+// Logs the time and share of the total time spent in each bucket
+func (h *currentHistogram) dump() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	total := time.Duration(0)
+	for _, d := range h.durations {
+		total += d
+	}
+	if total == 0 {
+		log.Info().Msg("Current histogram is empty")
+		return
+	}
+
+	log.Info().Dur("total", total).Msg("Current histogram")
+	for i, d := range h.durations {
+		lower, upper := math.Inf(-1), math.Inf(1)
+		if i > 0 {
+			lower = h.edges[i-1]
+		}
+		if i < len(h.edges) {
+			upper = h.edges[i]
+		}
+		log.Info().
+			Float64("fromAmps", lower).
+			Float64("toAmps", upper).
+			Dur("duration", d).
+			Float64("percentage", 100*float64(d)/float64(total)).
+			Msgf("  [%v A, %v A): %.1f%%", lower, upper, 100*float64(d)/float64(total))
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Interval at which a lost sensor is probed to see if it (or a replacement) has appeared
+const hotswapProbeInterval = 1 * time.Second
+
+// Delays between the attempts to set up the sensor at startup, doubled after every attempt
+const (
+	startupRetryDelay    = 250 * time.Millisecond
+	startupMaxRetryDelay = 5 * time.Second
+)
+
+// Sets up the sensor with init, and retries it with a growing delay for up to timeout after a failure, since at
+// cold boot the I2C bus or the power of the sensor may not be ready when the service starts. A wrong device
+// on the bus is not retried, it will not change by waiting. Returns the fault of the last failed attempt.
+func retryStartup(timeout time.Duration, init func() (faultCode, error)) (faultCode, error) {
+	deadline := time.Now().Add(timeout)
+	delay := startupRetryDelay
+	for attempt := 1; ; attempt++ {
+		code, err := init()
+		if err == nil {
+			if attempt > 1 {
+				log.Info().Int("attempts", attempt).Msg("The sensor is ready")
+			}
+			return "", nil
+		}
+		if code == faultIDMismatch || time.Now().Add(delay).After(deadline) {
+			return code, err
+		}
+		log.Warn().Int("attempt", attempt).Dur("retryIn", delay).Msgf("The sensor is not ready yet: %v", err)
+		time.Sleep(delay)
+		delay = min(delay*2, startupMaxRetryDelay)
+	}
+}
+
+// Detects when the INA226 stops responding (e.g. because the sensor board is unplugged on the test bench)
+// and re-initializes it as soon as a device responds again, so that the service does not need to be restarted
+type hotswapMonitor struct {
+	ina          *INA226
+	lostAfter    int // consecutive failed reads before the sensor is considered lost, 0 disables detection
+	failures     int
+	lost         bool
+	lastProbe    time.Time
+	onLost       func()
+	onReattached func()
+}
+
+func newHotswapMonitor(ina *INA226, lostAfter int, onLost func(), onReattached func()) *hotswapMonitor {
+	return &hotswapMonitor{
+		ina:          ina,
+		lostAfter:    lostAfter,
+		onLost:       onLost,
+		onReattached: onReattached,
+	}
+}
+
+// Whether the sensor is currently considered lost, in which case it should not be read
+func (m *hotswapMonitor) isLost() bool {
+	return m.lost
+}
+
+func (m *hotswapMonitor) readSucceeded() {
+	m.failures = 0
+}
+
+func (m *hotswapMonitor) readFailed() {
+	if m.lostAfter <= 0 || m.lost {
+		return
+	}
+	m.failures++
+	if m.failures >= m.lostAfter {
+		m.lost = true
+		log.Warn().Int("failures", m.failures).Msg("INA226 stopped responding, waiting for a sensor to appear")
+		m.onLost()
+	}
+}
+
+// Probes for a (possibly different) sensor at most once per probe interval and sets it up when it responds.
+// Returns whether the sensor was re-initialized. Only the hardware is set up again, the state of the service
+// (e.g. the accumulated totals) is left to the caller.
+func (m *hotswapMonitor) probe() bool {
+	if !m.lost || time.Since(m.lastProbe) < hotswapProbeInterval {
+		return false
+	}
+	m.lastProbe = time.Now()
+
+	if err := m.ina.Reinitialize(); err != nil {
+		log.Debug().Msgf("No sensor available yet: %v", err)
+		return false
+	}
+	m.lost = false
+	m.failures = 0
+	log.Info().Msg("INA226 responded again and was re-initialized")
+	m.onReattached()
+	return true
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The HTTP endpoints of the service (metrics and debugging), served when http-listen is configured
+var httpMux = http.NewServeMux()
+
+// Serves the HTTP endpoints in the background, a failing server does not stop the service
+func serveHTTP(address string) {
+	go func() {
+		log.Info().Str("address", address).Msg("Serving HTTP endpoints")
+		if err := http.ListenAndServe(address, httpMux); err != nil {
+			log.Error().Msgf("http server stopped: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	roverlib "github.com/VU-ASE/roverlib-go/src"
+	"github.com/rs/zerolog/log"
+)
+
+// Classes of I2C transaction errors that need different handling
+type busErrorKind int
+
+const (
+	busErrorOther busErrorKind = iota
+	// Another master won the arbitration, the transaction can simply be retried
+	busErrorArbitrationLost
+	// The bus is in use by another master (or stuck), retry after a short delay
+	busErrorBusy
+	// The device did not acknowledge, e.g. because it is absent or still waking up
+	busErrorNACK
+)
+
+const (
+	// Number of retries of a transaction that failed because of arbitration or a busy bus
+	busRetries = 5
+	// Delay before the first retry, doubled for every next retry
+	busRetryBaseDelay = 200 * time.Microsecond
+)
+
+// Returned by a bus when a read transfer ended before all bytes were received, so that a truncated register
+// value is never taken for a valid one
+type ShortReadError struct {
+	Read     int
+	Expected int
+}
+
+func (e *ShortReadError) Error() string {
+	return fmt.Sprintf("short read, received %d of %d bytes", e.Read, e.Expected)
+}
+
+// Reads the byte order of the register values on the bus from byte-order. The INA226 is big-endian, but some
+// I2C bridges and USB adapters deliver the bytes swapped.
+func readByteOrder(configuration *roverlib.ServiceConfiguration) (binary.ByteOrder, error) {
+	switch order := getStringOr(configuration, "byte-order", "big"); order {
+	case "big":
+		return binary.BigEndian, nil
+	case "little":
+		log.Warn().Msg("Interpreting the register values as little-endian, for a byte-swapping adapter")
+		return binary.LittleEndian, nil
+	default:
+		return nil, fmt.Errorf("invalid byte-order %q, must be \"big\" or \"little\"", order)
+	}
+}
+
+// Reads the I2C address of the sensor from i2c-address, e.g. "0x41" or "65", which the A0 and A1 pins of the
+// chip select. Needed to read several sensors on one bus, one instance of the service each.
+func readSensorAddress(configuration *roverlib.ServiceConfiguration) (uint16, error) {
+	text := getStringOr(configuration, "i2c-address", "0x40")
+	address, err := strconv.ParseUint(strings.TrimSpace(text), 0, 16)
+	if err != nil || address < ina226Address || address > ina226MaxAddress {
+		return 0, fmt.Errorf("invalid i2c-address %q, must be 0x%02x to 0x%02x", text, ina226Address, ina226MaxAddress)
+	}
+	return uint16(address), nil
+}
+
+// Classifies a transaction error using the error codes from the Linux I2C fault code documentation.
+// periph formats (rather than wraps) the errno, so the error message is matched as well.
+func classifyBusError(err error) busErrorKind {
+	matches := func(errno syscall.Errno) bool {
+		return errors.Is(err, errno) || strings.Contains(err.Error(), errno.Error())
+	}
+
+	switch {
+	case matches(syscall.EAGAIN):
+		return busErrorArbitrationLost
+	case matches(syscall.EBUSY):
+		return busErrorBusy
+	case matches(syscall.ENXIO), matches(syscall.EREMOTEIO):
+		return busErrorNACK
+	default:
+		return busErrorOther
+	}
+}
+
+// Performs an I2C transaction, retrying with backoff when arbitration is lost or the bus is busy.
+// When the bus stays busy for longer than the busy timeout, counted across transactions since the retries of a
+// single one take only a few milliseconds, the bus is recovered (if possible) before the next attempts. NACKs
+// and other errors are returned immediately, they are handled by the callers. Called with lock held.
+func (ina *INA226) tx(w []byte, r []byte) error {
+	return ina.retryBus(func() error {
+		return ina.dev.Tx(w, r)
+	})
+}
+
+// Runs a bus operation with the retry and recovery of tx
+func (ina *INA226) retryBus(op func() error) error {
+	delay := busRetryBaseDelay
+	recovered := false
+
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil {
+			ina.busySince = time.Time{}
+			return nil
+		}
+
+		switch classifyBusError(err) {
+		case busErrorArbitrationLost:
+			ina.arbitrationErrors.Add(1)
+		case busErrorBusy:
+			ina.busBusyErrors.Add(1)
+			if ina.busySince.IsZero() {
+				ina.busySince = time.Now()
+			}
+			if busy := time.Since(ina.busySince); !recovered && ina.busBusyTimeout > 0 && busy >= ina.busBusyTimeout {
+				recovered = true
+				// A bus that stays busy after the recovery is given the full timeout again
+				ina.busySince = time.Time{}
+				if rerr := ina.recoverBus(); rerr != nil {
+					return fmt.Errorf("bus stayed busy for %v and could not be recovered: %v (%v)", busy, rerr, err)
+				}
+			}
+		default:
+			ina.busySince = time.Time{}
+			return err
+		}
+
+		if attempt >= busRetries {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Tries to free a stuck bus. Platforms whose bus supports it get a recovery sequence (clocking out the
+// device that holds SDA low), after which the bus is reopened if a way to reopen it was provided.
+func (ina *INA226) recoverBus() error {
+	log.Warn().Msg("I2C bus stays busy, attempting bus recovery")
+
+	if recoverer, ok := ina.bus.(interface{ Recover() error }); ok {
+		if err := recoverer.Recover(); err != nil {
+			log.Warn().Msgf("bus recovery sequence failed: %v", err)
+		}
+	}
+
+	if ina.reopen == nil {
+		return fmt.Errorf("reopening the bus is not supported")
+	}
+	ina.bus.Close()
+	bus, err := ina.reopen()
+	if err != nil {
+		return fmt.Errorf("failed to reopen bus: %v", err)
+	}
+	ina.bus = bus
+	ina.dev.Bus = bus
+	ina.busReopens.Add(1)
+	log.Info().Msg("Reopened I2C bus")
+	return nil
+}
+
+// Number of times the bus was reopened during bus recovery
+func (ina *INA226) BusReopens() uint64 {
+	return ina.busReopens.Load()
+}
+
+// Number of transactions that lost arbitration to another master
+func (ina *INA226) ArbitrationErrors() uint64 {
+	return ina.arbitrationErrors.Load()
+}
+
+// Number of transactions that failed because the bus was busy
+func (ina *INA226) BusBusyErrors() uint64 {
+	return ina.busBusyErrors.Load()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/binary"
+	"syscall"
+	"testing"
+	"time"
+
+	"periph.io/x/conn/v3/i2c"
+)
+
+// An adapter that swaps the two bytes of every register value, in both directions
+type swappingBus struct {
+	*fakeBus
+}
+
+func (b swappingBus) Tx(addr uint16, w, r []byte) error {
+	if len(w) == 3 {
+		w = []byte{w[0], w[2], w[1]}
+	}
+	if err := b.fakeBus.Tx(addr, w, r); err != nil {
+		return err
+	}
+	if len(r) == 2 {
+		r[0], r[1] = r[1], r[0]
+	}
+	return nil
+}
+
+func TestByteOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		order binary.ByteOrder
+		wrap  func(*fakeBus) i2c.BusCloser
+	}{
+		{"big", binary.BigEndian, func(b *fakeBus) i2c.BusCloser { return b }},
+		{"little", binary.LittleEndian, func(b *fakeBus) i2c.BusCloser { return swappingBus{b} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cal, err := NewCalibration(0.002, 10)
+			if err != nil {
+				t.Fatalf("NewCalibration: %v", err)
+			}
+			bus := newFakeBus()
+			// The ID check fails when the bytes are interpreted in the wrong order
+			ina, err := NewINA226(tt.wrap(bus), INA226Options{Calibration: cal, ByteOrder: tt.order})
+			if err != nil {
+				t.Fatalf("NewINA226: %v", err)
+			}
+
+			// Writes reach the chip in its own order
+			if writes := bus.writesTo(calibrationReg); len(writes) != 1 || writes[0] != cal.Register {
+				t.Errorf("calibration writes %v, want [%d]", writes, cal.Register)
+			}
+			if writes := bus.writesTo(configReg); len(writes) != 1 || writes[0] != configValue {
+				t.Errorf("configuration writes %v, want [0x%04x]", writes, configValue)
+			}
+
+			// And reads are interpreted in it, on both read paths
+			bus.set(currentReg, 0x1234)
+			bus.set(busVoltReg, 0x2580)
+			if value, err := ina.readRegister(currentReg); err != nil || value != 0x1234 {
+				t.Errorf("readRegister = 0x%04x, %v, want 0x1234", value, err)
+			}
+			current, voltage, _, err := ina.readCurrentAndBusVoltageRaw()
+			if err != nil || current != 0x1234 || voltage != 0x2580 {
+				t.Errorf("readCurrentAndBusVoltageRaw = 0x%04x, 0x%04x, %v, want 0x1234, 0x2580", current, voltage, err)
+			}
+		})
+	}
+}
+
+func TestReadByteOrderDefault(t *testing.T) {
+	order, err := readByteOrder(nil)
+	if err != nil || order != binary.BigEndian {
+		t.Errorf("readByteOrder(nil) = %v, %v, want big-endian", order, err)
+	}
+}
+
+// An adapter that counts the transactions that only set the register pointer
+type pointerCountingBus struct {
+	*fakeBus
+	pointerOnly *int
+}
+
+func (b pointerCountingBus) Tx(addr uint16, w, r []byte) error {
+	if len(w) == 1 && len(r) == 0 {
+		*b.pointerOnly++
+	}
+	return b.fakeBus.Tx(addr, w, r)
+}
+
+func TestReadRegisterCombinedTransaction(t *testing.T) {
+	cal, err := NewCalibration(0.002, 10)
+	if err != nil {
+		t.Fatalf("NewCalibration: %v", err)
+	}
+	bus := newFakeBus()
+	pointerOnly := 0
+	ina, err := NewINA226(pointerCountingBus{bus, &pointerOnly}, INA226Options{Calibration: cal})
+	if err != nil {
+		t.Fatalf("NewINA226: %v", err)
+	}
+	bus.set(currentReg, 0x1234)
+	if value, err := ina.readRegister(currentReg); err != nil || value != 0x1234 {
+		t.Errorf("readRegister = 0x%04x, %v, want 0x1234", value, err)
+	}
+	if pointerOnly != 0 {
+		t.Errorf("%d transactions only set the register pointer, want every read combined", pointerOnly)
+	}
+}
+
+func TestBusRecoveryAcrossTransactions(t *testing.T) {
+	cal, err := NewCalibration(0.002, 10)
+	if err != nil {
+		t.Fatalf("NewCalibration: %v", err)
+	}
+	bus := newFakeBus()
+	reopened := 0
+	ina, err := NewINA226(bus, INA226Options{
+		Calibration:    cal,
+		BusBusyTimeout: 20 * time.Millisecond,
+		Reopen: func() (i2c.BusCloser, error) {
+			reopened++
+			return bus, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewINA226: %v", err)
+	}
+
+	// The retries of a single read give up long before the timeout, the reads of the next samples go on counting
+	bus.lock.Lock()
+	bus.readErr = syscall.EBUSY
+	bus.lock.Unlock()
+	start := time.Now()
+	for reopened == 0 && time.Since(start) < time.Second {
+		if _, err := ina.readRegister(currentReg); err == nil {
+			t.Fatalf("read succeeded on a busy bus")
+		}
+	}
+	if reopened != 1 || ina.BusReopens() != 1 {
+		t.Fatalf("reopened the bus %d times after %v, want once", reopened, time.Since(start))
+	}
+
+	// A read that gets through ends the busy period
+	bus.lock.Lock()
+	bus.readErr = nil
+	bus.lock.Unlock()
+	if _, err := ina.readRegister(currentReg); err != nil {
+		t.Fatalf("readRegister: %v", err)
+	}
+	if !ina.busySince.IsZero() {
+		t.Errorf("still busy since %v after a successful read", ina.busySince)
+	}
+}
+
+func TestSensorAddress(t *testing.T) {
+	cal, err := NewCalibration(0.002, 10)
+	if err != nil {
+		t.Fatalf("NewCalibration: %v", err)
+	}
+	for _, address := range []uint16{0, 0x41} {
+		ina, err := NewINA226(newFakeBus(), INA226Options{Calibration: cal, Address: address})
+		if err != nil {
+			t.Fatalf("NewINA226: %v", err)
+		}
+		want := address
+		if want == 0 {
+			want = ina226Address
+		}
+		if ina.dev.Addr != want {
+			t.Errorf("address 0x%02x with option 0x%02x, want 0x%02x", ina.dev.Addr, address, want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	roverlib "github.com/VU-ASE/roverlib-go/src"
+	"github.com/rs/zerolog/log"
+	"periph.io/x/conn/v3/i2c"
+	"periph.io/x/conn/v3/physic"
+)
+
+// Constants from linux/i2c-dev.h and linux/i2c.h
+const (
+	ioctlI2CRdwr = 0x0707
+	i2cMsgRead   = 0x0001
+)
+
+// Opens the I2C bus of the sensor, at startup and to reopen it after the sensor was disconnected
+type busOpener interface {
+	open() (i2c.BusCloser, error)
+	// The i2c-dev character device of the bus, for the SMBus reads
+	devicePath() string
+	String() string
+}
+
+// Opens the bus by name through periph, see openI2CBus
+type periphBusOpener struct {
+	drivers periphDrivers
+	name    string
+}
+
+func (o periphBusOpener) open() (i2c.BusCloser, error) {
+	return openI2CBus(o.drivers, o.name)
+}
+
+func (o periphBusOpener) devicePath() string {
+	return fmt.Sprintf(i2cDevicePathTemplate, o.name)
+}
+
+func (o periphBusOpener) String() string {
+	return o.name
+}
+
+// Opens the bus through its i2c-dev character device, without periph
+type deviceBusOpener struct {
+	path string
+}
+
+func (o deviceBusOpener) open() (i2c.BusCloser, error) {
+	return openI2CDevice(o.path)
+}
+
+func (o deviceBusOpener) devicePath() string {
+	return o.path
+}
+
+func (o deviceBusOpener) String() string {
+	return o.path
+}
+
+// Opens the bus by the device path in i2c-device-path when set, for platforms where the periph registry does
+// not enumerate the bus, and through periph otherwise
+func readBusOpener(configuration *roverlib.ServiceConfiguration, drivers periphDrivers) busOpener {
+	if path := getStringOr(configuration, "i2c-device-path", ""); path != "" {
+		log.Info().Str("path", path).Msg("Opening the I2C bus by its device path, bypassing the periph registry")
+		return deviceBusOpener{path: path}
+	}
+	return periphBusOpener{drivers: drivers, name: i2cBusName}
+}
+
+// Mirrors struct i2c_msg
+type i2cMsg struct {
+	addr   uint16
+	flags  uint16
+	length uint16
+	buf    *byte
+}
+
+// Mirrors struct i2c_rdwr_ioctl_data
+type i2cRdwrIoctlData struct {
+	msgs  *i2cMsg
+	nmsgs uint32
+}
+
+// An I2C bus that does its transactions with I2C_RDWR ioctls on an i2c-dev character device (e.g. /dev/i2c-1),
+// so the write and read of a transaction are combined with a repeated start, like periph does
+type i2cDevice struct {
+	path string
+	file *os.File
+}
+
+func openI2CDevice(path string) (*i2cDevice, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &i2cDevice{path: path, file: file}, nil
+}
+
+// Writes w and then reads r from the device at addr. The errno is wrapped, so that classifyBusError recognizes it.
+// The ioctl returns the number of messages that were transferred, when the read message is missing from it the
+// read is reported as a *ShortReadError.
+func (d *i2cDevice) Tx(addr uint16, w, r []byte) error {
+	var msgs [2]i2cMsg
+	n := 0
+	if len(w) > 0 {
+		msgs[n] = i2cMsg{addr: addr, length: uint16(len(w)), buf: &w[0]}
+		n++
+	}
+	if len(r) > 0 {
+		msgs[n] = i2cMsg{addr: addr, flags: i2cMsgRead, length: uint16(len(r)), buf: &r[0]}
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+
+	data := i2cRdwrIoctlData{msgs: &msgs[0], nmsgs: uint32(n)}
+	transferred, _, errno := syscall.Syscall(syscall.SYS_IOCTL, d.file.Fd(), ioctlI2CRdwr, uintptr(unsafe.Pointer(&data)))
+	if errno != 0 {
+		return fmt.Errorf("i2c-dev: %w", errno)
+	}
+	return checkTransferred(int(transferred), n, len(r))
+}
+
+// Checks the number of messages that an I2C_RDWR ioctl transferred, of which the read of readBytes (if any) is
+// the last one
+func checkTransferred(transferred int, messages int, readBytes int) error {
+	if transferred >= messages {
+		return nil
+	}
+	if readBytes > 0 {
+		return fmt.Errorf("i2c-dev: %w", &ShortReadError{Read: 0, Expected: readBytes})
+	}
+	return fmt.Errorf("i2c-dev: transferred %d of %d messages", transferred, messages)
+}
+
+// The i2c-dev interface has no way to change the bus speed, it is set by the device tree (or the adapter)
+func (d *i2cDevice) SetSpeed(f physic.Frequency) error {
+	return errors.New("i2c-dev: the bus speed cannot be changed through the character device")
+}
+
+func (d *i2cDevice) String() string {
+	return d.path
+}
+
+func (d *i2cDevice) Close() error {
+	return d.file.Close()
+}
@@ -0,0 +1,1065 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"periph.io/x/conn/v3/i2c"
+)
+
+const (
+	// Device address with A0 and A1 tied to GND, the default. The address pins select one of 0x40 to 0x4F.
+	ina226Address    = 0x40
+	ina226MaxAddress = 0x4F
+
+	// Register addresses
+	configReg      = 0x00
+	shuntVoltReg   = 0x01
+	busVoltReg     = 0x02
+	powerReg       = 0x03
+	currentReg     = 0x04
+	calibrationReg = 0x05
+	maskEnableReg  = 0x06
+	alertLimitReg  = 0x07
+	manufIDReg     = 0xFE
+	dieIDReg       = 0xFF
+
+	// Identification values
+	manufID = 0x5449 // "TI" in ASCII
+	dieID   = 0x226  // bits 15-4 of the die ID register, bits 3-0 hold the die revision
+
+	// Configuration values
+	configValue = 0x4127 // Default configuration
+
+	// The bits of the registers that read back what was written, see writeRegisterVerified
+	configWritableBits      = 0x7FFF // the reset bit always reads 0
+	calibrationWritableBits = 0x7FFF // bit 15 is reserved
+	maskEnableWritableBits  = 0xFC03 // bits 4-2 are the read-only flags
+
+	// Mask/enable register bits
+	conversionReadyAlert = 1 << 10 // CNVR, assert the ALERT pin when a conversion is ready
+	conversionReadyFlag  = 1 << 3  // CVRF, set when a conversion is ready, cleared by reading the register
+	alertFunctionFlag    = 1 << 4  // AFF, set when the alert function triggered
+	alertLatchEnable     = 1 << 0  // LEN, keep the ALERT pin and AFF asserted until the register is read
+
+	// Conversion factors
+	busVoltageConversion   = 1.25 / 1000.0 // 1.25 mV/bit
+	shuntVoltageConversion = 2.5e-6        // 2.5 uV/bit
+	shuntVoltageFullScale  = 0.08192       // +-81.92 mV
+
+	// Calibration constants from the datasheet (section 7.5)
+	calibrationScale    = 0.00512 // internal fixed value used to ensure scaling is maintained
+	currentLSBDivisor   = 32768.0 // 2^15, the current register is a signed 16-bit value
+	powerLSBFactor      = 25.0    // the power LSB is fixed at 25 times the current LSB
+	maxCalibrationValue = 0x7FFF  // bit 15 of the calibration register is reserved
+)
+
+// The calibration of the INA226, derived from the shunt resistor and the maximum current that is expected to flow through it
+type Calibration struct {
+	ShuntOhms      float64
+	MaxCurrentAmps float64
+	CurrentLSB     float64 // amps/bit
+	PowerLSB       float64 // watts/bit
+	Register       uint16  // value to write to the calibration register
+}
+
+// Computes the calibration for the given shunt resistor and maximum expected current, as described in the datasheet
+func NewCalibration(shuntOhms float64, maxCurrentAmps float64) (Calibration, error) {
+	if shuntOhms <= 0 {
+		return Calibration{}, fmt.Errorf("shunt resistance must be positive, got %v ohm", shuntOhms)
+	}
+	if maxCurrentAmps <= 0 {
+		return Calibration{}, fmt.Errorf("maximum current must be positive, got %v A", maxCurrentAmps)
+	}
+
+	currentLSB := maxCurrentAmps / currentLSBDivisor
+	register := calibrationScale / (currentLSB * shuntOhms)
+	if register < 1 || register > maxCalibrationValue {
+		return Calibration{}, fmt.Errorf("calibration value %.0f for %v ohm and %v A does not fit the calibration register", register, shuntOhms, maxCurrentAmps)
+	}
+
+	return Calibration{
+		ShuntOhms:      shuntOhms,
+		MaxCurrentAmps: maxCurrentAmps,
+		CurrentLSB:     currentLSB,
+		PowerLSB:       powerLSBFactor * currentLSB,
+		Register:       uint16(register),
+	}, nil
+}
+
+// Selects where the reported power comes from
+type PowerSource string
+
+const (
+	// The chip's power register, which is computed in hardware from the same conversion as the current,
+	// but only correct if the calibration register matches the shunt
+	PowerFromRegister PowerSource = "register"
+	// Bus voltage times current, computed in software from two register reads, so the two values may
+	// come from slightly different moments during fast transients
+	PowerComputed PowerSource = "computed"
+)
+
+// Where the current is computed from
+type CurrentMode string
+
+const (
+	// The chip's current register, which the chip scales with the calibration register
+	CurrentFromRegister CurrentMode = "register"
+	// The shunt voltage register divided by the shunt resistance, computed in software so that it does not depend
+	// on the calibration register at all
+	CurrentFromShunt CurrentMode = "shunt"
+)
+
+// Which side of the load the shunt is on, which determines the sign of the current (see SetShuntPlacement)
+type ShuntPlacement string
+
+const (
+	// Between the positive terminal of the source and the load, the current flows from IN+ to IN-
+	ShuntHighSide ShuntPlacement = "high"
+	// Between the load and the negative terminal of the source (ground), the current flows from IN- to IN+
+	ShuntLowSide ShuntPlacement = "low"
+)
+
+// Options for setting up an INA226
+type INA226Options struct {
+	Calibration Calibration
+	// Number of times a failed ID check is retried before giving up, since it can fail transiently on a noisy bus
+	IDRetries int
+	// Do not write the configuration and calibration registers, because another controller owns them.
+	// The LSB values of Calibration are still used to convert the readings, so they must match that controller's setup.
+	SkipInit bool
+	// Do not verify the manufacturer and die ID
+	SkipIDCheck bool
+	// Read back the configuration and mask/enable registers after writing them in the setup, and the calibration
+	// register after every write (also the range switches of Calibrate)
+	VerifyWrites bool
+	// How long the first read after a calibration write waits for a conversion with the new calibration,
+	// negative to wait for one conversion period
+	CalibrationSettleTime time.Duration
+	// Number of times the presence probe at startup is retried while the device does not acknowledge (NACK),
+	// e.g. because it is still powering up, and the delay between the probes
+	PresenceRetries    int
+	PresenceRetryDelay time.Duration
+	// How long the bus may stay busy before it is recovered and reopened, 0 disables recovery
+	BusBusyTimeout time.Duration
+	// Reopens the bus during bus recovery, optional
+	Reopen func() (i2c.BusCloser, error)
+	// Reads the registers with SMBus block reads instead of raw transactions, optional. Closed with the sensor.
+	SMBus *smbusDevice
+	// The byte order of the register values on the bus, nil for big-endian (the chip's own order). Little-endian
+	// handles adapters that swap the bytes.
+	ByteOrder binary.ByteOrder
+	// The I2C address of the sensor, 0 for the default ina226Address
+	Address uint16
+}
+
+// Returned by CheckID when the device responded, but with an ID that does not belong to an INA226
+type IDMismatchError struct {
+	Addr  uint16
+	Manuf uint16
+	Die   uint16
+}
+
+func (e *IDMismatchError) Error() string {
+	return fmt.Sprintf("device at address 0x%02x is not an INA226 (manufacturer ID 0x%04x, die ID 0x%04x)", e.Addr, e.Manuf, e.Die)
+}
+
+// Returned by the setup when a register does not read back what was written, e.g. because a bus glitch
+// corrupted or dropped the write
+type WriteVerifyError struct {
+	Reg     uint8
+	Written uint16
+	Read    uint16
+}
+
+func (e *WriteVerifyError) Error() string {
+	return fmt.Sprintf("register 0x%02x holds 0x%04x after writing 0x%04x", e.Reg, e.Read, e.Written)
+}
+
+// Delay between attempts of the ID check
+const idRetryDelay = 10 * time.Millisecond
+
+type INA226 struct {
+	bus         i2c.BusCloser
+	dev         i2c.Dev
+	cal         Calibration
+	idRetries   int
+	skipInit    bool
+	skipIDCheck bool
+	// Whether the setup reads back the configuration and mask/enable writes
+	verifyWrites bool
+	// The revision in the die ID register, known after a successful ID check
+	dieRevision     uint8
+	haveDieRevision bool
+	powerSource     PowerSource
+	// Subtracted from every current reading, determined by ZeroCalibrate
+	currentOffset float64
+	// A low-side shunt negates the current and shunt voltage readings
+	shuntPlacement ShuntPlacement
+	// Linear correction of the bus voltage from a two-point calibration against reference voltages
+	busGain   float64
+	busOffset float64
+	// Ratio of an external resistive divider in front of the bus voltage input, see SetBusVoltageDivider
+	busDivider float64
+	// The resistance of the shunt that is actually fitted when it differs from the calibration, 0 when it does not
+	actualShuntOhms float64
+	currentMode     CurrentMode
+	// The bus voltage is only read every voltageDivisor samples, the last reading is reused in between
+	voltageDivisor int
+	voltageSkipped int
+	lastVoltage    float64
+	lastRawVoltage uint16
+	haveVoltage    bool
+	// Whether the samples carry the register values they were computed from, see SetIncludeRaw. The samples of
+	// the read loop point at raw, so that reading a sample does not allocate.
+	includeRaw bool
+	raw        RawRegisters
+	// The registers that are read for every sample
+	plan ReadPlan
+	// After a calibration write, the first read waits until settleUntil and its current reading is discarded,
+	// since the current and power registers only reflect the new calibration after the next conversion.
+	// A negative settleTime waits for one conversion period.
+	settleTime         time.Duration
+	settleUntil        time.Time
+	calibrationPending bool
+	// The alert configuration of the mask/enable register, (re)applied on every setup
+	maskEnable uint16
+	// An alert flag that was cleared by reading the conversion ready flag, but not reported by AlertFlag yet
+	alertPending bool
+	// Set while a latched alert is left for an external controller to clear, the mask/enable register is not
+	// read then, since that would clear the latch (see KeepAlertLatched)
+	keepAlertLatched atomic.Bool
+	// Bus error handling (see i2cbus.go)
+	busBusyTimeout time.Duration
+	// Since when the transactions fail because the bus is busy, across transactions, zero while it is not.
+	// Guarded by lock.
+	busySince time.Time
+	reopen    func() (i2c.BusCloser, error)
+	// Register reads go through SMBus when set, writes always use raw transactions
+	smbus               *smbusDevice
+	byteOrder           binary.ByteOrder
+	arbitrationErrors   atomic.Uint64
+	busBusyErrors       atomic.Uint64
+	busReopens          atomic.Uint64
+	writeVerifyFailures atomic.Uint64
+	// Invoked with every successfully read sample, see OnSample
+	callbacks sampleCallbacks
+	// The register reads of the sample in progress, only recorded while raw callbacks are registered
+	recordReads bool
+	rawReads    []RawRead
+	// Serializes register access, since a read consists of two transactions (set the pointer, then read)
+	// that must not be interleaved with access from other goroutines (e.g. the debug endpoints)
+	lock sync.Mutex
+	// Serializes whole samples between the read loop and on-demand reads, which consist of several register reads
+	sampleLock sync.Mutex
+	// Transaction buffers, reused under the lock so that reading a sample does not allocate
+	writeBuf [3]byte
+	readBuf  [4]byte
+}
+
+func NewINA226(bus i2c.BusCloser, opts INA226Options) (*INA226, error) {
+	address := opts.Address
+	if address == 0 {
+		address = ina226Address
+	}
+	ina := &INA226{
+		bus:            bus,
+		dev:            i2c.Dev{Bus: bus, Addr: address},
+		idRetries:      opts.IDRetries,
+		skipInit:       opts.SkipInit,
+		skipIDCheck:    opts.SkipIDCheck,
+		verifyWrites:   opts.VerifyWrites,
+		powerSource:    PowerFromRegister,
+		currentMode:    CurrentFromRegister,
+		shuntPlacement: ShuntHighSide,
+		busGain:        1,
+		busDivider:     1,
+
+		voltageDivisor: 1,
+		settleTime:     opts.CalibrationSettleTime,
+		plan:           ReadPlan{BusVoltage: true, Power: true},
+		busBusyTimeout: opts.BusBusyTimeout,
+		reopen:         opts.Reopen,
+		smbus:          opts.SMBus,
+		byteOrder:      opts.ByteOrder,
+	}
+	if ina.byteOrder == nil {
+		ina.byteOrder = binary.BigEndian
+	}
+
+	if err := ina.waitForPresence(opts.PresenceRetries, opts.PresenceRetryDelay); err != nil {
+		return nil, err
+	}
+	if err := ina.setup(opts.Calibration); err != nil {
+		return nil, err
+	}
+	return ina, nil
+}
+
+// Probes the address until the device acknowledges. Only NACKs are retried, a device that powers up at the same
+// time as the service does not acknowledge until its power-on reset is released. Other errors are left to
+// the ID check, which has its own retries.
+func (ina *INA226) waitForPresence(retries int, delay time.Duration) error {
+	for attempt := 0; ; attempt++ {
+		_, err := ina.readRegister(manufIDReg)
+		if err == nil || classifyBusError(err) != busErrorNACK {
+			return nil
+		}
+		if attempt >= retries {
+			return fmt.Errorf("no device acknowledged at address 0x%02x after %d probes: %v", ina.dev.Addr, attempt+1, err)
+		}
+		time.Sleep(delay)
+	}
+}
+
+// Verifies that the device is an INA226 and (re)writes the configuration and calibration (unless skipped)
+func (ina *INA226) setup(cal Calibration) error {
+	if !ina.skipIDCheck {
+		if err := ina.CheckID(); err != nil {
+			return err
+		}
+	}
+
+	// Another controller configures the device, we only read it
+	if ina.skipInit {
+		ina.cal = cal
+		return nil
+	}
+
+	// Initialize device
+	if err := ina.initialize(); err != nil {
+		return fmt.Errorf("failed to initialize INA226: %w", err)
+	}
+	if err := ina.calibrate(cal); err != nil {
+		return fmt.Errorf("failed to calibrate INA226: %w", err)
+	}
+	if ina.maskEnable != 0 {
+		write := ina.writeRegister
+		// Reading the register back would clear a latched alert that is left for the external controller
+		if ina.verifyWrites && !ina.keepAlertLatched.Load() {
+			write = func(reg uint8, value uint16) error {
+				return ina.writeRegisterVerified(reg, value, maskEnableWritableBits)
+			}
+		}
+		if err := write(maskEnableReg, ina.maskEnable); err != nil {
+			return fmt.Errorf("failed to configure the alert: %w", err)
+		}
+	}
+	return nil
+}
+
+// Re-runs the full setup with the current calibration, e.g. after the sensor board was swapped
+func (ina *INA226) Reinitialize() error {
+	ina.sampleLock.Lock()
+	defer ina.sampleLock.Unlock()
+
+	// The last bus voltage may belong to the previous board
+	ina.haveVoltage = false
+	return ina.setup(ina.cal)
+}
+
+// Verifies that the device at the address is actually an INA226 by reading its manufacturer and die ID.
+// Both failed reads and mismatching IDs are retried, since bus noise can cause either. If the device keeps
+// responding with the wrong ID, an *IDMismatchError is returned, otherwise the last read error.
+func (ina *INA226) CheckID() error {
+	var err error
+	for attempt := 0; attempt <= ina.idRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(idRetryDelay)
+		}
+		if err = ina.checkIDOnce(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (ina *INA226) checkIDOnce() error {
+	manuf, err := ina.readRegister(manufIDReg)
+	if err != nil {
+		return fmt.Errorf("failed to read manufacturer ID: %v", err)
+	}
+	die, err := ina.readRegister(dieIDReg)
+	if err != nil {
+		return fmt.Errorf("failed to read die ID: %v", err)
+	}
+	if manuf != manufID || die>>4 != dieID {
+		return &IDMismatchError{Addr: ina.dev.Addr, Manuf: manuf, Die: die}
+	}
+	ina.dieRevision = uint8(die & 0xF)
+	ina.haveDieRevision = true
+	return nil
+}
+
+// Returns the die revision of the chip, which is only known when the ID was checked (see verify-id)
+func (ina *INA226) DieRevision() (uint8, bool) {
+	return ina.dieRevision, ina.haveDieRevision
+}
+
+func (ina *INA226) initialize() error {
+	// Set configuration register
+	if ina.verifyWrites {
+		return ina.writeRegisterVerified(configReg, configValue, configWritableBits)
+	}
+	return ina.writeRegister(configReg, configValue)
+}
+
+// Writes the calibration register and uses the matching LSB values for all subsequent reads. Serialized with
+// the samples, so that an on-demand read never converts with the LSB of another calibration.
+func (ina *INA226) Calibrate(cal Calibration) error {
+	ina.sampleLock.Lock()
+	defer ina.sampleLock.Unlock()
+	return ina.calibrate(cal)
+}
+
+// Like Calibrate, for callers that hold the sample lock
+func (ina *INA226) calibrate(cal Calibration) error {
+	write := ina.writeRegister
+	if ina.verifyWrites {
+		write = func(reg uint8, value uint16) error {
+			return ina.writeRegisterVerified(reg, value, calibrationWritableBits)
+		}
+	}
+	if err := write(calibrationReg, cal.Register); err != nil {
+		return err
+	}
+	ina.cal = cal
+
+	settle := ina.settleTime
+	if settle < 0 {
+		var err error
+		if settle, err = ina.ConversionPeriod(); err != nil {
+			settle = decodeConfig(configValue).conversionPeriod()
+		}
+	}
+	ina.settleUntil = time.Now().Add(settle)
+	ina.calibrationPending = true
+	return nil
+}
+
+// Waits for a conversion with the new calibration and discards the current reading that may still stem from
+// the old one, if the calibration was written since the last read
+func (ina *INA226) settleCalibration() error {
+	if !ina.calibrationPending {
+		return nil
+	}
+	time.Sleep(time.Until(ina.settleUntil))
+	if _, err := ina.ReadCurrent(); err != nil {
+		return fmt.Errorf("failed to read the first current after calibration: %v", err)
+	}
+	ina.calibrationPending = false
+	return nil
+}
+
+// Selects where the current is computed from. With CurrentFromShunt, the power must be computed as well
+// (PowerComputed), since the power register depends on the calibration.
+func (ina *INA226) SetCurrentMode(mode CurrentMode) {
+	ina.currentMode = mode
+}
+
+// The register that the current is computed from, see SetCurrentMode
+func (ina *INA226) currentSourceReg() uint8 {
+	if ina.currentMode == CurrentFromShunt {
+		return shuntVoltReg
+	}
+	return currentReg
+}
+
+// Sets the placement of the shunt. IN+ is expected to be connected to the terminal of the source in both
+// placements, so the current drawn from the source is positive on the high side, and negative on the low side
+// unless it is inverted, which this does for ShuntLowSide. The offset of the current (see ZeroCalibrate) is in
+// terms of the inverted readings.
+func (ina *INA226) SetShuntPlacement(placement ShuntPlacement) {
+	ina.shuntPlacement = placement
+}
+
+// The sign that the current and shunt voltage readings are multiplied with, see SetShuntPlacement
+func (ina *INA226) currentSign() float64 {
+	if ina.shuntPlacement == ShuntLowSide {
+		return -1
+	}
+	return 1
+}
+
+// Selects where ReadSensorData takes the reported power from
+func (ina *INA226) SetPowerSource(source PowerSource) {
+	ina.powerSource = source
+}
+
+// Closes the bus that the sensor is on
+func (ina *INA226) Close() error {
+	if ina.smbus != nil {
+		ina.smbus.Close()
+	}
+	return ina.bus.Close()
+}
+
+// Returns the calibration that is currently in use
+func (ina *INA226) Calibration() Calibration {
+	return ina.cal
+}
+
+func (ina *INA226) writeRegister(reg uint8, value uint16) error {
+	ina.lock.Lock()
+	defer ina.lock.Unlock()
+
+	ina.writeBuf[0] = reg
+	ina.byteOrder.PutUint16(ina.writeBuf[1:], value)
+	return ina.tx(ina.writeBuf[:], nil)
+}
+
+// Writes the register and reads it back, returning a *WriteVerifyError when the bits that can be written (the
+// mask) do not hold the value. For the registers whose writable bits read back what was written.
+func (ina *INA226) writeRegisterVerified(reg uint8, value uint16, mask uint16) error {
+	if err := ina.writeRegister(reg, value); err != nil {
+		return err
+	}
+	read, err := ina.readRegister(reg)
+	if err != nil {
+		return fmt.Errorf("failed to read back register 0x%02x: %v", reg, err)
+	}
+	if read&mask != value&mask {
+		ina.writeVerifyFailures.Add(1)
+		return &WriteVerifyError{Reg: reg, Written: value, Read: read}
+	}
+	return nil
+}
+
+// Number of verified register writes (of the setup and the calibration) that did not read back the written value
+func (ina *INA226) WriteVerifyFailures() uint64 {
+	return ina.writeVerifyFailures.Load()
+}
+
+func (ina *INA226) readRegister(reg uint8) (uint16, error) {
+	ina.lock.Lock()
+	defer ina.lock.Unlock()
+
+	if ina.smbus != nil {
+		var value uint16
+		err := ina.retryBus(func() (err error) {
+			value, err = ina.smbus.readRegister(reg, ina.byteOrder)
+			return err
+		})
+		return value, err
+	}
+
+	// Write the register address and read the value (2 bytes) in one combined transaction with a repeated start,
+	// so that another master on the bus cannot move the register pointer in between, also not between retries.
+	// A transfer that ends early is reported as an error by the bus, as a *ShortReadError by the i2c-dev and
+	// SMBus reads that know the count. periph's Tx does not report a byte count, so there it relies on the
+	// adapter. The buffer is zeroed first, so it never holds data from a previous read.
+	ina.writeBuf[0] = reg
+	data := ina.readBuf[:2]
+	clear(data)
+	if err := ina.tx(ina.writeBuf[:1], data); err != nil {
+		return 0, err
+	}
+
+	// Convert from big-endian
+	return ina.byteOrder.Uint16(data), nil
+}
+
+// Reads any register without interpretation, for low-level debugging
+func (ina *INA226) ReadRegisterRaw(reg uint8) (uint16, error) {
+	if reg == maskEnableReg && ina.keepAlertLatched.Load() {
+		return 0, errAlertLatchKept
+	}
+	return ina.readRegister(reg)
+}
+
+// Writes any register without validation, for low-level debugging. Writing the configuration or calibration
+// register this way is not reflected in the LSB values used to convert the readings.
+func (ina *INA226) WriteRegisterRaw(reg uint8, value uint16) error {
+	return ina.writeRegister(reg, value)
+}
+
+// Adds the register values that every sample was computed from to the sample (for validation against a
+// reference meter), so that a different calibration can be applied to recorded data afterwards
+func (ina *INA226) SetIncludeRaw(include bool) {
+	ina.includeRaw = include
+}
+
+func (ina *INA226) ReadBusVoltage() (float64, error) {
+	raw, err := ina.readRegister(busVoltReg)
+	if err != nil {
+		return 0, err
+	}
+	return ina.busVoltageFromRaw(raw), nil
+}
+
+func (ina *INA226) busVoltageFromRaw(raw uint16) float64 {
+	return float64(raw)*busVoltageConversion*ina.busDivider*ina.busGain + ina.busOffset
+}
+
+// Sets the ratio of an external resistive divider in front of the bus voltage input (rail voltage / input voltage),
+// to monitor rails above the 40.96 V full scale of the bus channel. The bus voltage and the power register readings
+// are scaled by it, since the chip computes the power from the divided voltage.
+func (ina *INA226) SetBusVoltageDivider(ratio float64) {
+	ina.busDivider = ratio
+}
+
+// Sets the resistance of the shunt that is actually fitted, when it differs from the shunt the calibration was
+// computed for (e.g. to reuse a calibration across slightly different shunts). The chip scales the current and
+// power registers by the calibrated resistance, so both are off by calibrated / actual, which is corrected in
+// the conversion of the readings. The calibration register itself is left as is.
+func (ina *INA226) SetActualShuntOhms(ohms float64) {
+	ina.actualShuntOhms = ohms
+}
+
+// The factor by which the current and power registers are scaled to the fitted shunt, see SetActualShuntOhms
+func (ina *INA226) shuntRatio() float64 {
+	if ina.actualShuntOhms == 0 {
+		return 1
+	}
+	return ina.cal.ShuntOhms / ina.actualShuntOhms
+}
+
+// The calibration in terms of the fitted shunt: the resistance, maximum current and LSBs of the converted
+// readings. Equal to Calibration when the fitted shunt is the calibrated one.
+func (ina *INA226) EffectiveCalibration() Calibration {
+	cal := ina.cal
+	ratio := ina.shuntRatio()
+	if ina.actualShuntOhms != 0 {
+		cal.ShuntOhms = ina.actualShuntOhms
+	}
+	cal.MaxCurrentAmps *= ratio
+	cal.CurrentLSB *= ratio
+	cal.PowerLSB *= ratio
+	if ina.currentMode == CurrentFromShunt {
+		// The range is that of the shunt voltage ADC
+		cal.CurrentLSB = shuntVoltageConversion / cal.ShuntOhms
+		cal.MaxCurrentAmps = shuntVoltageFullScale / cal.ShuntOhms
+	}
+	return cal
+}
+
+// Sets the linear correction that is applied to every bus voltage reading (corrected = gain * measured + offset).
+// The coefficients are fitted from the uncorrected readings at two known reference voltages.
+func (ina *INA226) SetBusCorrection(gain float64, offset float64) {
+	ina.busGain = gain
+	ina.busOffset = offset
+}
+
+// Only reads the bus voltage once every divisor calls of ReadSensorData(Into), reusing the last reading in between.
+// The bus voltage changes much slower than the current, so this saves bus traffic at high sample rates.
+func (ina *INA226) SetVoltageSampleDivisor(divisor int) {
+	ina.voltageDivisor = max(divisor, 1)
+}
+
+// Whether the bus voltage must be read for this sample, or the last reading can be reused (see SetVoltageSampleDivisor)
+func (ina *INA226) voltageDue() bool {
+	return !ina.haveVoltage || ina.voltageSkipped+1 >= ina.voltageDivisor
+}
+
+// Reads the voltage across the shunt resistor, which is measured independently of the calibration
+func (ina *INA226) ReadShuntVoltage() (float64, error) {
+	raw, err := ina.readRegister(shuntVoltReg)
+	if err != nil {
+		return 0, err
+	}
+	return shuntVoltageFromRaw(raw), nil
+}
+
+func shuntVoltageFromRaw(raw uint16) float64 {
+	// Signed (two's complement), like the current
+	return float64(int16(raw)) * shuntVoltageConversion
+}
+
+func (ina *INA226) ReadCurrent() (float64, error) {
+	raw, err := ina.readRegister(ina.currentSourceReg())
+	if err != nil {
+		return 0, err
+	}
+	return ina.currentFromRaw(raw), nil
+}
+
+// Converts the value of the current source register (see currentSourceReg)
+func (ina *INA226) currentFromRaw(raw uint16) float64 {
+	// Check if value is negative (two's complement)
+	value := int16(raw)
+	return float64(value)*ina.currentLSB()*ina.currentSign() - ina.currentOffset
+}
+
+// The current per bit of the current source register, in terms of the fitted shunt
+func (ina *INA226) currentLSB() float64 {
+	if ina.currentMode == CurrentFromShunt {
+		return shuntVoltageConversion / ina.EffectiveCalibration().ShuntOhms
+	}
+	return ina.cal.CurrentLSB * ina.shuntRatio()
+}
+
+// Reads the current and the bus voltage back-to-back, to minimize the time between them for an accurate V x I
+// during fast transients. Each register is read with a single combined transaction (the register pointer write
+// and the read with a repeated start), and no other register access can come in between. Also returns the time
+// between the completion of both reads, the residual skew that consumers can account for. Note that the chip
+// itself converts the shunt and bus voltage one after the other, so their conversions are a conversion time apart.
+func (ina *INA226) ReadCurrentAndBusVoltage() (current float64, voltage float64, skew time.Duration, err error) {
+	rawCurrent, rawVoltage, skew, err := ina.readCurrentAndBusVoltageRaw()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return ina.currentFromRaw(rawCurrent), ina.busVoltageFromRaw(rawVoltage), skew, nil
+}
+
+// Like ReadCurrentAndBusVoltage, but returns the register values, the current as the current source register
+func (ina *INA226) readCurrentAndBusVoltageRaw() (current uint16, voltage uint16, skew time.Duration, err error) {
+	ina.lock.Lock()
+	defer ina.lock.Unlock()
+
+	if ina.smbus != nil {
+		err = ina.retryBus(func() (err error) {
+			current, err = ina.smbus.readRegister(ina.currentSourceReg(), ina.byteOrder)
+			return err
+		})
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("failed to read current: %v", err)
+		}
+		currentRead := time.Now()
+		err = ina.retryBus(func() (err error) {
+			voltage, err = ina.smbus.readRegister(busVoltReg, ina.byteOrder)
+			return err
+		})
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("failed to read bus voltage: %v", err)
+		}
+		return current, voltage, time.Since(currentRead), nil
+	}
+
+	data := ina.readBuf[:]
+	clear(data)
+	ina.writeBuf[0] = ina.currentSourceReg()
+	if err := ina.tx(ina.writeBuf[:1], data[0:2]); err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to read current: %v", err)
+	}
+	currentRead := time.Now()
+	ina.writeBuf[0] = busVoltReg
+	if err := ina.tx(ina.writeBuf[:1], data[2:4]); err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to read bus voltage: %v", err)
+	}
+	skew = time.Since(currentRead)
+
+	return ina.byteOrder.Uint16(data[0:2]), ina.byteOrder.Uint16(data[2:4]), skew, nil
+}
+
+// Measures the current offset of the shunt and amplifier by averaging the given number of current readings,
+// and subtracts it from all subsequent readings. This assumes that truly no current flows while it runs.
+func (ina *INA226) ZeroCalibrate(samples int, interval time.Duration) (float64, error) {
+	if samples < 1 {
+		return 0, fmt.Errorf("at least one sample is needed to determine the offset")
+	}
+	ina.sampleLock.Lock()
+	defer ina.sampleLock.Unlock()
+
+	if err := ina.settleCalibration(); err != nil {
+		return 0, err
+	}
+	ina.currentOffset = 0
+	sum := 0.0
+	for i := 0; i < samples; i++ {
+		current, err := ina.ReadCurrent()
+		if err != nil {
+			return 0, fmt.Errorf("failed to read current: %v", err)
+		}
+		sum += current
+		time.Sleep(interval)
+	}
+
+	ina.currentOffset = sum / float64(samples)
+	return ina.currentOffset, nil
+}
+
+// Returns the offset that is subtracted from every current reading
+func (ina *INA226) CurrentOffset() float64 {
+	return ina.currentOffset
+}
+
+// Sets the offset that is subtracted from every current reading, when it is known from a previous measurement
+// (e.g. the factory test of the board) instead of measured with ZeroCalibrate
+func (ina *INA226) SetCurrentOffset(offset float64) {
+	ina.currentOffset = offset
+}
+
+func (ina *INA226) ReadPower() (float64, error) {
+	raw, err := ina.readRegister(powerReg)
+	if err != nil {
+		return 0, err
+	}
+	return ina.powerFromRaw(raw), nil
+}
+
+func (ina *INA226) powerFromRaw(raw uint16) float64 {
+	return float64(raw) * ina.cal.PowerLSB * ina.busDivider * ina.shuntRatio()
+}
+
+// The power register only holds the magnitude, so during regeneration (negative current) it
+// cannot be distinguished from power that is drawn. This applies the sign of the current to it.
+func (ina *INA226) SignedPower() (float64, error) {
+	current, err := ina.ReadCurrent()
+	if err != nil {
+		return 0, err
+	}
+	power, err := ina.ReadPower()
+	if err != nil {
+		return 0, err
+	}
+	return signedPower(power, current), nil
+}
+
+func signedPower(power float64, current float64) float64 {
+	return math.Copysign(power, current)
+}
+
+type CurrentSensorOutput struct {
+	Timestamp     time.Time `json:"timestamp"`
+	SupplyVoltage float64   `json:"supplyVoltage"`
+	CurrentAmps   float64   `json:"currentAmps"`
+	PowerWatts    float64   `json:"powerWatts"`
+	// Negative while power is returned to the supply (e.g. regenerative braking)
+	SignedPowerWatts float64 `json:"signedPowerWatts"`
+	// Only read when requested in the field-mask
+	ShuntVoltage float64 `json:"shuntVoltage"`
+	// Time between reading the current and the bus voltage, 0 when the last bus voltage was reused
+	SkewMicros float64 `json:"skewMicros"`
+	// Cumulative values since the service started, filled in by the energy accumulator
+	EnergyWh float64 `json:"energyWh"`
+	ChargeAh float64 `json:"chargeAh"`
+	// The cumulative values in the configured energy-unit and charge-unit
+	Energy     float64 `json:"energy"`
+	EnergyUnit string  `json:"energyUnit"`
+	Charge     float64 `json:"charge"`
+	ChargeUnit string  `json:"chargeUnit"`
+	// Mean signed power over the power-trend-seconds window (a minute by default), updated every second
+	AvgPowerWattsLastMinute float64 `json:"avgPowerWattsLastMinute"`
+	// Set while the bus voltage is below low-battery-volts or critical-battery-volts
+	LowBattery      bool `json:"lowBattery"`
+	CriticalBattery bool `json:"criticalBattery"`
+	// Estimated runtime left on the battery, nil when unknown (no battery-capacity-wh, or idle or charging)
+	RemainingRuntimeMinutes *float64 `json:"remainingRuntimeMinutes"`
+	// Uncertainty band of the remaining runtime (one standard deviation), the upper bound is nil when unbounded
+	RemainingRuntimeMinutesLow  *float64 `json:"remainingRuntimeMinutesLow,omitempty"`
+	RemainingRuntimeMinutesHigh *float64 `json:"remainingRuntimeMinutesHigh,omitempty"`
+	// State of charge of the battery in percent, blending coulomb counting with open-circuit voltage measurements,
+	// and from the last open-circuit voltage measurement alone. Only set with ocv-table, after the first measurement.
+	StateOfChargePercent    *float64 `json:"stateOfChargePercent,omitempty"`
+	OCVStateOfChargePercent *float64 `json:"ocvStateOfChargePercent,omitempty"`
+	// The remaining charge in Ah and where the state of charge comes from ("software" or the fuel-gauge chip),
+	// only set with fuel-gauge
+	RemainingChargeAh *float64 `json:"remainingChargeAh,omitempty"`
+	ChargeSource      string   `json:"chargeSource,omitempty"`
+	// The power of the input rail at the time of the sample and the efficiency from it to this rail, only set
+	// with efficiency-input-socket. The efficiency is nil while the input power is too low or the power flows back.
+	InputPowerWatts   *float64 `json:"inputPowerWatts,omitempty"`
+	EfficiencyPercent *float64 `json:"efficiencyPercent,omitempty"`
+	// The fields that are meaningful for this sensor, the others are zeroed
+	ValidFields FieldMask `json:"validFields"`
+	// The resolution of the current reading, which changes with the calibration range
+	CurrentLSB float64 `json:"currentLSB"`
+	// The active calibration range ("low" or "high") when auto-ranging, empty otherwise
+	Range string `json:"range,omitempty"`
+	// Nanoseconds on the monotonic clock since the service started, for precise ordering regardless of
+	// wall clock steps. Only set with monotonic-timestamps.
+	MonotonicNanos int64 `json:"monotonicNanos,omitempty"`
+	// The codes of the active faults (e.g. "read-failed" or "undervoltage")
+	Faults []string `json:"faults,omitempty"`
+	// Why the sample was published with event-mode (e.g. "overcurrent" or "heartbeat")
+	Trigger string `json:"trigger,omitempty"`
+	// Set on the samples that fill the gap of a failed read (see gap-fill), which hold the last good values or
+	// no valid measurements at all
+	Stale bool `json:"stale,omitempty"`
+	// External event marker (e.g. "start maneuver"), set through PUT /tag for the next tag-samples samples
+	Tag string `json:"tag,omitempty"`
+	// The register values the sample was computed from, see include-raw. For the samples of the read loop it
+	// points at a buffer of the sensor that the next sample overwrites, copy it to keep it (the sample callbacks
+	// get a copy). The other pointer fields likewise point into the estimators.
+	Raw *RawRegisters `json:"raw,omitempty"`
+}
+
+// The register values as returned by the chip, before any conversion or correction. The current and shunt
+// voltage registers are two's complement. Registers that are not in the read plan are zero, and so is the
+// current register when the current is computed from the shunt voltage.
+type RawRegisters struct {
+	Current      uint16 `json:"current"`
+	BusVoltage   uint16 `json:"busVoltage"`
+	Power        uint16 `json:"power"`
+	ShuntVoltage uint16 `json:"shuntVoltage"`
+	// The value that was written to the calibration register, which determines the current and power LSB
+	Calibration uint16 `json:"calibration"`
+}
+
+// The quantities that ReadSensorData(Into) reads, so that no bus traffic is spent on quantities that are
+// not used. The current is always read, since the sign of the power and the cumulative charge depend on it.
+type ReadPlan struct {
+	BusVoltage   bool
+	Power        bool
+	ShuntVoltage bool
+}
+
+// Builds the read plan for the fields that the output needs. Computing the power needs the bus voltage,
+// even when the voltage itself is not needed.
+func NewReadPlan(fields FieldMask, source PowerSource) ReadPlan {
+	return ReadPlan{
+		BusVoltage:   fields.Has(FieldVoltage) || (fields.Has(FieldPower) && source == PowerComputed),
+		Power:        fields.Has(FieldPower),
+		ShuntVoltage: fields.Has(FieldShuntVoltage),
+	}
+}
+
+func (ina *INA226) SetReadPlan(plan ReadPlan) {
+	ina.plan = plan
+}
+
+func (ina *INA226) ReadSensorData() (*CurrentSensorOutput, error) {
+	out := &CurrentSensorOutput{}
+	if err := ina.ReadSensorDataInto(out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Like ReadSensorData, but fills a caller-owned struct, so that it can be reused at high sample rates
+// without allocating. All fields of out are overwritten, out is left untouched when an error is returned.
+// Only the registers of the read plan are read, the other quantities are zero.
+func (ina *INA226) ReadSensorDataInto(out *CurrentSensorOutput) error {
+	ina.sampleLock.Lock()
+	defer ina.sampleLock.Unlock()
+
+	ina.recordReads = ina.callbacks.wantRaw()
+	return ina.readSample(out, false)
+}
+
+// Reads a single fresh sample on demand (e.g. for test automation), in between the samples of the read loop.
+// The bus voltage is always read, and neither the voltage-sample-divisor cadence nor the recorded raw reads are affected.
+func (ina *INA226) ReadSensorDataNow() (*CurrentSensorOutput, error) {
+	ina.sampleLock.Lock()
+	defer ina.sampleLock.Unlock()
+
+	out := &CurrentSensorOutput{}
+	ina.recordReads = false
+	if err := ina.readSample(out, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Records a register read of the sample in progress for the raw callbacks. The bytes are encoded back in the
+// byte order of the bus, which reproduces the transferred bytes exactly.
+func (ina *INA226) recordRead(reg uint8, value uint16) {
+	if !ina.recordReads {
+		return
+	}
+	read := RawRead{Register: reg}
+	ina.byteOrder.PutUint16(read.Bytes[:], value)
+	ina.rawReads = append(ina.rawReads, read)
+}
+
+// Reads the registers of the read plan into out. A fresh read always reads the bus voltage, without updating
+// the state of the voltage-sample-divisor.
+func (ina *INA226) readSample(out *CurrentSensorOutput, fresh bool) error {
+	var voltage, current, power, shuntVoltage float64
+	var err error
+	valid := FieldCurrent
+
+	if err := ina.settleCalibration(); err != nil {
+		return err
+	}
+
+	raw := RawRegisters{Calibration: ina.cal.Register}
+	if !fresh {
+		// The reads of the last sample are kept for DispatchSample, an on-demand read in between leaves them
+		ina.rawReads = ina.rawReads[:0]
+	}
+	var rawCurrent uint16
+	var skew time.Duration
+	if ina.plan.BusVoltage && (fresh || ina.voltageDue()) {
+		// Read current and bus voltage as close together as possible
+		rawCurrent, raw.BusVoltage, skew, err = ina.readCurrentAndBusVoltageRaw()
+		if err != nil {
+			return err
+		}
+		ina.recordRead(ina.currentSourceReg(), rawCurrent)
+		ina.recordRead(busVoltReg, raw.BusVoltage)
+		voltage = ina.busVoltageFromRaw(raw.BusVoltage)
+		if !fresh {
+			ina.lastVoltage = voltage
+			ina.lastRawVoltage = raw.BusVoltage
+			ina.haveVoltage = true
+			ina.voltageSkipped = 0
+		}
+		valid |= FieldVoltage
+	} else {
+		// Reuse the last bus voltage when sampling the voltage at a lower rate
+		if ina.plan.BusVoltage {
+			voltage = ina.lastVoltage
+			raw.BusVoltage = ina.lastRawVoltage
+			ina.voltageSkipped++
+			valid |= FieldVoltage
+		}
+		rawCurrent, err = ina.readRegister(ina.currentSourceReg())
+		if err != nil {
+			return fmt.Errorf("failed to read current: %v", err)
+		}
+		ina.recordRead(ina.currentSourceReg(), rawCurrent)
+	}
+	current = ina.currentFromRaw(rawCurrent)
+	if ina.currentMode == CurrentFromShunt {
+		// The shunt voltage was read already
+		raw.ShuntVoltage = rawCurrent
+		shuntVoltage = shuntVoltageFromRaw(rawCurrent) * ina.currentSign()
+	} else {
+		raw.Current = rawCurrent
+	}
+
+	// Read power, or compute it from the voltage and current (the power register only holds the magnitude)
+	if ina.plan.Power {
+		if ina.powerSource == PowerComputed {
+			power = voltage * math.Abs(current)
+		} else {
+			raw.Power, err = ina.readRegister(powerReg)
+			if err != nil {
+				return fmt.Errorf("failed to read power: %v", err)
+			}
+			ina.recordRead(powerReg, raw.Power)
+			power = ina.powerFromRaw(raw.Power)
+		}
+		valid |= FieldPower
+	}
+
+	if ina.plan.ShuntVoltage {
+		if ina.currentMode != CurrentFromShunt {
+			raw.ShuntVoltage, err = ina.readRegister(shuntVoltReg)
+			if err != nil {
+				return fmt.Errorf("failed to read shunt voltage: %v", err)
+			}
+			ina.recordRead(shuntVoltReg, raw.ShuntVoltage)
+			shuntVoltage = shuntVoltageFromRaw(raw.ShuntVoltage) * ina.currentSign()
+		}
+		valid |= FieldShuntVoltage
+	}
+
+	*out = CurrentSensorOutput{
+		Timestamp:        time.Now(),
+		SupplyVoltage:    voltage,
+		CurrentAmps:      current,
+		PowerWatts:       power,
+		SignedPowerWatts: signedPower(power, current),
+		ShuntVoltage:     shuntVoltage,
+		ValidFields:      valid,
+		CurrentLSB:       ina.currentLSB(),
+		SkewMicros:       float64(skew) / float64(time.Microsecond),
+	}
+	if ina.includeRaw {
+		if fresh {
+			// On-demand samples are handed to another goroutine, they get their own copy
+			onDemand := raw
+			out.Raw = &onDemand
+		} else {
+			ina.raw = raw
+			out.Raw = &ina.raw
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+)
+
+func newBenchINA226(b testing.TB) (*INA226, *fakeBus) {
+	cal, err := NewCalibration(0.002, 10)
+	if err != nil {
+		b.Fatalf("NewCalibration: %v", err)
+	}
+	bus := newFakeBus()
+	bus.set(currentReg, 1000)
+	bus.set(busVoltReg, 9600)
+	bus.set(powerReg, 500)
+	return newFakeINA226(b, bus, cal), bus
+}
+
+// Keeps the samples of the benchmarks, like the read loop hands them on, so that they are not optimized away
+var benchSample *CurrentSensorOutput
+
+func BenchmarkReadSensorData(b *testing.B) {
+	ina, _ := newBenchINA226(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sample, err := ina.ReadSensorData()
+		if err != nil {
+			b.Fatal(err)
+		}
+		benchSample = sample
+	}
+}
+
+// Reuses one sample, compare the allocations per call with BenchmarkReadSensorData
+func BenchmarkReadSensorDataInto(b *testing.B) {
+	ina, _ := newBenchINA226(b)
+	out := &CurrentSensorOutput{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := ina.ReadSensorDataInto(out); err != nil {
+			b.Fatal(err)
+		}
+		benchSample = out
+	}
+}
+
+func BenchmarkReadRegister(b *testing.B) {
+	ina, _ := newBenchINA226(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ina.readRegister(currentReg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// The hot path must not allocate, the allocations per sample are what the benchmarks above report
+func TestReadPathAllocations(t *testing.T) {
+	ina, bus := newBenchINA226(t)
+	// The fake bus records the writes, which must not count as allocations of the driver
+	bus.writes = make([]fakeWrite, 0, 1024)
+	out := &CurrentSensorOutput{}
+	paths := []struct {
+		name string
+		read func() error
+	}{
+		{"readRegister", func() error {
+			_, err := ina.readRegister(currentReg)
+			return err
+		}},
+		{"writeRegister", func() error {
+			return ina.writeRegister(alertLimitReg, 0)
+		}},
+		{"ReadSensorDataInto", func() error {
+			return ina.ReadSensorDataInto(out)
+		}},
+	}
+	for _, p := range paths {
+		allocs := testing.AllocsPerRun(100, func() {
+			if err := p.read(); err != nil {
+				t.Fatalf("%s: %v", p.name, err)
+			}
+		})
+		if allocs != 0 {
+			t.Errorf("%s allocates %v times per call, want 0", p.name, allocs)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync"
+	"testing"
+
+	"periph.io/x/conn/v3/physic"
+)
+
+// A register write that reached the fake bus
+type fakeWrite struct {
+	reg   uint8
+	value uint16
+}
+
+// An INA226 on a fake I2C bus: it keeps a register file, follows the register pointer like the chip and records
+// the register writes. Values are transferred big-endian, like the chip does.
+type fakeBus struct {
+	lock    sync.Mutex
+	regs    map[uint8]uint16
+	pointer uint8
+	writes  []fakeWrite
+	// Returned by every transaction that reads, with the read buffer filled up to readBytes, e.g. to emulate a
+	// transfer that ends early. Ignored when nil.
+	readErr   error
+	readBytes int
+}
+
+// A fake bus with an INA226 (die revision 0) in its power-on state
+func newFakeBus() *fakeBus {
+	return &fakeBus{regs: map[uint8]uint16{
+		configReg:  0x4127,
+		manufIDReg: manufID,
+		dieIDReg:   dieID << 4,
+	}}
+}
+
+func (b *fakeBus) Tx(addr uint16, w, r []byte) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if len(w) > 0 {
+		b.pointer = w[0]
+	}
+	if len(w) == 3 {
+		value := binary.BigEndian.Uint16(w[1:])
+		b.regs[b.pointer] = value
+		b.writes = append(b.writes, fakeWrite{reg: b.pointer, value: value})
+	}
+	if len(r) > 0 {
+		var data [2]byte
+		binary.BigEndian.PutUint16(data[:], b.regs[b.pointer])
+		if b.readErr != nil {
+			copy(r[:min(b.readBytes, len(r))], data[:])
+			return b.readErr
+		}
+		copy(r, data[:])
+	}
+	return nil
+}
+
+func (b *fakeBus) SetSpeed(f physic.Frequency) error {
+	return nil
+}
+
+func (b *fakeBus) String() string {
+	return "fake"
+}
+
+func (b *fakeBus) Close() error {
+	return nil
+}
+
+func (b *fakeBus) set(reg uint8, value uint16) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.regs[reg] = value
+}
+
+// The values that were written to the register, in order
+func (b *fakeBus) writesTo(reg uint8) []uint16 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	values := []uint16{}
+	for _, w := range b.writes {
+		if w.reg == reg {
+			values = append(values, w.value)
+		}
+	}
+	return values
+}
+
+func newFakeINA226(t testing.TB, bus *fakeBus, cal Calibration) *INA226 {
+	t.Helper()
+	ina, err := NewINA226(bus, INA226Options{Calibration: cal})
+	if err != nil {
+		t.Fatalf("NewINA226: %v", err)
+	}
+	return ina
+}
+
+func TestCalibrationRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		shuntOhms float64
+		maxAmps   float64
+		register  uint16
+	}{
+		{"2 mOhm 10 A", 0.002, 10, 8388},
+		{"5 mOhm 5 A", 0.005, 5, 6710},
+		{"100 mOhm 0.5 A", 0.1, 0.5, 3355},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cal, err := NewCalibration(tt.shuntOhms, tt.maxAmps)
+			if err != nil {
+				t.Fatalf("NewCalibration: %v", err)
+			}
+			if cal.Register != tt.register {
+				t.Errorf("calibration register %d, want %d", cal.Register, tt.register)
+			}
+
+			// Written to the bus by the setup
+			bus := newFakeBus()
+			ina := newFakeINA226(t, bus, cal)
+			if writes := bus.writesTo(calibrationReg); len(writes) != 1 || writes[0] != tt.register {
+				t.Fatalf("calibration writes %v, want [%d]", writes, tt.register)
+			}
+
+			// And by Calibrate, e.g. on a range switch
+			bus.set(calibrationReg, 0)
+			if err := ina.Calibrate(cal); err != nil {
+				t.Fatalf("Calibrate: %v", err)
+			}
+			if writes := bus.writesTo(calibrationReg); len(writes) != 2 || writes[1] != tt.register {
+				t.Fatalf("calibration writes %v, want a second %d", writes, tt.register)
+			}
+
+			// The current register converts back to amps with the LSB of the calibration, full scale is the
+			// maximum current
+			bus.set(currentReg, math.MaxInt16)
+			current, err := ina.ReadCurrent()
+			if err != nil {
+				t.Fatalf("ReadCurrent: %v", err)
+			}
+			if math.Abs(current-tt.maxAmps) > cal.CurrentLSB {
+				t.Errorf("full scale current %v A, want %v A", current, tt.maxAmps)
+			}
+		})
+	}
+}
+
+func TestShortRead(t *testing.T) {
+	cal, err := NewCalibration(0.002, 10)
+	if err != nil {
+		t.Fatalf("NewCalibration: %v", err)
+	}
+	bus := newFakeBus()
+	ina := newFakeINA226(t, bus, cal)
+	bus.set(currentReg, 0x1234)
+
+	// The transfer ends after the first byte
+	bus.lock.Lock()
+	bus.readErr = &ShortReadError{Read: 1, Expected: 2}
+	bus.readBytes = 1
+	bus.lock.Unlock()
+
+	value, err := ina.readRegister(currentReg)
+	var short *ShortReadError
+	if !errors.As(err, &short) {
+		t.Fatalf("readRegister returned 0x%04x, %v, want a *ShortReadError", value, err)
+	}
+	if short.Read != 1 || short.Expected != 2 {
+		t.Errorf("short read of %d of %d bytes, want 1 of 2", short.Read, short.Expected)
+	}
+	if sample, err := ina.ReadSensorData(); err == nil {
+		t.Errorf("ReadSensorData returned %+v after a short read, want an error", sample)
+	}
+}
+
+func TestCheckTransferred(t *testing.T) {
+	if err := checkTransferred(2, 2, 2); err != nil {
+		t.Errorf("complete transfer: %v", err)
+	}
+	var short *ShortReadError
+	if err := checkTransferred(1, 2, 2); !errors.As(err, &short) || short.Expected != 2 {
+		t.Errorf("missing read message: %v, want a *ShortReadError of 2 bytes", err)
+	}
+	if err := checkTransferred(0, 1, 0); err == nil || errors.As(err, &short) {
+		t.Errorf("missing write message: %v, want a plain error", err)
+	}
+}
+
+// Run with -race: a range switch of the read loop must not race with an on-demand read
+func TestCalibrateDuringOnDemandRead(t *testing.T) {
+	high, err := NewCalibration(0.002, 10)
+	if err != nil {
+		t.Fatalf("NewCalibration: %v", err)
+	}
+	low, err := NewCalibration(0.002, 5)
+	if err != nil {
+		t.Fatalf("NewCalibration: %v", err)
+	}
+	bus := newFakeBus()
+	ina := newFakeINA226(t, bus, high)
+
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 200; i++ {
+			cal := high
+			if i%2 == 0 {
+				cal = low
+			}
+			if err := ina.Calibrate(cal); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for i := 0; i < 200; i++ {
+		if _, err := ina.ReadSensorDataNow(); err != nil {
+			t.Fatalf("ReadSensorDataNow: %v", err)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Calibrate: %v", err)
+	}
+}
+
+// An adapter that flips the lowest bit of the calibration register writes, like a bus glitch
+type corruptingBus struct {
+	*fakeBus
+}
+
+func (b corruptingBus) Tx(addr uint16, w, r []byte) error {
+	if len(w) == 3 && w[0] == calibrationReg {
+		w = []byte{w[0], w[1], w[2] ^ 1}
+	}
+	return b.fakeBus.Tx(addr, w, r)
+}
+
+func TestCalibrateVerifiesWrites(t *testing.T) {
+	high, err := NewCalibration(0.002, 10)
+	if err != nil {
+		t.Fatalf("NewCalibration: %v", err)
+	}
+	low, err := NewCalibration(0.002, 5)
+	if err != nil {
+		t.Fatalf("NewCalibration: %v", err)
+	}
+	for _, verify := range []bool{true, false} {
+		bus := newFakeBus()
+		ina, err := NewINA226(bus, INA226Options{Calibration: high, VerifyWrites: verify})
+		if err != nil {
+			t.Fatalf("NewINA226: %v", err)
+		}
+
+		// A range switch whose write is corrupted
+		ina.dev.Bus = corruptingBus{bus}
+		err = ina.Calibrate(low)
+		var unverified *WriteVerifyError
+		if verify {
+			if !errors.As(err, &unverified) || unverified.Reg != calibrationReg {
+				t.Errorf("Calibrate returned %v, want a *WriteVerifyError of the calibration register", err)
+			}
+			if ina.WriteVerifyFailures() != 1 {
+				t.Errorf("%d write verify failures, want 1", ina.WriteVerifyFailures())
+			}
+			if ina.cal != high {
+				t.Errorf("the unverified calibration was applied")
+			}
+		} else if err != nil || ina.WriteVerifyFailures() != 0 {
+			t.Errorf("Calibrate without verify-writes returned %v with %d failures", err, ina.WriteVerifyFailures())
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Lines that are written in a single request
+	influxBatchLines = 500
+	// Lines that are kept while the database is unreachable, the oldest lines are dropped beyond this
+	influxMaxBufferedLines = 50000
+	// Timeout of a single write request
+	influxWriteTimeout = 5 * time.Second
+	// Maximum delay between attempts while writes fail, doubled from the flush interval after every failure
+	influxMaxRetryInterval = time.Minute
+	// Maximum size of a UDP datagram, so that it is not fragmented on a typical network
+	influxUDPPayload = 1400
+	// Bytes of the response body that are included in the error of a failed write
+	influxMaxErrorBody = 256
+)
+
+var metricInfluxRejected = metrics.counter("rover_energy_influx_rejected_lines_total", "Number of lines that InfluxDB rejected and that were skipped instead of retried")
+
+// Optional sink, shared with onTerminate to flush it on shutdown
+var influx *influxSink
+
+// Writes samples in the InfluxDB line protocol, to the HTTP write endpoint or a UDP listener. Lines are
+// buffered and written in batches from a separate goroutine, so that a slow or unreachable database never
+// stalls the sensor loop. Failed batches are kept and retried with a growing delay, unless the database
+// rejected them.
+type influxSink struct {
+	url   string   // HTTP write endpoint, empty when writing over UDP
+	token string   // sent as "Authorization: Token <token>" when set
+	udp   net.Conn // nil when writing over HTTP
+	// The measurement and the tags of every line
+	series        string
+	flushInterval time.Duration
+	client        *http.Client
+
+	lock    sync.Mutex
+	lines   [][]byte
+	dropped int
+	closed  bool
+	wake    chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+	// The status of the last rejected batch, so that a repeating rejection is logged once until a batch is accepted
+	rejected string
+}
+
+// Returned by send when the database rejected the batch with a 4xx status (other than 429 Too Many Requests),
+// e.g. for a malformed line or a wrong token. Sending the same batch again would fail the same way.
+type InfluxRejectedError struct {
+	Status string
+	Body   string
+}
+
+func (e *InfluxRejectedError) Error() string {
+	return fmt.Sprintf("influx rejected the samples with %s: %s", e.Status, e.Body)
+}
+
+// Creates the sink for an endpoint of the form http(s)://host:8086/api/v2/write?org=...&bucket=... (or the
+// /write?db=... endpoint of InfluxDB 1.x), or udp://host:port
+func newInfluxSink(endpoint string, token string, measurement string, tags []label, flushInterval time.Duration) (*influxSink, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid influx-url: %v", err)
+	}
+
+	s := &influxSink{
+		token:         token,
+		series:        influxSeries(measurement, tags),
+		flushInterval: flushInterval,
+		client:        &http.Client{Timeout: influxWriteTimeout},
+		wake:          make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+	switch parsed.Scheme {
+	case "http", "https":
+		s.url = endpoint
+	case "udp":
+		s.udp, err = net.Dial("udp", parsed.Host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open influx udp socket: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("invalid influx-url %q, must be an http(s):// or udp:// url", endpoint)
+	}
+
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+// The measurement and the tags that start every line of the sensor, escaped for the line protocol
+func influxSeries(measurement string, tags []label) string {
+	series := escapeInfluxName(measurement, ", ")
+	for _, tag := range tags {
+		if tag.value == "" {
+			// Empty tag values are not allowed in the line protocol
+			continue
+		}
+		series += "," + escapeInfluxName(tag.name, ",= ") + "=" + escapeInfluxName(tag.value, ",= ")
+	}
+	return series
+}
+
+// Appends the sample as a line of the line protocol (without the newline), with only the valid measurements
+// as fields and the timestamp in nanoseconds
+func appendInfluxLine(line []byte, series string, sample *CurrentSensorOutput) []byte {
+	line = append(line, series...)
+	separator := byte(' ')
+	field := func(name string, value float64) {
+		line = append(line, separator)
+		line = append(line, name...)
+		line = append(line, '=')
+		line = strconv.AppendFloat(line, value, 'g', -1, 64)
+		separator = ','
+	}
+	if sample.ValidFields.Has(FieldVoltage) {
+		field("supplyVoltage", sample.SupplyVoltage)
+	}
+	if sample.ValidFields.Has(FieldCurrent) {
+		field("currentAmps", sample.CurrentAmps)
+	}
+	if sample.ValidFields.Has(FieldPower) {
+		field("powerWatts", sample.PowerWatts)
+		field("signedPowerWatts", sample.SignedPowerWatts)
+	}
+	if sample.ValidFields.Has(FieldShuntVoltage) {
+		field("shuntVoltage", sample.ShuntVoltage)
+	}
+	field("energyWh", sample.EnergyWh)
+	field("chargeAh", sample.ChargeAh)
+	line = append(line, ' ')
+	return strconv.AppendInt(line, sample.Timestamp.UnixNano(), 10)
+}
+
+// Escapes the characters that have a meaning in the line protocol at the position of a name
+func escapeInfluxName(name string, special string) string {
+	var b strings.Builder
+	for _, c := range name {
+		if strings.ContainsRune(special, c) || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *influxSink) Name() string {
+	return "influx"
+}
+
+// Queues the sample as a line, never blocks. Only the valid measurements are written, and gap samples are
+// left out, like in the SQLite storage.
+func (s *influxSink) Write(sample *CurrentSensorOutput) error {
+	if sample.Stale {
+		return nil
+	}
+
+	line := appendInfluxLine(make([]byte, 0, 256), s.series, sample)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.lines = append(s.lines, line)
+	s.trim()
+	if len(s.lines) >= influxBatchLines {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Drops the oldest lines beyond influxMaxBufferedLines, called with the lock held
+func (s *influxSink) trim() {
+	overflow := len(s.lines) - influxMaxBufferedLines
+	if overflow <= 0 {
+		return
+	}
+	s.lines = s.lines[overflow:]
+	if s.dropped == 0 {
+		log.Warn().Int("buffered", influxMaxBufferedLines).Msg("InfluxDB is unreachable for too long, dropping the oldest samples")
+	}
+	s.dropped += overflow
+}
+
+// Writes the buffered lines every flush interval, or as soon as a batch is full. After a failure, the
+// lines are kept and the next attempt waits twice as long, up to influxMaxRetryInterval.
+func (s *influxSink) run() {
+	defer s.wg.Done()
+
+	delay := s.flushInterval
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.wake:
+			if delay > s.flushInterval {
+				// Still backing off after a failure
+				continue
+			}
+		case <-timer.C:
+		}
+
+		if err := s.flush(); err != nil {
+			delay = min(delay*2, influxMaxRetryInterval)
+			log.Warn().Dur("retryIn", delay).Msgf("unable to write samples to influx: %v", err)
+		} else {
+			delay = s.flushInterval
+		}
+		timer.Reset(delay)
+	}
+}
+
+// Writes all buffered lines in batches. A batch that failed on the network, with a 5xx status or with 429 Too
+// Many Requests is put back in front of the buffer, to be retried. A batch that was rejected is skipped.
+func (s *influxSink) flush() error {
+	for {
+		s.lock.Lock()
+		n := min(len(s.lines), influxBatchLines)
+		batch := s.lines[:n:n]
+		s.lines = s.lines[n:]
+		s.lock.Unlock()
+		if n == 0 {
+			return nil
+		}
+
+		err := s.send(batch)
+		var rejected *InfluxRejectedError
+		if errors.As(err, &rejected) {
+			metricInfluxRejected.Add(float64(len(batch)))
+			if rejected.Status != s.rejected {
+				log.Error().Int("lines", len(batch)).Msgf("Skipping samples: %v", err)
+				s.rejected = rejected.Status
+			}
+			continue
+		}
+		if err != nil {
+			s.lock.Lock()
+			s.lines = append(batch, s.lines...)
+			s.trim()
+			s.lock.Unlock()
+			return err
+		}
+
+		s.rejected = ""
+		s.lock.Lock()
+		if s.dropped > 0 {
+			log.Info().Int("dropped", s.dropped).Msg("InfluxDB is reachable again")
+			s.dropped = 0
+		}
+		s.lock.Unlock()
+	}
+}
+
+// Writes the lines in a single request, or in datagrams of at most influxUDPPayload bytes over UDP
+func (s *influxSink) send(lines [][]byte) error {
+	if s.udp != nil {
+		var datagram []byte
+		for i, line := range lines {
+			datagram = append(datagram, line...)
+			datagram = append(datagram, '\n')
+			if i == len(lines)-1 || len(datagram)+len(lines[i+1])+1 > influxUDPPayload {
+				if _, err := s.udp.Write(datagram); err != nil {
+					return err
+				}
+				datagram = datagram[:0]
+			}
+		}
+		return nil
+	}
+
+	body := bytes.Join(lines, []byte{'\n'})
+	request, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		request.Header.Set("Authorization", "Token "+s.token)
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 == 2 {
+		return nil
+	}
+	reply, _ := io.ReadAll(io.LimitReader(response.Body, influxMaxErrorBody))
+	message := strings.TrimSpace(string(reply))
+	if response.StatusCode/100 == 4 && response.StatusCode != http.StatusTooManyRequests {
+		return &InfluxRejectedError{Status: response.Status, Body: message}
+	}
+	return fmt.Errorf("influx responded with %s: %s", response.Status, message)
+}
+
+// Stops the background writes and makes a last attempt to write the buffered lines
+func (s *influxSink) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.lock.Unlock()
+
+	close(s.done)
+	s.wg.Wait()
+	err := s.flush()
+	if s.udp != nil {
+		s.udp.Close()
+	}
+	return err
+}
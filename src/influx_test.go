@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// A rejected batch is skipped, while a batch that failed with a server error, or was throttled, is kept for a retry
+func TestInfluxFlushRetriesOnlyTransientFailures(t *testing.T) {
+	status := http.StatusBadRequest
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests++
+		http.Error(w, "unable to parse line", status)
+	}))
+	defer server.Close()
+
+	s := &influxSink{url: server.URL, client: server.Client()}
+	queue := func(n int) {
+		for i := 0; i < n; i++ {
+			s.lines = append(s.lines, []byte("energy energyWh=1 0"))
+		}
+	}
+
+	queue(influxBatchLines + 1)
+	if err := s.flush(); err != nil {
+		t.Fatalf("rejected batches must be skipped without an error, got %v", err)
+	}
+	if len(s.lines) != 0 || requests != 2 {
+		t.Fatalf("expected both rejected batches to be skipped after one request each, got %d lines left after %d requests", len(s.lines), requests)
+	}
+
+	for _, status = range []int{http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+		requests = 0
+		queue(3)
+		if err := s.flush(); err == nil {
+			t.Fatalf("expected an error for status %d", status)
+		}
+		if len(s.lines) != 3 || requests != 1 {
+			t.Fatalf("expected the batch to be kept after status %d, got %d lines after %d requests", status, len(s.lines), requests)
+		}
+		s.lines = nil
+	}
+
+	server.Close()
+	queue(3)
+	if err := s.flush(); err == nil || len(s.lines) != 3 {
+		t.Fatalf("expected the batch to be kept after a network error, got %v with %d lines", err, len(s.lines))
+	}
+}
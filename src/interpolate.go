@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Produces samples at exact grid timestamps (multiples of the period) by linearly interpolating between the two
+// nearest raw samples, for consumers that expect a regular time base. A grid sample is only produced once the
+// raw sample after it was read, which adds up to one sample period of latency.
+type gridInterpolator struct {
+	period       time.Duration
+	previous     CurrentSensorOutput
+	havePrevious bool
+	next         time.Time             // the next grid timestamp to produce
+	out          []CurrentSensorOutput // reused between calls
+}
+
+// Gaps between raw samples (e.g. while the sensor was lost) longer than this many periods, and at least
+// a second, are not interpolated across
+const interpolationMaxGapPeriods = 10
+
+func newGridInterpolator(period time.Duration) *gridInterpolator {
+	return &gridInterpolator{period: period}
+}
+
+// Adds a raw sample and returns the grid samples between the previous raw sample and this one. The returned
+// slice is only valid until the next call.
+func (g *gridInterpolator) add(sample *CurrentSensorOutput) []CurrentSensorOutput {
+	g.out = g.out[:0]
+	maxGap := max(interpolationMaxGapPeriods*g.period, time.Second)
+	if !g.havePrevious || sample.Timestamp.Sub(g.previous.Timestamp) > maxGap {
+		// Start (again) at the first grid timestamp from this sample on
+		g.next = sample.Timestamp.Truncate(g.period)
+		if g.next.Before(sample.Timestamp) {
+			g.next = g.next.Add(g.period)
+		}
+	}
+
+	if g.havePrevious {
+		span := sample.Timestamp.Sub(g.previous.Timestamp)
+		for span > 0 && !g.next.After(sample.Timestamp) {
+			f := float64(g.next.Sub(g.previous.Timestamp)) / float64(span)
+			g.out = append(g.out, interpolateSample(&g.previous, sample, f, g.next))
+			g.next = g.next.Add(g.period)
+		}
+	} else if g.next.Equal(sample.Timestamp) {
+		g.out = append(g.out, *sample)
+		g.next = g.next.Add(g.period)
+	}
+
+	g.previous = *sample
+	g.havePrevious = true
+	return g.out
+}
+
+// Interpolates the quantities of two samples at fraction f (0 at a, 1 at b). The other fields are taken from b.
+func interpolateSample(a *CurrentSensorOutput, b *CurrentSensorOutput, f float64, timestamp time.Time) CurrentSensorOutput {
+	lerp := func(x float64, y float64) float64 {
+		return x + f*(y-x)
+	}
+
+	out := *b
+	out.Timestamp = timestamp
+	out.SupplyVoltage = lerp(a.SupplyVoltage, b.SupplyVoltage)
+	out.CurrentAmps = lerp(a.CurrentAmps, b.CurrentAmps)
+	out.PowerWatts = lerp(a.PowerWatts, b.PowerWatts)
+	out.SignedPowerWatts = lerp(a.SignedPowerWatts, b.SignedPowerWatts)
+	out.ShuntVoltage = lerp(a.ShuntVoltage, b.ShuntVoltage)
+	out.EnergyWh = lerp(a.EnergyWh, b.EnergyWh)
+	out.ChargeAh = lerp(a.ChargeAh, b.ChargeAh)
+	out.Energy = lerp(a.Energy, b.Energy)
+	out.Charge = lerp(a.Charge, b.Charge)
+	out.AvgPowerWattsLastMinute = lerp(a.AvgPowerWattsLastMinute, b.AvgPowerWattsLastMinute)
+	out.MonotonicNanos = a.MonotonicNanos + int64(math.Round(f*float64(b.MonotonicNanos-a.MonotonicNanos)))
+	return out
+}
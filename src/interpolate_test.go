@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInterpolatedMonotonicNanos(t *testing.T) {
+	g := newGridInterpolator(100 * time.Millisecond)
+	start := time.Date(2024, 5, 1, 10, 0, 0, 50*int(time.Millisecond), time.UTC)
+	// Read at 1 s and 1.2 s on the monotonic clock, the grid samples lie in between
+	first := CurrentSensorOutput{Timestamp: start, MonotonicNanos: int64(time.Second), CurrentAmps: 1}
+	second := CurrentSensorOutput{Timestamp: start.Add(200 * time.Millisecond), MonotonicNanos: int64(1200 * time.Millisecond), CurrentAmps: 3}
+	if grid := g.add(&first); len(grid) != 0 {
+		t.Fatalf("got %d grid samples from the first sample, want 0", len(grid))
+	}
+	grid := g.add(&second)
+	if len(grid) != 2 {
+		t.Fatalf("got %d grid samples, want 2", len(grid))
+	}
+	for i, want := range []time.Duration{1050 * time.Millisecond, 1150 * time.Millisecond} {
+		if grid[i].MonotonicNanos != int64(want) {
+			t.Errorf("grid sample %d has monotonicNanos %d, want %d", i, grid[i].MonotonicNanos, int64(want))
+		}
+	}
+	if grid[0].CurrentAmps != 1.5 {
+		t.Errorf("grid sample 0 has %v A, want 1.5 A", grid[0].CurrentAmps)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	roverlib "github.com/VU-ASE/roverlib-go/src"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Replaces the logger that roverlib set up with the one selected by log-format: "json" for machine ingestion,
+// "console" for (colorized) human-readable output. Without log-format, roverlib's logger is kept, which logs to
+// the console, or as JSON to the file given with -output. The log level and caller format are kept either way.
+func setupLogFormat(configuration *roverlib.ServiceConfiguration) error {
+	switch format := getStringOr(configuration, "log-format", ""); format {
+	case "":
+		return nil
+	case "json":
+		log.Logger = zerolog.New(os.Stderr).With().Timestamp().Caller().Logger()
+	case "console":
+		log.Logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).With().Timestamp().Caller().Logger()
+	default:
+		return fmt.Errorf("invalid log-format %q, must be \"json\" or \"console\"", format)
+	}
+	return nil
+}
+
+// Collapses identical consecutive error messages into a periodic "still failing" summary, so that an outage
+// (e.g. an unplugged bus) does not bury everything else in the log
+type repeatedErrorLog struct {
+	interval   time.Duration // between the summaries of a repeating error, 0 logs every error
+	message    string
+	count      int
+	lastLogged time.Time
+}
+
+func newRepeatedErrorLog(interval time.Duration) *repeatedErrorLog {
+	return &repeatedErrorLog{interval: interval}
+}
+
+// Logs the error when it differs from the previous one, and otherwise at most once per interval with the
+// number of consecutive failures
+func (l *repeatedErrorLog) failed(message string) {
+	now := time.Now()
+	if message != l.message {
+		l.message = message
+		l.count = 1
+		l.lastLogged = now
+		log.Error().Msg(message)
+		return
+	}
+
+	l.count++
+	if now.Sub(l.lastLogged) >= l.interval {
+		l.lastLogged = now
+		log.Error().Int("times", l.count).Msgf("Still failing (%d times): %s", l.count, message)
+	}
+}
+
+// Ends the repeating error, so that the next error is logged right away
+func (l *repeatedErrorLog) succeeded() {
+	if l.count > 1 {
+		log.Info().Int("times", l.count).Msgf("Recovered after failing %d times: %s", l.count, l.message)
+	}
+	l.message = ""
+	l.count = 0
+}
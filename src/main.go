@@ -1,232 +1,1150 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	roverlib "github.com/VU-ASE/roverlib-go/src"
-	"periph.io/x/conn/v3/i2c"
-	"periph.io/x/conn/v3/i2c/i2creg"
-	"periph.io/x/host/v3"
+	"periph.io/x/conn/v3/gpio"
 
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-
-	// pb_outputs "github.com/VU-ASE/rovercom/packages/go/outputs"
 )
 
-const (
-	// Device address
-	ina226Address = 0x40
-
-	// Register addresses
-	configReg      = 0x00
-	shuntVoltReg   = 0x01
-	busVoltReg     = 0x02
-	powerReg       = 0x03
-	currentReg     = 0x04
-	calibrationReg = 0x05
-
-	// Configuration values
-	configValue = 0x4127 // Default configuration
-
-	// Conversion factors
-	busVoltageConversion = 1.25 / 1000.0 // 1.25 mV/bit
-	currentLSB           = 0.001         // 1 mA/bit (adjust based on your calibration)
-	powerLSB             = 25.0 * 0.001  // 25 * currentLSB (25 mW/bit)
-)
+// Optional sinks, which are shared with onTerminate to flush them on shutdown
+var sqlite *sqliteSink
+var mqttPublisher *mqttSink
+var histogram *currentHistogram
+var persister *statePersister
+var socketSink *unixSocketSink
 
-type INA226 struct {
-	dev i2c.Dev
-}
+// Suggests a calibration range from the observed current, shared with onTerminate to advise on shutdown
+var advisor *calibrationAdvisor
 
-func NewINA226(bus i2c.BusCloser) (*INA226, error) {
-	ina := &INA226{
-		dev: i2c.Dev{Bus: bus, Addr: ina226Address},
+// Totals of the run, shared with onTerminate to report them on shutdown
+var stats *runStats
+
+func run(service roverlib.Service, configuration *roverlib.ServiceConfiguration) error {
+	// Select the log output first, so that every message uses it
+	if err := setupLogFormat(configuration); err != nil {
+		return err
+	}
+
+	// From the service.yaml, read the configuration value for the update-frequency
+	// of the service.
+	if configuration == nil {
+		if !defaultConfigAllowed() {
+			return fmt.Errorf("configuration cannot be accessed (set ENERGY_ALLOW_DEFAULT_CONFIG=1 to run with the built-in defaults)")
+		}
+		log.Warn().Msg("No configuration available, running with the built-in defaults (I2C bus 5, address 0x40, 10 Hz, 2 mOhm shunt)")
 	}
 
-	// Initialize device
-	if err := ina.initialize(); err != nil {
-		return nil, fmt.Errorf("failed to initialize INA226: %v", err)
+	if err := validateConfiguration(service, configuration); err != nil {
+		return err
 	}
 
-	return ina, nil
-}
+	// Determine the calibration before touching the hardware, so that misconfiguration fails fast
+	cal, err := readCalibration(configuration)
+	if err != nil {
+		return fmt.Errorf("invalid shunt configuration: %v", err)
+	}
+	powerSource, err := readPowerSource(configuration)
+	if err != nil {
+		return err
+	}
+	currentMode, err := readCurrentMode(configuration)
+	if err != nil {
+		return err
+	}
+	shuntPlacement, err := readShuntPlacement(configuration)
+	if err != nil {
+		return err
+	}
+	if currentMode == CurrentFromShunt {
+		if getFloatOr(configuration, "auto-range", 0) != 0 || getFloatOr(configuration, "calibration-check-tolerance", 0) > 0 {
+			return fmt.Errorf("current-mode %q does not use the calibration register, so it cannot be combined with auto-range or calibration-check-tolerance", CurrentFromShunt)
+		}
+		// The power register is scaled by the calibration as well
+		powerSource = PowerComputed
+	}
+	units, err := newUnitConverter(getStringOr(configuration, "energy-unit", "wh"), getStringOr(configuration, "charge-unit", "ah"))
+	if err != nil {
+		return err
+	}
+	busGain := getFloatOr(configuration, "bus-gain", 1)
+	busOffset := getFloatOr(configuration, "bus-offset", 0)
+	if busGain <= 0 {
+		return fmt.Errorf("bus-gain must be positive, got %v", busGain)
+	}
+	busDivider := getFloatOr(configuration, "bus-voltage-divider", 1)
+	if busDivider < 1 {
+		return fmt.Errorf("bus-voltage-divider must be at least 1, got %v", busDivider)
+	}
+	actualShunt := getFloatOr(configuration, "actual-shunt-ohms", 0)
+	if actualShunt < 0 {
+		return fmt.Errorf("actual-shunt-ohms must not be negative, got %v", actualShunt)
+	}
+	revisionOverrides, err := parseRevisionOverrides(getStringOr(configuration, "die-revision-overrides", ""))
+	if err != nil {
+		return err
+	}
+	fieldMask, err := parseFieldMask(getStringOr(configuration, "field-mask", "voltage,current,power"))
+	if err != nil {
+		return fmt.Errorf("invalid field-mask: %v", err)
+	}
+	voltageDivisor := getFloatOr(configuration, "voltage-sample-divisor", 1)
+	if voltageDivisor < 1 || voltageDivisor != math.Trunc(voltageDivisor) {
+		return fmt.Errorf("voltage-sample-divisor must be a positive integer, got %v", voltageDivisor)
+	}
+	log.Info().Float64("shuntOhms", cal.ShuntOhms).Float64("maxCurrentAmps", cal.MaxCurrentAmps).Uint16("calibration", cal.Register).Msg("Using shunt calibration")
+
+	id := getFloatOr(configuration, "sensor-id", 1)
+	if id < 0 || id != math.Trunc(id) {
+		return fmt.Errorf("sensor-id must be a non-negative integer, got %v", id)
+	}
+	sensorID = uint32(id)
+	sensorName := getStringOr(configuration, "sensor-name", "")
+
+	// We publish measurements to the energy output stream
+	writeStream := service.GetWriteStream("energy")
+	if writeStream == nil {
+		return fmt.Errorf("failed to create write stream 'energy'")
+	}
 
-func (ina *INA226) initialize() error {
-	// Set configuration register
-	if err := ina.writeRegister(configReg, configValue); err != nil {
+	// Initialize periph.io
+	drivers, err := readPeriphDrivers(configuration)
+	if err != nil {
 		return err
 	}
+	initPeriph(drivers)
 
-	// Set calibration register (2560 or 0xA00 for a 2mΩ shunt resistor)
-	// This value should be calculated based on your specific shunt resistor
-	if err := ina.writeRegister(calibrationReg, 2560); err != nil {
+	byteOrder, err := readByteOrder(configuration)
+	if err != nil {
 		return err
 	}
+	address, err := readSensorAddress(configuration)
+	if err != nil {
+		return err
+	}
+	initTimeout := getFloatOr(configuration, "init-timeout-seconds", 10)
+	if initTimeout < 0 {
+		return fmt.Errorf("init-timeout-seconds must not be negative, got %v", initTimeout)
+	}
 
-	return nil
-}
+	opener := readBusOpener(configuration, drivers)
+	openBus := opener.open
+	var ina226 *INA226
+	var board *boardCalibration
+	code, err := retryStartup(time.Duration(initTimeout*float64(time.Second)), func() (faultCode, error) {
+		// Open I2C bus
+		bus, err := openBus()
+		if err != nil {
+			return faultBusOpenFailed, fmt.Errorf("failed to open I2C bus: %v", err)
+		}
 
-func (ina *INA226) writeRegister(reg uint8, value uint16) error {
-	// Convert value to big-endian bytes
-	data := []byte{reg, byte(value >> 8), byte(value & 0xFF)}
-	return ina.dev.Tx(data, nil)
-}
+		// Optionally read the registers with SMBus block reads, falling back to raw transactions
+		var smbus *smbusDevice
+		if getFloatOr(configuration, "smbus", 0) != 0 {
+			smbus, err = openSMBus(opener.devicePath(), address)
+			if err != nil {
+				log.Warn().Msgf("unable to use SMBus block reads, falling back to raw I2C transactions: %v", err)
+			} else {
+				log.Info().Msg("Reading registers with SMBus block reads")
+			}
+		}
+
+		// The trimmed calibration of the board, when it carries an EEPROM with one
+		board = readConfiguredBoardCalibration(configuration, bus)
+
+		// Create a new INA226 instance
+		ina226, err = NewINA226(bus, INA226Options{
+			Calibration:           cal,
+			IDRetries:             int(getFloatOr(configuration, "id-check-retries", 3)),
+			SkipInit:              getFloatOr(configuration, "skip-init", 0) != 0,
+			SkipIDCheck:           getFloatOr(configuration, "verify-id", 1) == 0,
+			VerifyWrites:          getFloatOr(configuration, "verify-writes", 1) != 0,
+			CalibrationSettleTime: time.Duration(getFloatOr(configuration, "calibration-settle-ms", -1) * float64(time.Millisecond)),
+			PresenceRetries:       int(getFloatOr(configuration, "probe-nack-retries", 20)),
+			PresenceRetryDelay:    time.Duration(getFloatOr(configuration, "probe-nack-delay-ms", 5)) * time.Millisecond,
+			BusBusyTimeout:        time.Duration(getFloatOr(configuration, "bus-busy-timeout-ms", 50)) * time.Millisecond,
+			Reopen:                openBus,
+			SMBus:                 smbus,
+			ByteOrder:             byteOrder,
+			Address:               address,
+		})
+		if err != nil {
+			bus.Close()
+			if smbus != nil {
+				smbus.Close()
+			}
+			var mismatch *IDMismatchError
+			if errors.As(err, &mismatch) {
+				return faultIDMismatch, fmt.Errorf("wrong device on the I2C bus: %v", err)
+			}
+			var unverified *WriteVerifyError
+			if errors.As(err, &unverified) {
+				return faultWriteVerifyFailed, err
+			}
+			return faultInitFailed, err
+		}
+		return "", nil
+	})
+	if err != nil {
+		return faults.fatal(code, err)
+	}
+	// The bus may be reopened during bus recovery, so the sensor closes whichever bus it ends up on
+	defer ina226.Close()
 
-func (ina *INA226) readRegister(reg uint8) (uint16, error) {
-	// Write register address
-	if err := ina.dev.Tx([]byte{reg}, nil); err != nil {
-		return 0, err
+	// A die revision may behave slightly differently, so the trims can be overridden per revision
+	var overrides optionOverrides
+	startRevision, haveStartRevision := ina226.DieRevision()
+	if haveStartRevision {
+		overrides = revisionOverrides[startRevision]
+		log.Info().Uint8("dieRevision", startRevision).Bool("overridden", overrides != nil).Msg("Detected the die revision")
+		if overrides != nil {
+			// Easily forgotten once set, like the output corrections
+			log.Warn().Uint8("dieRevision", startRevision).Interface("overrides", overrides).Msg("Applying the configuration overrides of the die revision")
+		}
+	} else if len(revisionOverrides) > 0 {
+		log.Warn().Msg("The die revision is not read with verify-id 0, die-revision-overrides are ignored")
+	}
+	busGain = overrides.float("bus-gain", busGain)
+	busOffset = overrides.float("bus-offset", busOffset)
+	actualShunt = overrides.float("actual-shunt-ohms", actualShunt)
+	ina226.SetPowerSource(powerSource)
+	ina226.SetCurrentMode(currentMode)
+	ina226.SetShuntPlacement(shuntPlacement)
+	ina226.SetBusVoltageDivider(busDivider)
+	if actualShunt != 0 {
+		ina226.SetActualShuntOhms(actualShunt)
+		// Easily forgotten once set, like the output corrections
+		log.Warn().Float64("calibratedShuntOhms", cal.ShuntOhms).Float64("actualShuntOhms", actualShunt).Float64("ratio", ina226.shuntRatio()).
+			Msg("The fitted shunt differs from the calibration, the current and power readings are scaled to it")
 	}
+	ina226.SetBusCorrection(busGain, busOffset)
+	if board != nil {
+		board.apply(ina226)
+	}
+	ina226.SetVoltageSampleDivisor(int(voltageDivisor))
 
-	// Read register value (2 bytes)
-	data := make([]byte, 2)
-	if err := ina.dev.Tx(nil, data); err != nil {
-		return 0, err
+	// The metrics are exported over HTTP (Prometheus) and/or pushed over OTLP
+	metrics.setLabels(label{"sensor", fmt.Sprint(sensorID)}, label{"rail", sensorName})
+	version := "unknown"
+	if service.Version != nil {
+		version = *service.Version
 	}
+	metrics.buildInfo("rover_energy_build_info", version)
+	metrics.counterFunc("rover_energy_i2c_arbitration_errors_total", "Number of I2C transactions that lost arbitration to another master",
+		func() float64 { return float64(ina226.ArbitrationErrors()) })
+	metrics.counterFunc("rover_energy_i2c_bus_busy_errors_total", "Number of I2C transactions that failed because the bus was busy",
+		func() float64 { return float64(ina226.BusBusyErrors()) })
+	metrics.counterFunc("rover_energy_write_verify_failures_total", "Number of verified register writes (setup and calibration) that did not read back the written value",
+		func() float64 { return float64(ina226.WriteVerifyFailures()) })
 
-	// Convert from big-endian
-	return uint16(data[0])<<8 | uint16(data[1]), nil
-}
+	if address := getStringOr(configuration, "http-listen", ""); address != "" {
+		httpMux.Handle("GET /metrics", metrics)
+		registerRegisterEndpoints(ina226, getFloatOr(configuration, "debug-register-access", 0) != 0)
+		registerSnapshotEndpoint(ina226)
+		registerCapabilitiesEndpoint()
+		serveHTTP(address)
+	}
+
+	if endpoint := getStringOr(configuration, "otlp-endpoint", ""); endpoint != "" {
+		interval := time.Duration(getFloatOr(configuration, "otlp-interval-seconds", 10) * float64(time.Second))
+		if interval <= 0 {
+			return fmt.Errorf("otlp-interval-seconds must be positive, got %v", interval.Seconds())
+		}
+		exporter := newOTLPExporter(metrics, endpoint, interval, []label{
+			{"service.name", "energy"},
+			{"service.version", version},
+			{"sensor.id", fmt.Sprint(sensorID)},
+			{"sensor.rail", sensorName},
+		})
+		go exporter.run()
+		log.Info().Str("endpoint", endpoint).Dur("interval", interval).Msg("Pushing metrics over OTLP")
+	}
 
-func (ina *INA226) ReadBusVoltage() (float64, error) {
-	raw, err := ina.readRegister(busVoltReg)
+	// Qualification of the I2C bus, which only reads the registers and stops with a verdict
+	stress, err := readStressTest(configuration)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	if stress != nil {
+		if !stress.run(ina226) {
+			// A non-zero exit status, for automated qualification
+			return fmt.Errorf("stress test failed")
+		}
+		return nil
+	}
+
+	// Optionally measure the current offset while no current flows, to improve low-current accuracy
+	if getFloatOr(configuration, "zero-calibrate", 0) != 0 {
+		samples := int(getFloatOr(configuration, "zero-calibrate-samples", 200))
+		maxOffset := getFloatOr(configuration, "zero-calibrate-max-amps", 0.05)
+		if err := runZeroCalibration(ina226, samples, maxOffset); err != nil {
+			return err
+		}
 	}
-	return float64(raw) * busVoltageConversion, nil
-}
 
-func (ina *INA226) ReadCurrent() (float64, error) {
-	raw, err := ina.readRegister(currentReg)
+	// The chip cannot produce fresh conversions faster than its conversion time and averaging allow
+	conversionPeriod, err := ina226.ConversionPeriod()
 	if err != nil {
-		return 0, err
+		return fmt.Errorf("failed to read the configuration: %v", err)
 	}
-	// Check if value is negative (two's complement)
-	value := int16(raw)
-	return float64(value) * currentLSB, nil
-}
+	maxRate := 0.0
+	if conversionPeriod > 0 {
+		maxRate = float64(time.Second) / float64(conversionPeriod)
+	}
+	averaging, err := ina226.Averaging()
+	if err != nil {
+		return fmt.Errorf("failed to read the configuration: %v", err)
+	}
+	// Reading faster than the chip converts only repeats (heavily correlated, with averaging) conversions, so the
+	// read rate can be limited to the conversion rate instead of only warning about it
+	limitToConversions := getFloatOr(configuration, "limit-to-conversion-rate", 0) != 0
 
-func (ina *INA226) ReadPower() (float64, error) {
-	raw, err := ina.readRegister(powerReg)
+	// With skip-init, another controller may have left a mode that converts only one channel, in which the
+	// registers of the other channel (and the power register, which needs both) are stale
+	mode, err := ina226.OperatingMode()
 	if err != nil {
-		return 0, err
+		return fmt.Errorf("failed to read the configuration: %v", err)
+	}
+	if stale := fieldMask &^ mode.convertedFields(); stale != 0 {
+		event := log.Warn().Str("mode", mode.mode).Strs("staleFields", stale.Names())
+		switch handling := getStringOr(configuration, "channel-mode-handling", "mask"); handling {
+		case "mask":
+			fieldMask &^= stale
+			if fieldMask == 0 {
+				return fmt.Errorf("the operating mode %q converts none of the fields of field-mask", mode.mode)
+			}
+			event.Msg("The operating mode does not convert all fields of field-mask, leaving the stale fields out")
+		case "warn":
+			event.Msg("The operating mode does not convert all fields of field-mask, their readings may be stale")
+		case "error":
+			return fmt.Errorf("the operating mode %q does not convert %s of field-mask", mode.mode, strings.Join(stale.Names(), ", "))
+		default:
+			return fmt.Errorf("invalid channel-mode-handling %q, must be \"mask\", \"warn\" or \"error\"", handling)
+		}
+	}
+	if mode.modeBits != 0 && mode.modeBits < 4 {
+		log.Warn().Str("mode", mode.mode).Msg("The sensor is in a triggered mode, readings are only fresh when another controller triggers a conversion")
 	}
-	return float64(raw) * powerLSB, nil
-}
 
-type CurrentSensorOutput struct {
-	SupplyVoltage float64
-	CurrentAmps   float64
-	PowerWatts    float64
-}
+	// Optionally synchronize the reads with the conversions of the sensor, instead of sampling on a timer
+	var waiter *conversionWaiter
+	switch trigger := getStringOr(configuration, "sample-trigger", "timer"); trigger {
+	case "timer":
+	case "conversion":
+		if getFloatOr(configuration, "skip-init", 0) != 0 {
+			return fmt.Errorf("sample-trigger %q needs to configure the alert function, which skip-init does not allow", trigger)
+		}
+		debounce := time.Duration(getFloatOr(configuration, "alert-debounce-us", 10)) * time.Microsecond
+		if conversionPeriod == 0 {
+			return fmt.Errorf("sample-trigger %q needs the chip to convert continuously", trigger)
+		}
+		waiter, err = newConversionWaiter(ina226, getStringOr(configuration, "alert-gpio", ""), debounce, max(conversionWaitTimeout, 2*conversionPeriod))
+		if err != nil {
+			return err
+		}
+		log.Info().Float64("samplesPerSecond", maxRate).Dur("conversionPeriod", conversionPeriod).Msg("Sampling every conversion")
+	default:
+		return fmt.Errorf("invalid sample-trigger %q, must be \"timer\" or \"conversion\"", trigger)
+	}
 
-func (ina *INA226) ReadSensorData() (*CurrentSensorOutput, error) {
-	// Read bus voltage
-	voltage, err := ina.ReadBusVoltage()
-	if err != nil {
-		return nil, fmt.Errorf("failed to read bus voltage: %v", err)
+	// Optionally latch alerts, which are then cleared by the service or by an external controller
+	var alerts *alertMonitor
+	if getFloatOr(configuration, "alert-latch", 0) != 0 {
+		if getFloatOr(configuration, "skip-init", 0) != 0 {
+			return fmt.Errorf("alert-latch needs to configure the alert function, which skip-init does not allow")
+		}
+		autoClear := getFloatOr(configuration, "alert-auto-clear", 1) != 0
+		if !autoClear && waiter != nil {
+			return fmt.Errorf("alert-auto-clear 0 cannot be combined with sample-trigger \"conversion\", which clears the alert for every sample")
+		}
+		var pin gpio.PinIn
+		if waiter != nil && waiter.pin != nil {
+			pin = waiter.pin
+		} else if name := getStringOr(configuration, "alert-gpio", ""); name != "" {
+			pin = openAlertPin(name)
+		}
+		alerts, err = newAlertMonitor(ina226, autoClear, pin)
+		if err != nil {
+			return fmt.Errorf("failed to enable the alert latch: %v", err)
+		}
 	}
 
-	// Read current
-	current, err := ina.ReadCurrent()
+	// Reading all registers takes a few dozen transactions, so only do so when it will be logged
+	if zerolog.GlobalLevel() <= zerolog.DebugLevel {
+		log.Debug().Msg("Chip state at startup:\n" + ina226.DumpState())
+	}
+
+	// Optionally store all samples in an SQLite database for querying afterwards
+	if path := getStringOr(configuration, "sqlite-path", ""); path != "" {
+		batchRows := int(getFloatOr(configuration, "sqlite-batch-rows", 100))
+		batchInterval := time.Duration(getFloatOr(configuration, "sqlite-batch-ms", 1000)) * time.Millisecond
+		sqlite, err = newSQLiteSink(path, batchRows, batchInterval)
+		if err != nil {
+			return err
+		}
+		defer sqlite.Close()
+		log.Info().Str("path", path).Msg("Writing samples to sqlite database")
+	}
+
+	// Optionally compact the JSON samples for bandwidth-limited links
+	decimals := getFloatOr(configuration, "json-decimals", -1)
+	if decimals != math.Trunc(decimals) || decimals < -1 || decimals > 15 {
+		return fmt.Errorf("json-decimals must be an integer between 0 and 15, or -1 for full precision, got %v", decimals)
+	}
+	sampleEncoding = compactEncoding{decimals: int(decimals), omitEmpty: getFloatOr(configuration, "json-omit-empty", 0) != 0}
+	sampleSchemaVersion, err = readSchemaVersion(getFloatOr(configuration, "schema-version", currentSchemaVersion))
 	if err != nil {
-		return nil, fmt.Errorf("failed to read current: %v", err)
+		return err
+	}
+
+	// Optionally publish samples to an MQTT broker, alongside or instead of the roverlib stream
+	if broker := getStringOr(configuration, "mqtt-broker", ""); broker != "" {
+		topic := getStringOr(configuration, "mqtt-topic", "rover/energy")
+		mode := getStringOr(configuration, "mqtt-publish-mode", "absolute")
+		if mode != "absolute" && mode != "delta" {
+			return fmt.Errorf("invalid mqtt-publish-mode %q, must be \"absolute\" or \"delta\"", mode)
+		}
+		keyframeInterval := time.Duration(getFloatOr(configuration, "mqtt-keyframe-seconds", 10) * float64(time.Second))
+		mqttPublisher, err = newMQTTSink(broker, topic, fmt.Sprintf("energy-%d", os.Getpid()), mode == "delta", keyframeInterval)
+		if err != nil {
+			return err
+		}
+		defer mqttPublisher.Close()
+		log.Info().Str("broker", broker).Str("topic", topic).Msg("Publishing samples to mqtt")
+	}
+
+	// Optionally stream samples as JSON lines to local clients
+	if path := getStringOr(configuration, "unix-socket-path", ""); path != "" {
+		socketSink, err = newUnixSocketSink(path)
+		if err != nil {
+			return err
+		}
+		defer socketSink.Close()
+		log.Info().Str("path", path).Msg("Streaming samples on unix socket")
+	}
+
+	// Optionally write samples to InfluxDB, identified by the same labels as the metrics
+	if endpoint := getStringOr(configuration, "influx-url", ""); endpoint != "" {
+		flushSeconds := getFloatOr(configuration, "influx-flush-seconds", 1)
+		if flushSeconds <= 0 {
+			return fmt.Errorf("influx-flush-seconds must be positive, got %v", flushSeconds)
+		}
+		influx, err = newInfluxSink(endpoint, getStringOr(configuration, "influx-token", ""),
+			getStringOr(configuration, "influx-measurement", "energy"),
+			[]label{{"sensor", fmt.Sprint(sensorID)}, {"rail", sensorName}},
+			time.Duration(flushSeconds*float64(time.Second)))
+		if err != nil {
+			return err
+		}
+		defer influx.Close()
+		log.Info().Str("url", endpoint).Msg("Writing samples to influx")
+	}
+	publishStream := getFloatOr(configuration, "stream-enabled", 1) != 0
+
+	// Status events are published on the same stream as the measurements
+	var statusStream *roverlib.WriteStream
+	if publishStream {
+		statusStream = writeStream
+	}
+	faults.setStream(statusStream)
+
+	// Sensor boards can be swapped live, after which the new sensor is set up without a restart
+	hotswap := newHotswapMonitor(ina226, int(getFloatOr(configuration, "sensor-lost-after-failures", 5)),
+		func() {
+			faults.raise(faultSensorLost)
+			publishStatus(statusStream, statusSensorLost, "sensor-lost")
+		},
+		func() {
+			faults.clear(faultSensorLost)
+			stats.reconnected()
+			publishStatus(statusStream, statusOK, "sensor-swapped")
+			// The overrides are selected at startup, a swapped-in sensor of another revision keeps those
+			if revision, ok := ina226.DieRevision(); ok && haveStartRevision && revision != startRevision {
+				_, overridden := revisionOverrides[revision]
+				_, wasOverridden := revisionOverrides[startRevision]
+				event := log.Info()
+				if overridden || wasOverridden {
+					event = log.Warn()
+				}
+				event.Uint8("dieRevision", revision).Uint8("startDieRevision", startRevision).
+					Msg("The swapped-in sensor has another die revision, its die-revision-overrides only apply after a restart")
+			}
+		},
+	)
+
+	// Detect a chip that reset while running and set it up again, not possible when another controller owns the setup
+	var resets *resetDetector
+	if getFloatOr(configuration, "reset-detection", 1) != 0 && getFloatOr(configuration, "skip-init", 0) == 0 {
+		resets = newResetDetector(ina226, func() {
+			faults.record(faultCalibrationReset)
+			publishStatus(statusStream, statusOK, "sensor-reset")
+		})
+	}
+
+	// Optionally track the time spent in each current bucket, dumped on SIGUSR1 and at shutdown
+	if edges := getStringOr(configuration, "histogram-edges", ""); edges != "" {
+		parsed, err := parseHistogramEdges(edges)
+		if err != nil {
+			return err
+		}
+		histogram = newCurrentHistogram(parsed)
+
+		dumpSignal := make(chan os.Signal, 1)
+		signal.Notify(dumpSignal, syscall.SIGUSR1)
+		go func() {
+			for range dumpSignal {
+				histogram.dump()
+			}
+		}()
+	}
+
+	// Optionally mark the transitions between discharging and charging (regeneration)
+	var regen *regenDetector
+	if getFloatOr(configuration, "regen-markers", 0) != 0 {
+		regen = newRegenDetector(
+			getFloatOr(configuration, "regen-deadband-amps", 0.05),
+			time.Duration(getFloatOr(configuration, "regen-debounce-ms", 100))*time.Millisecond,
+		)
 	}
 
-	// Read power
-	power, err := ina.ReadPower()
+	accumulator := &energyAccumulator{
+		deadbandAmps: getFloatOr(configuration, "accumulation-deadband-amps", 0),
+	}
+	trendWindow := getFloatOr(configuration, "power-trend-seconds", 60)
+	if trendWindow < 2 {
+		return fmt.Errorf("power-trend-seconds must be at least 2, got %v", trendWindow)
+	}
+	trend := newPowerTrend(time.Duration(trendWindow * float64(time.Second)))
+	runtime, err := readRuntimeEstimator(configuration)
+	if err != nil {
+		return err
+	}
+	soc, err := readSOCEstimator(configuration)
+	if err != nil {
+		return err
+	}
+	// Optionally read the state of charge from a fuel gauge IC, which is preferred over the software estimate
+	gauge, err := openFuelGauge(configuration, openBus)
+	if err != nil {
+		return err
+	}
+	var charge *chargeSelector
+	if gauge != nil {
+		defer gauge.Close()
+		sources := []ChargeSource{&throttledChargeSource{ChargeSource: gauge, interval: time.Second}}
+		if soc != nil {
+			sources = append(sources, softwareChargeSource{estimator: soc})
+		}
+		charge = newChargeSelector(sources...)
+		log.Info().Str("chip", gauge.Name()).Bool("softwareFallback", soc != nil).Msg("Reading the state of charge from a fuel gauge")
+	}
+	efficiency, err := readEfficiencyMeter(configuration)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read power: %v", err)
+		return err
 	}
 
-	return &CurrentSensorOutput{
-		SupplyVoltage: voltage,
-		CurrentAmps:   current,
-		PowerWatts:    power,
-	}, nil
-}
+	// Warn when the calibration range is too small for the current that is actually drawn
+	clipping := newClipDetector(getFloatOr(configuration, "clip-warn-fraction", 0.01))
+	shuntSaturation := newShuntSaturationDetector(getFloatOr(configuration, "shunt-warn-fraction", 0))
+	calibrationCheck := newCalibrationChecker(getFloatOr(configuration, "calibration-check-tolerance", 0))
 
-func run(service roverlib.Service, configuration *roverlib.ServiceConfiguration) error {
-	log.Info().Msg("Hello testing")
+	// Optionally suggest the calibration range that fits the observed current, at shutdown and periodically
+	if getFloatOr(configuration, "calibration-advice", 1) != 0 {
+		advisor = newCalibrationAdvisor(cal)
+		if minutes := getFloatOr(configuration, "calibration-advice-minutes", 0); minutes > 0 {
+			go func() {
+				for range time.Tick(time.Duration(minutes * float64(time.Minute))) {
+					advisor.advise()
+				}
+			}()
+		}
+	}
 
-	// From the service.yaml, read the configuration value for the update-frequency
-	// of the service.
-	if configuration == nil {
-		return fmt.Errorf("configuration cannot be accessed")
+	// Optionally switch between a high-resolution and a high-range calibration depending on the load
+	var ranger *autoRanger
+	if getFloatOr(configuration, "auto-range", 0) != 0 {
+		if getFloatOr(configuration, "skip-init", 0) != 0 {
+			return fmt.Errorf("auto-range needs to write the calibration register, which skip-init does not allow")
+		}
+		ranger, err = newAutoRanger(ina226, cal, getFloatOr(configuration, "auto-range-low-max-amps", cal.MaxCurrentAmps/8),
+			int(getFloatOr(configuration, "auto-range-hold-samples", 10)))
+		if err != nil {
+			return err
+		}
 	}
 
-	// We publish measurements to the energy output stream
-	writeStream := service.GetWriteStream("energy")
-	if writeStream == nil {
-		return fmt.Errorf("failed to create write stream 'energy'")
+	// Only read the registers that are needed, the shunt voltage costs an extra read so it is only read when used
+	plan := NewReadPlan(fieldMask, powerSource)
+	plan.ShuntVoltage = plan.ShuntVoltage || shuntSaturation.enabled() || calibrationCheck.enabled()
+	ina226.SetReadPlan(plan)
+	ina226.SetIncludeRaw(getFloatOr(configuration, "include-raw", 0) != 0)
+
+	// Reused for every sample to avoid allocating at high sample rates
+	data := &CurrentSensorOutput{}
+
+	// Measures the achieved sample rate, which real I2C latency keeps below the target
+	rates := newRateMonitor(time.Duration(getFloatOr(configuration, "rate-log-seconds", 60)*float64(time.Second)),
+		getFloatOr(configuration, "rate-warn-percent", 10)/100, getFloatOr(configuration, "rate-change-log-factor", 2))
+
+	// Whether the accumulated totals continue when a lost sensor is reconnected, or start from zero
+	warmRestart := getFloatOr(configuration, "warm-restart", 1) != 0
+
+	// Repeated read errors (e.g. while the bus is unplugged) are collapsed into a periodic summary
+	readErrors := newRepeatedErrorLog(time.Duration(getFloatOr(configuration, "read-error-log-seconds", 10) * float64(time.Second)))
+
+	// For fixed-duration tests, the run stops by itself after max-run-seconds (0 runs forever)
+	maxRun := time.Duration(getFloatOr(configuration, "max-run-seconds", 0) * float64(time.Second))
+	stats = newRunStats(getStringOr(configuration, "run-summary-path", ""), ina226.BusReopens)
+
+	// Incoming inspection of a sensor board, runs at the rate at startup and stops with a verdict
+	burn, err := readBurnIn(configuration, getFloatOr(configuration, "updates-per-second", defaultUpdatesPerSecond))
+	if err != nil {
+		return err
 	}
 
-	// Initialize periph.io
-	if _, err := host.Init(); err != nil {
-		log.Error().Msgf("failed to initialize periph: %v", err)
+	// Optionally continue the totals from a previous run, so that they survive a crash-restart
+	if path := getStringOr(configuration, "accumulator-state-path", ""); path != "" {
+		interval := time.Duration(getFloatOr(configuration, "accumulator-save-seconds", 60) * float64(time.Second))
+		persister = newStatePersister(path, interval)
+		state := persister.load()
+		accumulator.restore(state.EnergyWh, state.ChargeAh)
+		stats.restorePeaks(state.PeakAmps, state.PeakWatts)
+		defer persister.save()
+	}
+
+	// Exit when the loop hangs, rather than appearing alive without producing samples
+	var dog *watchdog
+	if stall := getFloatOr(configuration, "watchdog-stall-seconds", 10); stall > 0 {
+		dog = newWatchdog(time.Duration(stall * float64(time.Second)))
+		go dog.run()
+	}
+
+	// Optionally signal a low battery from the bus voltage, so that downstream services can shut down safely
+	var battery *lowBatteryDetector
+	if lowVolts := getFloatOr(configuration, "low-battery-volts", 0); lowVolts > 0 {
+		criticalVolts := getFloatOr(configuration, "critical-battery-volts", 0)
+		if criticalVolts >= lowVolts {
+			return fmt.Errorf("critical-battery-volts (%v) must be below low-battery-volts (%v)", criticalVolts, lowVolts)
+		}
+		battery = newLowBatteryDetector(lowVolts, criticalVolts,
+			time.Duration(getFloatOr(configuration, "low-battery-debounce-ms", 5000))*time.Millisecond)
+	}
+
+	// Optional corrections of the published values, for integrator quirks
+	corrections := readOutputCorrections(configuration, overrides)
+
+	// Optional explicitly ordered transforms of the published values, applied after the corrections
+	var transforms *transformPipeline
+	if spec := getStringOr(configuration, "transforms", ""); spec != "" {
+		transforms, err = parseTransforms(spec)
+		if err != nil {
+			return fmt.Errorf("invalid transforms: %v", err)
+		}
+		log.Info().Str("stages", transforms.String()).Msg("Transforming the published samples")
 	}
 
-	// Open I2C bus
-	bus, err := i2creg.Open("5")
+	// What to publish when a read fails
+	gapPolicy, err := readGapFillPolicy(configuration)
 	if err != nil {
-		log.Error().Msgf("failed to open I2C bus: %v", err)
+		return err
+	}
+	gaps := newGapFiller(gapPolicy)
+
+	// Optionally publish a low-rate summary of the raw samples alongside them
+	var aggregator *sampleAggregator
+	if seconds := getFloatOr(configuration, "aggregate-seconds", 0); seconds > 0 {
+		aggregator = newSampleAggregator(time.Duration(seconds * float64(time.Second)))
+	}
+	// Publishes a JSON document besides the samples: with the key on the output stream, on <mqtt-topic>/<key>,
+	// and as a {"<key>":...} line on the Unix domain socket
+	publishDocument := func(key string, payload []byte) {
+		publishJSON(statusStream, key, payload)
+		if mqttPublisher != nil {
+			mqttPublisher.PublishTo(key, payload, false)
+		}
+		if socketSink != nil {
+			socketSink.WriteLine(append(append([]byte(`{"`+key+`":`), payload...), "}\n"...))
+		}
+	}
+	publishAggregate := func(aggregate *sampleAggregate) {
+		payload, err := json.Marshal(aggregate)
+		if err != nil {
+			log.Warn().Msgf("unable to encode summary: %v", err)
+			return
+		}
+		publishDocument("summary", payload)
+	}
+
+	// Optional threshold rules, which dispatch their actions when they trigger or clear
+	var rules *ruleEngine
+	if spec := getStringOr(configuration, "threshold-rules", ""); spec != "" {
+		rules, err = parseThresholdRules(spec, map[string]func(ruleEvent){
+			"log": func(e ruleEvent) {
+				if e.Triggered {
+					log.Warn().Str("rule", e.Rule).Float64("value", e.Value).Float64("limit", e.Limit).Msg("Threshold rule triggered")
+				} else {
+					log.Info().Str("rule", e.Rule).Float64("value", e.Value).Float64("limit", e.Limit).Msg("Threshold rule cleared")
+				}
+			},
+			"status": func(e ruleEvent) {
+				if e.Triggered {
+					publishStatus(statusStream, statusOK, "rule:"+e.Rule)
+				} else {
+					publishStatus(statusStream, statusOK, "rule-cleared:"+e.Rule)
+				}
+			},
+			"publish": func(e ruleEvent) {
+				payload, err := json.Marshal(e)
+				if err != nil {
+					log.Warn().Msgf("unable to encode rule event: %v", err)
+					return
+				}
+				publishDocument("rule", payload)
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("invalid threshold-rules: %v", err)
+		}
+	}
+
+	// Optional event markers that are set externally through the HTTP endpoints
+	var tagger *eventTagger
+	if getStringOr(configuration, "http-listen", "") != "" {
+		samples := getFloatOr(configuration, "tag-samples", 1)
+		if samples < 1 || samples != math.Trunc(samples) {
+			return fmt.Errorf("tag-samples must be a positive integer, got %v", samples)
+		}
+		tagger = newEventTagger(int(samples))
+		registerTagEndpoints(tagger, func(event string) { publishStatus(statusStream, statusOK, event) })
+		registerReadEndpoint(ina226, corrections)
 	}
-	defer bus.Close()
 
-	// Create a new INA226 instance
-	ina226, err := NewINA226(bus)
+	// Optionally add a monotonic timestamp next to the wall clock timestamp
+	monotonicTimestamps := getFloatOr(configuration, "monotonic-timestamps", 0) != 0
+	serviceStart := time.Now()
+	// Taken from the timestamps of the reads, which still carry the monotonic clock reading, since the grid
+	// timestamps of the interpolation do not
+	stampMonotonic := func(sample *CurrentSensorOutput) {
+		if monotonicTimestamps {
+			sample.MonotonicNanos = sample.Timestamp.Sub(serviceStart).Nanoseconds()
+		}
+	}
+
+	// Optionally publish a heartbeat at a fixed interval, regardless of the samples
+	var beat *heartbeat
+	if seconds := getFloatOr(configuration, "heartbeat-seconds", 0); seconds > 0 {
+		beat = newHeartbeat(time.Duration(seconds*float64(time.Second)), serviceStart, func(payload []byte) { publishDocument("heartbeat", payload) })
+		go beat.run()
+	}
+
+	// Every published sample is written to all enabled sinks
+	var stream *streamSink
+	if publishStream {
+		binaryStream, err := readStreamEncoding(getStringOr(configuration, "stream-encoding", "protobuf"))
+		if err != nil {
+			return err
+		}
+		stream = &streamSink{stream: writeStream, sensorID: sensorID, battery: battery, binary: binaryStream}
+	}
+	sampleSinks, err := readSampleSinks(configuration, stream, []label{{"sensor", fmt.Sprint(sensorID)}, {"rail", sensorName}})
 	if err != nil {
-		log.Error().Msgf("%v", err)
+		return err
+	}
+	if csvSink != nil {
+		defer csvSink.Close()
+	}
+
+	// Publishes a sample to all enabled sinks and the sample callbacks, read is set for the sample of the last read
+	publish := func(sample *CurrentSensorOutput, read bool) {
+		sample.Faults = faults.activeCodes()
+		if corrections != nil {
+			corrected := corrections.apply(sample)
+			sample = &corrected
+		}
+		// Gap samples hold no new measurements, so they do not advance the filters either
+		if transforms != nil && !sample.Stale {
+			transformed := transforms.apply(sample)
+			sample = &transformed
+		}
+		// Held gap samples repeat the values that were published last, neither corrected nor transformed again
+		if !sample.Stale {
+			gaps.remember(sample)
+		}
+		if tagger != nil {
+			if tag := tagger.next(); tag != "" {
+				tagged := *sample
+				tagged.Tag = tag
+				sample = &tagged
+			}
+		}
+		for _, sink := range sampleSinks {
+			if err := sink.Write(sample); err != nil {
+				log.Warn().Str("sink", sink.Name()).Msgf("unable to publish sample: %v", err)
+			}
+		}
+		ina226.DispatchSample(sample, read)
+	}
+
+	// Optionally publish samples at exact grid timestamps instead of the raw read times
+	var interpolator *gridInterpolator
+	if gridMs := getFloatOr(configuration, "interpolate-grid-ms", 0); gridMs > 0 {
+		interpolator = newGridInterpolator(time.Duration(gridMs * float64(time.Millisecond)))
+	}
+
+	// Optionally only publish the samples in which an event occurs, plus a heartbeat
+	var events *eventTrigger
+	if getFloatOr(configuration, "event-mode", 0) != 0 {
+		if interpolator != nil || gapPolicy != gapFillSkip {
+			return fmt.Errorf("event-mode publishes no periodic samples, so it cannot be combined with interpolate-grid-ms or gap-fill")
+		}
+		events = newEventTrigger(
+			getFloatOr(configuration, "event-overcurrent-amps", 0),
+			getFloatOr(configuration, "event-undervoltage-volts", 0),
+			getFloatOr(configuration, "event-delta-amps", 0),
+			time.Duration(getFloatOr(configuration, "event-heartbeat-seconds", 10)*float64(time.Second)),
+		)
+	}
+
+	sinks := []string{}
+	for _, sink := range sampleSinks {
+		sinks = append(sinks, sink.Name())
+	}
+	if getStringOr(configuration, "http-listen", "") != "" {
+		sinks = append(sinks, "http")
+	}
+	logStartupBanner(ina226, opener, configuration, sinks)
+
+	// Describes this sensor to downstream tooling, announced at startup and whenever the sample rate is tuned
+	announceCapabilities := func(samplesPerSecond float64) {
+		effectiveCal := ina226.EffectiveCalibration()
+		err := announcedCapabilities.set(sensorCapabilities{
+			SensorID:         sensorID,
+			SensorName:       sensorName,
+			Version:          version,
+			SchemaVersion:    sampleSchemaVersion,
+			Fields:           fieldMask.Names(),
+			Units:            capabilitiesUnits(units),
+			SamplesPerSecond: samplesPerSecond,
+			PowerSource:      powerSource,
+			// In terms of the fitted shunt and the current mode, as the published readings are
+			Calibration: capabilitiesCalibration{
+				ShuntOhms:      effectiveCal.ShuntOhms,
+				MaxCurrentAmps: effectiveCal.MaxCurrentAmps,
+				CurrentLSB:     effectiveCal.CurrentLSB,
+				PowerLSB:       effectiveCal.PowerLSB,
+			},
+			AutoRange: ranger != nil,
+		})
+		if err != nil {
+			log.Warn().Msgf("unable to encode capabilities: %v", err)
+			return
+		}
+		publishJSON(statusStream, "capabilities", announcedCapabilities.get())
+		if mqttPublisher != nil {
+			mqttPublisher.PublishCapabilities()
+		}
 	}
 
+	warnedFrequency := 0.0
+	announcedRate := 0.0
+	readFirst := getFloatOr(configuration, "read-first", 0) != 0
+	// Re-reads updates-per-second while sleeping, keeping the current rate when it cannot be read
+	rereadFrequency := func() float64 {
+		if burn != nil {
+			return burn.rate
+		}
+		if configuration == nil {
+			return defaultUpdatesPerSecond
+		}
+		frequency, err := configuration.GetFloat("updates-per-second")
+		if err != nil {
+			return 0
+		}
+		if limitToConversions && waiter == nil && maxRate > 0 {
+			frequency = min(frequency, maxRate)
+		}
+		return frequency
+	}
+	kickDog := func(period time.Duration) {
+		if dog != nil {
+			dog.kick(period)
+		}
+	}
 	for {
+		if maxRun > 0 && time.Since(stats.start) >= maxRun {
+			log.Info().Dur("maxRun", maxRun).Msg("Maximum run duration reached, stopping")
+			stats.report()
+			if advisor != nil {
+				advisor.advise()
+			}
+			if histogram != nil {
+				histogram.dump()
+			}
+			// The sinks are flushed and closed by the deferred calls
+			return nil
+		}
+		if burn != nil && burn.done() {
+			stats.report()
+			if !burn.report() {
+				// A non-zero exit status, for automated inspection
+				return fmt.Errorf("burn-in failed")
+			}
+			return nil
+		}
+
 		// Fetch in the loop to make it possible to tune
-		updateFrequency, err := configuration.GetFloat("updates-per-second")
-		if err != nil {
-			return fmt.Errorf("unable to read configuration: %v", err)
+		updateFrequency := float64(defaultUpdatesPerSecond)
+		if configuration != nil {
+			updateFrequency, err = configuration.GetFloat("updates-per-second")
+			if err != nil {
+				return fmt.Errorf("unable to read configuration: %v", err)
+			}
+		}
+		if burn != nil {
+			// The drift is only comparable at a fixed rate, retuning is ignored during the burn-in
+			updateFrequency = burn.rate
+		}
+		if waiter == nil && maxRate > 0 && updateFrequency > maxRate {
+			if updateFrequency != warnedFrequency {
+				// Warn once per (tuned) value, faster sampling only returns duplicates of the same conversion
+				event := log.Warn().Float64("updatesPerSecond", updateFrequency).Float64("maxSamplesPerSecond", maxRate).Int("averaging", averaging)
+				if limitToConversions {
+					event.Msgf("updates-per-second is faster than the chip produces fresh conversions, reading at %.1f Hz instead", maxRate)
+				} else {
+					event.Msgf("updates-per-second is faster than the chip produces fresh conversions, samples will be duplicated; set it to at most %.1f Hz, lower the averaging or set limit-to-conversion-rate", maxRate)
+				}
+				warnedFrequency = updateFrequency
+			}
+			if limitToConversions {
+				updateFrequency = maxRate
+			}
+		}
+		if waiter == nil {
+			rates.retune(updateFrequency)
+		}
+
+		// The rate at which samples are published
+		rate := updateFrequency
+		if waiter != nil {
+			rate = maxRate
+		}
+		if interpolator != nil {
+			rate = float64(time.Second) / float64(interpolator.period)
+		}
+		if rate != announcedRate {
+			announceCapabilities(rate)
+			announcedRate = rate
+		}
+
+		if waiter != nil && !hotswap.isLost() {
+			// Read every conversion as soon as it is ready, instead of on a timer
+			if dog != nil {
+				dog.kick(waiter.timeout)
+			}
+			if err := waiter.wait(); err != nil {
+				readErrors.failed(fmt.Sprintf("Failed to wait for a conversion: %v", err))
+				metricReadErrors.Add(1)
+				hotswap.readFailed()
+				continue
+			}
+		} else {
+			sleepStart := time.Now()
+			kickDog(time.Duration(float64(time.Second) / updateFrequency))
+			if readFirst {
+				// Take the first sample right away, the period is waited for after it
+				readFirst = false
+			} else {
+				// A retuned rate applies within the period, rather than after the remainder of the old one
+				updateFrequency = sleepPeriod(sleepStart, updateFrequency, rereadFrequency, kickDog)
+				if waiter == nil {
+					rates.retune(updateFrequency)
+				}
+			}
+			// time.Sleep(1 * time.Millisecond)
+		}
+
+		// While the sensor is gone, only probe for it to come back
+		if hotswap.isLost() {
+			if hotswap.probe() {
+				accumulator.reconnected(warmRestart)
+			}
+			continue
 		}
-		sleepSeconds := 1.0 / updateFrequency
-		time.Sleep(time.Duration(sleepSeconds * float64(time.Second)))
-		// time.Sleep(1 * time.Millisecond)
 
 		// Read sensor data
-		data, err := ina226.ReadSensorData()
-		if err != nil {
-			log.Error().Msgf("Failed to read sensor data: %v", err)
-		}
-
-		// We build the output message that that is serialized with protobuf
-		// outputMsg := pb_outputs.SensorOutput{
-		// 	Timestamp: uint64(time.Now().UnixMilli()),
-		// 	Status:    0,
-		// 	SensorId:  1,
-		// 	SensorOutput: &pb_outputs.SensorOutput_EnergyOutput{
-		// 		EnergyOutput: &pb_outputs.EnergySensorOutput{
-		// 			CurrentAmps:   float32(data.CurrentAmps),
-		// 			SupplyVoltage: float32(data.SupplyVoltage),
-		// 			PowerWatts:    float32(data.PowerWatts),
-		// 		},
-		// 	},
-		// }
-
-		timestamp := time.Now().Format("15:04:05") 
-		log.Info().Msgf("[%s] Amps: %.3f Volts: %.3f Watts: %.3f",
-			timestamp,data.CurrentAmps,data.SupplyVoltage,data.PowerWatts)
-
-		// Publish the data
-		// err = writeStream.Write(&outputMsg)
-		// if err != nil {
-		// 	log.Warn().Msgf("unable to publish data: %v", err)
-		// }
+		err = ina226.ReadSensorDataInto(data)
+		if err != nil {
+			readErrors.failed(fmt.Sprintf("Failed to read sensor data: %v", err))
+			metricReadErrors.Add(1)
+			faults.raise(faultReadFailed)
+			stats.readFailed()
+			hotswap.readFailed()
+			// Gap samples bypass the interpolation, they are not measurements
+			if sample := gaps.fill(time.Now()); sample != nil {
+				stampMonotonic(sample)
+				publish(sample, false)
+			}
+			continue
+		}
+		hotswap.readSucceeded()
+		readErrors.succeeded()
+		stampMonotonic(data)
+		if waiter != nil {
+			rates.observe(data.Timestamp, maxRate)
+		} else {
+			rates.observe(data.Timestamp, updateFrequency)
+		}
+		faults.clear(faultReadFailed)
+		if resets != nil && resets.observe(data) {
+			continue
+		}
+		alerted := false
+		if alerts != nil {
+			alerted = alerts.observe()
+		}
+		if ranger != nil {
+			ranger.observe(data)
+		}
+		if shuntSaturation.enabled() {
+			// Observed before the field mask is applied, since the shunt voltage may only be read for this
+			shuntSaturation.observe(data.Timestamp, data.ShuntVoltage, ina226.EffectiveCalibration())
+		}
+		if calibrationCheck.enabled() {
+			calibrationCheck.observe(data.Timestamp, data.CurrentAmps+ina226.CurrentOffset(), data.ShuntVoltage, ina226.EffectiveCalibration())
+		}
+		fieldMask.apply(data)
+		clipping.observe(data.Timestamp, data.CurrentAmps, ina226.EffectiveCalibration())
+		if advisor != nil {
+			advisor.observe(data.CurrentAmps)
+		}
+		if burn != nil {
+			burn.observe(data)
+		}
+		accumulator.add(data)
+		trend.add(data)
+		if runtime != nil {
+			runtime.add(data)
+		}
+		if soc != nil {
+			soc.add(data)
+		}
+		if charge != nil {
+			charge.apply(data)
+		}
+		if efficiency != nil {
+			efficiency.apply(data)
+		}
+		units.apply(data)
+		stats.add(data)
+		updateSampleMetrics(data)
+		if persister != nil {
+			persister.update(accumulatorState{
+				EnergyWh:  data.EnergyWh,
+				ChargeAh:  data.ChargeAh,
+				PeakAmps:  stats.peakAmps,
+				PeakWatts: stats.peakWatts,
+			})
+		}
+		if regen != nil {
+			if event := regen.observe(data); event != "" {
+				log.Info().Float64("currentAmps", data.CurrentAmps).Str("event", event).Msg("Current direction changed")
+				publishStatus(statusStream, statusOK, event)
+			}
+		}
+		if histogram != nil {
+			histogram.add(data)
+		}
+		if battery != nil {
+			if event := battery.observe(data); event != "" {
+				log.Warn().Float64("supplyVoltage", data.SupplyVoltage).Str("event", event).Msg("Battery level changed")
+				publishStatus(statusStream, battery.status(), event)
+				if battery.status() == statusOK {
+					faults.clear(faultUndervoltage)
+				} else {
+					faults.raise(faultUndervoltage)
+				}
+			}
+		}
+		if rules != nil {
+			rules.observe(data)
+		}
+
+		timestamp := time.Now().Format("15:04:05")
+		log.Info().Msgf("[%s] Amps: %.3f Volts: %.3f Watts: %.3f Energy: %.3f %s Charge: %.3f %s",
+			timestamp, data.CurrentAmps, data.SupplyVoltage, data.PowerWatts, data.Energy, data.EnergyUnit, data.Charge, data.ChargeUnit)
+
+		if aggregator != nil {
+			if aggregate := aggregator.add(data); aggregate != nil {
+				publishAggregate(aggregate)
+			}
+		}
+		if beat != nil {
+			beat.update(data)
+		}
+		if events != nil {
+			if data.Trigger = events.check(data, alerted); data.Trigger == "" {
+				continue
+			}
+		}
+		if interpolator != nil {
+			grid := interpolator.add(data)
+			for i := range grid {
+				publish(&grid[i], false)
+			}
+		} else {
+			publish(data, true)
+		}
 	}
 }
 
 // When the service is stopped externally, this function is called.
-// Currently, there are no clean up routines.
+// Pending samples are flushed, so that they are not lost on termination.
 func onTerminate(sig os.Signal) error {
 	log.Info().Str("signal", sig.String()).Msg("Terminating service")
+	if stats != nil {
+		stats.report()
+	}
+	if advisor != nil {
+		advisor.advise()
+	}
+	if histogram != nil {
+		histogram.dump()
+	}
+	if persister != nil {
+		if err := persister.save(); err != nil {
+			log.Warn().Msgf("unable to save accumulator state: %v", err)
+		}
+	}
+	if mqttPublisher != nil {
+		mqttPublisher.Close()
+	}
+	if socketSink != nil {
+		socketSink.Close()
+	}
+	if csvSink != nil {
+		if err := csvSink.Close(); err != nil {
+			log.Warn().Msgf("unable to close csv file: %v", err)
+		}
+	}
+	if influx != nil {
+		if err := influx.Close(); err != nil {
+			log.Warn().Msgf("unable to write the last samples to influx: %v", err)
+		}
+	}
+	if sqlite != nil {
+		return sqlite.Close()
+	}
 	return nil
 }
 
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A single metric, exported in the Prometheus text format. Its value is either set by the service,
+// or read from a function at scrape time (e.g. for counters that are kept by the driver).
+type metric struct {
+	name   string
+	help   string
+	kind   string // "gauge" or "counter"
+	labels []label
+	bits   atomic.Uint64
+	value  func() float64
+}
+
+type label struct {
+	name  string
+	value string
+}
+
+// Formats labels as {name="value",...}, escaped as required by the text format
+func formatLabels(labels []label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		parts[i] = fmt.Sprintf(`%s="%s"`, l.name, escaper.Replace(l.value))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (m *metric) Set(v float64) {
+	m.bits.Store(math.Float64bits(v))
+}
+
+func (m *metric) Add(v float64) {
+	for {
+		old := m.bits.Load()
+		if m.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (m *metric) Get() float64 {
+	if m.value != nil {
+		return m.value()
+	}
+	return math.Float64frombits(m.bits.Load())
+}
+
+// All metrics of the service, served on /metrics when http-listen is configured
+type metricsRegistry struct {
+	metrics []*metric
+	// Added to every metric, to distinguish the sensors in a multi-sensor deployment
+	labels []label
+	lock   sync.Mutex
+}
+
+var metrics = &metricsRegistry{}
+
+func (r *metricsRegistry) register(m *metric) *metric {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+func (r *metricsRegistry) gauge(name string, help string) *metric {
+	return r.register(&metric{name: name, help: help, kind: "gauge"})
+}
+
+func (r *metricsRegistry) counter(name string, help string) *metric {
+	return r.register(&metric{name: name, help: help, kind: "counter"})
+}
+
+func (r *metricsRegistry) counterFunc(name string, help string, value func() float64) *metric {
+	return r.register(&metric{name: name, help: help, kind: "counter", value: value})
+}
+
+// Sets the labels that are added to every metric
+func (r *metricsRegistry) setLabels(labels ...label) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.labels = labels
+}
+
+// Registers the conventional build_info metric, which is always 1 and carries the version as a label
+func (r *metricsRegistry) buildInfo(name string, version string) {
+	m := r.register(&metric{
+		name:   name,
+		help:   "Build information of the service",
+		kind:   "gauge",
+		labels: []label{{"version", version}, {"goversion", runtime.Version()}},
+	})
+	m.Set(1)
+}
+
+// Calls fn for every metric, in registration order
+func (r *metricsRegistry) each(fn func(m *metric)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, m := range r.metrics {
+		fn(m)
+	}
+}
+
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	previous := ""
+	for _, m := range r.metrics {
+		// Metrics with the same name but different labels (registered one after the other) share the header
+		if m.name != previous {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+			previous = m.name
+		}
+		labels := formatLabels(append(append([]label{}, r.labels...), m.labels...))
+		fmt.Fprintf(w, "%s%s %g\n", m.name, labels, m.Get())
+	}
+}
+
+// The metrics that are updated for every sample
+var (
+	metricSupplyVoltage = metrics.gauge("rover_energy_supply_voltage_volts", "Bus (supply) voltage in volts")
+	metricCurrent       = metrics.gauge("rover_energy_current_amps", "Current in amps")
+	metricPower         = metrics.gauge("rover_energy_power_watts", "Power in watts")
+	metricEnergy        = metrics.gauge("rover_energy_energy_wh", "Cumulative energy since the service started in Wh")
+	metricCharge        = metrics.gauge("rover_energy_charge_ah", "Cumulative charge since the service started in Ah")
+	metricSamples       = metrics.counter("rover_energy_samples_total", "Number of successful sensor reads")
+	metricReadErrors    = metrics.counter("rover_energy_read_errors_total", "Number of failed sensor reads")
+)
+
+func updateSampleMetrics(sample *CurrentSensorOutput) {
+	metricSupplyVoltage.Set(sample.SupplyVoltage)
+	metricCurrent.Set(sample.CurrentAmps)
+	metricPower.Set(sample.PowerWatts)
+	metricEnergy.Set(sample.EnergyWh)
+	metricCharge.Set(sample.ChargeAh)
+	metricSamples.Add(1)
+}
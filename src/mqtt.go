@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Samples waiting to be published, if the broker cannot keep up newer samples are dropped
+	mqttQueueSize = 256
+	// Maximum time to wait for a single publish to be handed to the broker
+	mqttPublishTimeout = 500 * time.Millisecond
+	// Delay between attempts to (re)connect to the broker
+	mqttRetryInterval = 5 * time.Second
+)
+
+var metricMQTTDropped = metrics.counter("rover_energy_mqtt_dropped_total", "Number of samples that were not published to the mqtt broker, because the queue was full or the broker was unreachable")
+
+// Publishes samples as JSON to an MQTT broker. Publishing happens in a separate goroutine,
+// so that a slow or unreachable broker never stalls the sensor loop
+type mqttSink struct {
+	client mqtt.Client
+	topic  string
+	queue  chan []byte
+	// Samples dropped since the queue last accepted one, to log the drops once per outage
+	dropped int
+	// Encodes the samples as deltas, nil to publish absolute values
+	delta *deltaEncoder
+	wg    sync.WaitGroup
+	// The sink is closed from the termination handler, which runs concurrently with the loop
+	lock   sync.Mutex
+	closed bool
+}
+
+// Creates the sink, which publishes deltas with a keyframe every keyframeInterval if delta is set
+func newMQTTSink(broker string, topic string, clientID string, delta bool, keyframeInterval time.Duration) (*mqttSink, error) {
+	if topic == "" {
+		return nil, fmt.Errorf("mqtt-topic must be set when mqtt-broker is configured")
+	}
+
+	s := &mqttSink{
+		topic: topic,
+		queue: make(chan []byte, mqttQueueSize),
+	}
+	if delta {
+		s.delta = newDeltaEncoder(keyframeInterval)
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientID).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(mqttRetryInterval).
+		SetMaxReconnectInterval(mqttRetryInterval).
+		SetOnConnectHandler(func(mqtt.Client) {
+			log.Info().Str("broker", broker).Msg("Connected to mqtt broker")
+			s.resync()
+			s.PublishCapabilities()
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Warn().Str("broker", broker).Msgf("Lost connection to mqtt broker, reconnecting: %v", err)
+		})
+	s.client = mqtt.NewClient(opts)
+
+	// With connect retry enabled, this token only completes once connected, so we do not wait for it
+	s.client.Connect()
+
+	s.wg.Add(1)
+	go s.publish()
+	return s, nil
+}
+
+func (s *mqttSink) Name() string {
+	return "mqtt"
+}
+
+// Queues the sample for publishing, never blocks. A full queue drops the sample without an error, the drops are
+// counted in a metric and logged once per outage. Deltas are encoded here, so a message that is dropped or fails to
+// publish leaves a gap in the sequence numbers of the messages that were queued after it.
+func (s *mqttSink) Write(sample *CurrentSensorOutput) error {
+	var payload []byte
+	var err error
+	if s.delta != nil {
+		payload, err = marshalSample(s.delta.encode(sample))
+	} else {
+		payload, err = marshalSample(sample)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+
+	select {
+	case s.queue <- payload:
+		if s.dropped > 0 {
+			log.Info().Int("dropped", s.dropped).Msg("mqtt broker is keeping up again")
+			s.dropped = 0
+		}
+	default:
+		if s.dropped == 0 {
+			log.Warn().Msg("mqtt queue is full, dropping samples until the broker catches up")
+		}
+		s.dropped++
+		metricMQTTDropped.Add(1)
+		s.resync()
+	}
+	return nil
+}
+
+func (s *mqttSink) publish() {
+	defer s.wg.Done()
+
+	for payload := range s.queue {
+		// While disconnected, samples are discarded rather than buffered indefinitely
+		if !s.client.IsConnectionOpen() {
+			metricMQTTDropped.Add(1)
+			s.resync()
+			continue
+		}
+		token := s.client.Publish(s.topic, 0, false, payload)
+		if !token.WaitTimeout(mqttPublishTimeout) {
+			log.Debug().Msg("Timed out publishing sample to mqtt broker")
+			s.resync()
+		} else if token.Error() != nil {
+			log.Debug().Msgf("unable to publish sample to mqtt broker: %v", token.Error())
+			s.resync()
+		}
+	}
+}
+
+// Publishes the announced capabilities as a retained message on <topic>/capabilities, if connected. Does not
+// wait for the broker, since it is also called from the connect handler.
+func (s *mqttSink) PublishCapabilities() {
+	if payload := announcedCapabilities.get(); payload != nil {
+		s.PublishTo("capabilities", payload, true)
+	}
+}
+
+// Publishes a message on <topic>/<subtopic> if connected, without waiting for the broker. Used for the messages
+// besides the samples, which are published at a low rate and are not queued.
+func (s *mqttSink) PublishTo(subtopic string, payload []byte, retained bool) {
+	if !s.client.IsConnectionOpen() {
+		return
+	}
+	s.client.Publish(s.topic+"/"+subtopic, 1, retained, payload)
+}
+
+// Makes the next delta-encoded sample a keyframe, after consumers may have missed a sample. The deltas that are
+// already queued are still published, consumers skip them by their sequence number.
+func (s *mqttSink) resync() {
+	if s.delta != nil {
+		s.delta.resync()
+	}
+}
+
+// Publishes the queued samples and disconnects from the broker
+func (s *mqttSink) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.queue)
+	s.lock.Unlock()
+
+	s.wg.Wait()
+	s.client.Disconnect(uint(mqttPublishTimeout.Milliseconds()))
+	return nil
+}
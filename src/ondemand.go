@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Registers an endpoint (GET /read) that takes a single fresh sample and returns it as JSON, for test scripts
+// that need a reading at a precise moment. The sample is read in between the samples of the read loop, it is
+// not published, accumulated or stored.
+func registerReadEndpoint(ina *INA226, corrections *outputCorrections) {
+	httpMux.HandleFunc("GET /read", func(w http.ResponseWriter, _ *http.Request) {
+		sample, err := ina.ReadSensorDataNow()
+		if err != nil {
+			log.Warn().Msgf("unable to read an on-demand sample: %v", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if corrections != nil {
+			*sample = corrections.apply(sample)
+		}
+		payload, err := marshalSample(sample)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(payload)
+	})
+}
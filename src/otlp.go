@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Timeout of a single push to the collector
+const otlpPushTimeout = 5 * time.Second
+
+// Aggregation temporality of the counters, they are cumulative since the service started
+const otlpCumulative = 2
+
+// Pushes the metrics of a registry to an OpenTelemetry collector, using OTLP over HTTP with the JSON encoding.
+// The values are the same as the ones that are served to Prometheus; gauges become OTel gauges and counters
+// become monotonic cumulative sums. The identity of the sensor is sent as resource attributes.
+type otlpExporter struct {
+	registry  *metricsRegistry
+	url       string
+	interval  time.Duration
+	resource  []label
+	startTime time.Time
+	client    *http.Client
+}
+
+func newOTLPExporter(registry *metricsRegistry, endpoint string, interval time.Duration, resource []label) *otlpExporter {
+	return &otlpExporter{
+		registry:  registry,
+		url:       strings.TrimSuffix(endpoint, "/") + "/v1/metrics",
+		interval:  interval,
+		resource:  resource,
+		startTime: time.Now(),
+		client:    &http.Client{Timeout: otlpPushTimeout},
+	}
+}
+
+func (e *otlpExporter) run() {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := e.push(); err != nil {
+			log.Warn().Msgf("unable to push metrics over OTLP: %v", err)
+		}
+	}
+}
+
+// The subset of the OTLP metrics data model (opentelemetry/proto/metrics/v1) that is exported
+type (
+	otlpRequest struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource     otlpResource       `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpAttribute struct {
+		Key   string             `json:"key"`
+		Value otlpAttributeValue `json:"value"`
+	}
+	otlpAttributeValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	otlpScopeMetrics struct {
+		Scope   otlpScope    `json:"scope"`
+		Metrics []otlpMetric `json:"metrics"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpMetric struct {
+		Name        string     `json:"name"`
+		Description string     `json:"description"`
+		Gauge       *otlpGauge `json:"gauge,omitempty"`
+		Sum         *otlpSum   `json:"sum,omitempty"`
+	}
+	otlpGauge struct {
+		DataPoints []otlpDataPoint `json:"dataPoints"`
+	}
+	otlpSum struct {
+		DataPoints             []otlpDataPoint `json:"dataPoints"`
+		AggregationTemporality int             `json:"aggregationTemporality"`
+		IsMonotonic            bool            `json:"isMonotonic"`
+	}
+	otlpDataPoint struct {
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		AsDouble          float64         `json:"asDouble"`
+	}
+)
+
+func otlpAttributes(labels []label) []otlpAttribute {
+	attributes := make([]otlpAttribute, len(labels))
+	for i, l := range labels {
+		attributes[i] = otlpAttribute{Key: l.name, Value: otlpAttributeValue{StringValue: l.value}}
+	}
+	return attributes
+}
+
+func (e *otlpExporter) push() error {
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	start := strconv.FormatInt(e.startTime.UnixNano(), 10)
+
+	exported := []otlpMetric{}
+	e.registry.each(func(m *metric) {
+		point := otlpDataPoint{Attributes: otlpAttributes(m.labels), TimeUnixNano: now, AsDouble: m.Get()}
+		om := otlpMetric{Name: m.name, Description: m.help}
+		if m.kind == "counter" {
+			point.StartTimeUnixNano = start
+			om.Sum = &otlpSum{DataPoints: []otlpDataPoint{point}, AggregationTemporality: otlpCumulative, IsMonotonic: true}
+		} else {
+			om.Gauge = &otlpGauge{DataPoints: []otlpDataPoint{point}}
+		}
+		exported = append(exported, om)
+	})
+
+	body, err := json.Marshal(otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource:     otlpResource{Attributes: otlpAttributes(e.resource)},
+		ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: "energy"}, Metrics: exported}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	response, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded with %s", response.Status)
+	}
+	return nil
+}
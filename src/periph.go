@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	roverlib "github.com/VU-ASE/roverlib-go/src"
+	"github.com/rs/zerolog/log"
+	"periph.io/x/conn/v3/i2c"
+	"periph.io/x/conn/v3/i2c/i2creg"
+	"periph.io/x/host/v3"
+	"periph.io/x/host/v3/sysfs"
+)
+
+// Which periph drivers are initialized at startup
+type periphDrivers string
+
+const (
+	// Initialize all host drivers (GPIO, SPI, 1-wire, board specific drivers, ...)
+	periphDriversAll periphDrivers = "all"
+	// Only open the I2C bus through its character device, without initializing any driver
+	periphDriversI2C periphDrivers = "i2c"
+)
+
+// Reads periph-drivers. Without the drivers there are no GPIO pins, so an alert-gpio pin is rejected rather than
+// silently left unused.
+func readPeriphDrivers(configuration *roverlib.ServiceConfiguration) (periphDrivers, error) {
+	drivers := periphDrivers(getStringOr(configuration, "periph-drivers", string(periphDriversAll)))
+	switch drivers {
+	case periphDriversAll:
+		return drivers, nil
+	case periphDriversI2C:
+		if pin := getStringOr(configuration, "alert-gpio", ""); pin != "" {
+			return "", fmt.Errorf("alert-gpio %q needs the GPIO driver, which periph-drivers %q does not initialize", pin, periphDriversI2C)
+		}
+		return drivers, nil
+	default:
+		return "", fmt.Errorf("invalid periph-drivers %q, must be %q or %q", drivers, periphDriversAll, periphDriversI2C)
+	}
+}
+
+// Initializes the periph drivers and logs which ones were loaded. Periph has no selective initialization (it
+// initializes every registered driver), so with periphDriversI2C no driver is initialized at all and the bus is
+// opened directly, see openI2CBus.
+func initPeriph(drivers periphDrivers) {
+	if drivers == periphDriversI2C {
+		log.Info().Strs("loaded", []string{"sysfs-i2c (direct)"}).Msg("Skipped the periph driver initialization")
+		return
+	}
+
+	state, err := host.Init()
+	if err != nil {
+		log.Error().Msgf("failed to initialize periph: %v", err)
+		return
+	}
+	loaded := make([]string, 0, len(state.Loaded))
+	for _, d := range state.Loaded {
+		loaded = append(loaded, d.String())
+	}
+	for _, f := range state.Skipped {
+		log.Debug().Msgf("periph driver skipped: %v", f)
+	}
+	for _, f := range state.Failed {
+		log.Warn().Msgf("periph driver failed: %v", f)
+	}
+	log.Info().Strs("loaded", loaded).Int("skipped", len(state.Skipped)).Int("failed", len(state.Failed)).Msg("Initialized periph drivers")
+}
+
+// Opens the I2C bus by name, through the periph registry, or directly through /dev/i2c-N when the drivers
+// were not initialized
+func openI2CBus(drivers periphDrivers, name string) (i2c.BusCloser, error) {
+	if drivers == periphDriversAll {
+		return i2creg.Open(name)
+	}
+	number, err := strconv.Atoi(strings.TrimPrefix(name, "/dev/i2c-"))
+	if err != nil {
+		return nil, fmt.Errorf("bus %q must be a bus number with periph-drivers %q", name, periphDriversI2C)
+	}
+	return sysfs.NewI2C(number)
+}
@@ -0,0 +1,61 @@
+package main
+
+import "time"
+
+// Time-weighted mean of the signed power over a sliding window (e.g. the last minute), to show whether the
+// drain rate trends up or down. The window is kept as one-second buckets, so the mean is updated once per second.
+type powerTrend struct {
+	energy   []float64       // watt-seconds per bucket, a ring buffer
+	duration []time.Duration // covered time per bucket
+	current  int             // index of the bucket that is being filled
+	start    time.Time       // start of the current bucket
+	last     time.Time       // timestamp of the previous sample, zero before the first sample
+	mean     float64         // mean over the completed buckets
+}
+
+const powerTrendBucket = time.Second
+
+func newPowerTrend(window time.Duration) *powerTrend {
+	buckets := max(int(window/powerTrendBucket), 1)
+	return &powerTrend{
+		energy:   make([]float64, buckets),
+		duration: make([]time.Duration, buckets),
+	}
+}
+
+// Adds the time since the previous sample to the window and fills in the mean power of the sample
+func (t *powerTrend) add(sample *CurrentSensorOutput) {
+	if t.last.IsZero() {
+		t.start = sample.Timestamp
+	} else {
+		// Complete the buckets that ended before this sample (skipping over gaps without samples)
+		for sample.Timestamp.Sub(t.start) >= powerTrendBucket {
+			t.start = t.start.Add(powerTrendBucket)
+			t.current = (t.current + 1) % len(t.energy)
+			t.energy[t.current] = 0
+			t.duration[t.current] = 0
+			t.update()
+		}
+		dt := sample.Timestamp.Sub(t.last)
+		t.energy[t.current] += sample.SignedPowerWatts * dt.Seconds()
+		t.duration[t.current] += dt
+	}
+	t.last = sample.Timestamp
+	sample.AvgPowerWattsLastMinute = t.mean
+}
+
+// Recomputes the mean over all completed buckets, i.e. all but the one that is being filled
+func (t *powerTrend) update() {
+	energy := 0.0
+	duration := time.Duration(0)
+	for i := range t.energy {
+		if i == t.current {
+			continue
+		}
+		energy += t.energy[i]
+		duration += t.duration[i]
+	}
+	if duration > 0 {
+		t.mean = energy / duration.Seconds()
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// The sliding window over which the achieved sample rate is measured, in rateBuckets buckets
+	rateWindow  = 10 * time.Second
+	rateBuckets = 10
+	// How often updates-per-second is re-read while sleeping, so that a retuned rate applies within this time
+	// instead of after the remainder of a long period
+	rateRecheckInterval = 250 * time.Millisecond
+)
+
+var metricActualHz = metrics.gauge("rover_energy_actual_hz", "Achieved sample rate over the last 10 seconds in Hz")
+
+// Measures the rate at which samples are actually read, which is below updates-per-second when the I2C
+// transactions (or anything else in the loop) take a noticeable part of the period
+type rateMonitor struct {
+	logInterval  time.Duration // between the logs of the achieved rate, 0 disables them
+	warnBelow    float64       // fraction below the target rate that is warned about, 0 disables the warning
+	changeFactor float64       // ratio between the old and new target rate that is logged at info level
+	target       float64       // the last target rate, to detect a retuned updates-per-second
+	counts       [rateBuckets]int
+	bucket       int // index of the current bucket
+	bucketStart  time.Time
+	start        time.Time
+	lastLog      time.Time
+	warned       bool
+}
+
+func newRateMonitor(logInterval time.Duration, warnBelow float64, changeFactor float64) *rateMonitor {
+	return &rateMonitor{logInterval: logInterval, warnBelow: warnBelow, changeFactor: changeFactor}
+}
+
+// Records the target rate of the next sample. When it was retuned, the change is logged and the measurement
+// restarts, so that the achieved rate is never compared against a window that mixes both rates.
+func (m *rateMonitor) retune(target float64) {
+	previous := m.target
+	m.target = target
+	if previous == 0 || target == previous {
+		return
+	}
+
+	ratio := max(target/previous, previous/target)
+	event := log.Debug()
+	if m.changeFactor > 0 && ratio >= m.changeFactor {
+		event = log.Info()
+	}
+	event.Float64("fromHz", previous).Float64("toHz", target).Msg("The sample rate was retuned")
+	m.start = time.Time{}
+	m.warned = false
+}
+
+// Sleeps until one period of the rate after start. The rate is re-read every rateRecheckInterval, and a retuned
+// rate applies to the period that is already being slept (e.g. a drop from 100 Hz to 0.1 Hz extends it right
+// away, a raise from 0.1 Hz to 100 Hz ends it). kick is called with the remainder whenever the period changes.
+// Returns the rate that the period ended with.
+func sleepPeriod(start time.Time, rate float64, reread func() float64, kick func(time.Duration)) float64 {
+	for {
+		remaining := time.Until(start.Add(time.Duration(float64(time.Second) / rate)))
+		if remaining <= 0 {
+			return rate
+		}
+		if remaining <= rateRecheckInterval {
+			time.Sleep(remaining)
+			return rate
+		}
+		time.Sleep(rateRecheckInterval)
+
+		if next := reread(); next > 0 && next != rate {
+			rate = next
+			kick(time.Until(start.Add(time.Duration(float64(time.Second) / rate))))
+		}
+	}
+}
+
+// Records a sample, and publishes the achieved rate once a full window was observed
+func (m *rateMonitor) observe(now time.Time, target float64) {
+	bucketLength := rateWindow / rateBuckets
+	if m.start.IsZero() || now.Sub(m.bucketStart) >= rateWindow+bucketLength {
+		// First sample, or nothing was read for a whole window (e.g. while the sensor was lost)
+		m.counts = [rateBuckets]int{}
+		m.start = now
+		m.bucketStart = now
+		m.lastLog = now
+	}
+	for now.Sub(m.bucketStart) >= bucketLength {
+		m.bucket = (m.bucket + 1) % rateBuckets
+		m.counts[m.bucket] = 0
+		m.bucketStart = m.bucketStart.Add(bucketLength)
+	}
+	m.counts[m.bucket]++
+	if now.Sub(m.start) < rateWindow {
+		return
+	}
+
+	total := 0
+	for _, count := range m.counts {
+		total += count
+	}
+	// The current bucket is only partially elapsed
+	elapsed := time.Duration(rateBuckets-1)*bucketLength + now.Sub(m.bucketStart)
+	rate := float64(total) / elapsed.Seconds()
+	metricActualHz.Set(rate)
+
+	if m.warnBelow > 0 {
+		behind := rate < target*(1-m.warnBelow)
+		if behind && !m.warned {
+			log.Warn().Float64("actualHz", rate).Float64("targetHz", target).
+				Msgf("The achieved sample rate is more than %.0f%% below the target, the loop cannot keep up", m.warnBelow*100)
+		} else if !behind && m.warned {
+			log.Info().Float64("actualHz", rate).Float64("targetHz", target).Msg("The achieved sample rate is back near the target")
+		}
+		m.warned = behind
+	}
+	if m.logInterval > 0 && now.Sub(m.lastLog) >= m.logInterval {
+		m.lastLog = now
+		log.Info().Float64("actualHz", rate).Float64("targetHz", target).Msg("Achieved sample rate")
+	}
+}
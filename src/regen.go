@@ -0,0 +1,67 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Direction of the current through the shunt
+type currentDirection int
+
+const (
+	directionUnknown currentDirection = iota
+	directionDischarging
+	directionCharging // negative current, e.g. during regenerative braking
+)
+
+// Detects transitions between discharging and charging (regeneration). Currents within the deadband
+// around zero keep the previous direction, and a new direction must hold for the debounce time before
+// it is reported, so that a current that hovers around zero does not produce a flood of markers.
+type regenDetector struct {
+	deadbandAmps   float64
+	debounce       time.Duration
+	direction      currentDirection
+	candidate      currentDirection
+	candidateSince time.Time
+}
+
+func newRegenDetector(deadbandAmps float64, debounce time.Duration) *regenDetector {
+	return &regenDetector{deadbandAmps: deadbandAmps, debounce: debounce}
+}
+
+// Returns the event to publish when the sample completes a (debounced) direction change, or an empty string
+func (d *regenDetector) observe(sample *CurrentSensorOutput) string {
+	if math.Abs(sample.CurrentAmps) <= d.deadbandAmps {
+		d.candidate = directionUnknown
+		return ""
+	}
+
+	direction := directionDischarging
+	if sample.CurrentAmps < 0 {
+		direction = directionCharging
+	}
+	if direction == d.direction {
+		d.candidate = directionUnknown
+		return ""
+	}
+	if direction != d.candidate {
+		d.candidate = direction
+		d.candidateSince = sample.Timestamp
+	}
+	if sample.Timestamp.Sub(d.candidateSince) < d.debounce {
+		return ""
+	}
+
+	// The first direction after startup establishes the baseline, it is not a transition
+	previous := d.direction
+	d.direction = direction
+	d.candidate = directionUnknown
+	switch {
+	case previous == directionUnknown:
+		return ""
+	case direction == directionCharging:
+		return "regen-start"
+	default:
+		return "regen-stop"
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+type registerValue struct {
+	Register string `json:"register"`
+	Value    string `json:"value"`
+}
+
+// Registers endpoints to read (GET /registers/{reg}) and write (PUT /registers/{reg}?value=...) arbitrary
+// registers at runtime, for bringing up new board revisions. Writing is only allowed when explicitly enabled,
+// to prevent accidentally misconfiguring a sensor in production.
+func registerRegisterEndpoints(ina *INA226, allowWrite bool) {
+	httpMux.HandleFunc("GET /registers/{reg}", func(w http.ResponseWriter, r *http.Request) {
+		reg, err := strconv.ParseUint(r.PathValue("reg"), 0, 8)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid register: %v", err), http.StatusBadRequest)
+			return
+		}
+		value, err := ina.ReadRegisterRaw(uint8(reg))
+		if errors.Is(err, errAlertLatchKept) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to read register: %v", err), http.StatusBadGateway)
+			return
+		}
+		writeRegisterValue(w, uint8(reg), value)
+	})
+
+	httpMux.HandleFunc("PUT /registers/{reg}", func(w http.ResponseWriter, r *http.Request) {
+		if !allowWrite {
+			http.Error(w, "register writes are disabled, set debug-register-access to 1 to enable them", http.StatusForbidden)
+			return
+		}
+		reg, err := strconv.ParseUint(r.PathValue("reg"), 0, 8)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid register: %v", err), http.StatusBadRequest)
+			return
+		}
+		value, err := strconv.ParseUint(r.URL.Query().Get("value"), 0, 16)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid value: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := ina.WriteRegisterRaw(uint8(reg), uint16(value)); err != nil {
+			http.Error(w, fmt.Sprintf("failed to write register: %v", err), http.StatusBadGateway)
+			return
+		}
+		log.Warn().Str("register", fmt.Sprintf("0x%02x", reg)).Str("value", fmt.Sprintf("0x%04x", value)).Msg("Register written through debug endpoint")
+		writeRegisterValue(w, uint8(reg), uint16(value))
+	})
+}
+
+func writeRegisterValue(w http.ResponseWriter, reg uint8, value uint16) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(registerValue{
+		Register: fmt.Sprintf("0x%02x", reg),
+		Value:    fmt.Sprintf("0x%04x", value),
+	})
+}
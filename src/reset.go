@@ -0,0 +1,54 @@
+package main
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Minimum time between two checks of the calibration register
+const resetCheckInterval = 1 * time.Second
+
+var metricSensorResets = metrics.counter("rover_energy_sensor_resets_total", "Number of times the INA226 was found reset (e.g. by a brownout) and was re-initialized")
+
+// Detects an INA226 that silently reset while the service runs, e.g. by a brownout on an integrated power board.
+// After a reset the calibration register is 0, so the current and power read exactly 0 while the bus voltage
+// still looks fine. While the current reads exactly 0, the calibration register is checked (at most once per
+// check interval), and when it does not hold the written calibration the chip is set up again.
+type resetDetector struct {
+	ina       *INA226
+	lastCheck time.Time
+	onReset   func()
+}
+
+func newResetDetector(ina *INA226, onReset func()) *resetDetector {
+	return &resetDetector{ina: ina, onReset: onReset}
+}
+
+// Checks a freshly read sample (before the field mask is applied) and returns whether the chip was found reset,
+// in which case the sample is invalid
+func (d *resetDetector) observe(sample *CurrentSensorOutput) bool {
+	// A raw current of 0 is converted to minus the zero offset
+	if sample.CurrentAmps != -d.ina.CurrentOffset() || time.Since(d.lastCheck) < resetCheckInterval {
+		return false
+	}
+	d.lastCheck = time.Now()
+
+	calibration, err := d.ina.readRegister(calibrationReg)
+	if err != nil {
+		log.Debug().Msgf("unable to check the calibration register: %v", err)
+		return false
+	}
+	if calibration == d.ina.Calibration().Register {
+		return false
+	}
+
+	log.Warn().Uint16("calibration", calibration).Uint16("expected", d.ina.Calibration().Register).
+		Msg("INA226 lost its calibration, it was probably reset (e.g. by a brownout). Re-initializing it")
+	metricSensorResets.Add(1)
+	if err := d.ina.Reinitialize(); err != nil {
+		log.Error().Msgf("Failed to re-initialize the INA226 after a reset: %v", err)
+	}
+	d.onReset()
+	return true
+}
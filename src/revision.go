@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The options that can be overridden per die revision, which are those that trim the readings
+var revisionOverridableOptions = map[string]bool{
+	"bus-gain":          true,
+	"bus-offset":        true,
+	"actual-shunt-ohms": true,
+	"current-scale":     true,
+	"current-offset":    true,
+	"voltage-scale":     true,
+	"voltage-offset":    true,
+	"power-scale":       true,
+	"power-offset":      true,
+}
+
+// Values that replace configured options, e.g. for the die revision of the sensor. A nil map overrides nothing.
+type optionOverrides map[string]float64
+
+// The overridden value of the option, or the fallback when it is not overridden
+func (o optionOverrides) float(name string, fallback float64) float64 {
+	if value, ok := o[name]; ok {
+		return value
+	}
+	return fallback
+}
+
+// Parses the overrides per die revision, separated by semicolons. Each is revision:option=value,option=value,
+// e.g. "0:current-scale=1.002;1:bus-gain=0.998,bus-offset=0.01".
+func parseRevisionOverrides(spec string) (map[uint8]optionOverrides, error) {
+	revisions := map[uint8]optionOverrides{}
+	for _, s := range strings.Split(spec, ";") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		revisionText, options, ok := strings.Cut(s, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid die revision override %q, must be revision:option=value,...", s)
+		}
+		revision, err := strconv.ParseUint(strings.TrimSpace(revisionText), 0, 4)
+		if err != nil {
+			return nil, fmt.Errorf("die revision override %q: the revision must be 0 to 15", s)
+		}
+		if _, ok := revisions[uint8(revision)]; ok {
+			return nil, fmt.Errorf("die revision %d is overridden more than once", revision)
+		}
+
+		overrides := optionOverrides{}
+		for _, option := range strings.Split(options, ",") {
+			name, valueText, ok := strings.Cut(option, "=")
+			name = strings.TrimSpace(name)
+			if !ok || !revisionOverridableOptions[name] {
+				return nil, fmt.Errorf("die revision override %q: invalid option %q, must be one of bus-gain, bus-offset, actual-shunt-ohms or the output corrections", s, strings.TrimSpace(option))
+			}
+			value, err := strconv.ParseFloat(strings.TrimSpace(valueText), 64)
+			if err != nil {
+				return nil, fmt.Errorf("die revision override %q: invalid value of %s: %v", s, name, err)
+			}
+			if (name == "bus-gain" && value <= 0) || (name == "actual-shunt-ohms" && value < 0) {
+				return nil, fmt.Errorf("die revision override %q: invalid value %v of %s", s, value, name)
+			}
+			overrides[name] = value
+		}
+		revisions[uint8(revision)] = overrides
+	}
+	return revisions, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	roverlib "github.com/VU-ASE/roverlib-go/src"
+	"github.com/rs/zerolog/log"
+)
+
+// Suffix of a rotated file, inserted before the extension (e.g. energy-20240501T100000Z.csv)
+const rotatedTimeFormat = "20060102T150405Z"
+
+// When a file sink starts a new file. The zero value never rotates.
+type fileRotation struct {
+	maxBytes int64         // 0 does not rotate on size
+	maxAge   time.Duration // 0 does not rotate on time
+	keep     int           // rotated files that are kept, 0 keeps all
+}
+
+// Reads log-rotate-mb, log-rotate-minutes and log-rotate-keep
+func readFileRotation(configuration *roverlib.ServiceConfiguration) (fileRotation, error) {
+	mb := getFloatOr(configuration, "log-rotate-mb", 0)
+	minutes := getFloatOr(configuration, "log-rotate-minutes", 0)
+	keep := getFloatOr(configuration, "log-rotate-keep", 0)
+	if mb < 0 || minutes < 0 || keep < 0 {
+		return fileRotation{}, fmt.Errorf("log-rotate-mb, log-rotate-minutes and log-rotate-keep must not be negative")
+	}
+	return fileRotation{
+		maxBytes: int64(mb * 1024 * 1024),
+		maxAge:   time.Duration(minutes * float64(time.Minute)),
+		keep:     int(keep),
+	}, nil
+}
+
+func (r fileRotation) enabled() bool {
+	return r.maxBytes > 0 || r.maxAge > 0
+}
+
+// Whether a file of the size, that was opened at the time, is due to be rotated
+func (r fileRotation) due(size int64, opened time.Time, now time.Time) bool {
+	return (r.maxBytes > 0 && size >= r.maxBytes) || (r.maxAge > 0 && now.Sub(opened) >= r.maxAge)
+}
+
+// Renames the closed file at path to its rotated name and removes the oldest rotated files beyond keep
+func (r fileRotation) rotate(path string, now time.Time) error {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	stamped := base + "-" + now.UTC().Format(rotatedTimeFormat)
+	rotated := stamped + ext
+	// Only when rotating more than once per second: a counter after the last file of that second, which may be
+	// the only one left after pruning. Zero-padded, so that the names sort in the order of rotation.
+	same, err := filepath.Glob(stamped + "*" + ext)
+	if err != nil {
+		return err
+	}
+	if len(same) > 0 {
+		sortRotated(same, ext)
+		counter := 0
+		fmt.Sscanf(strings.TrimSuffix(strings.TrimPrefix(same[len(same)-1], stamped), ext), "-%d", &counter)
+		rotated = fmt.Sprintf("%s-%03d%s", stamped, counter+1, ext)
+	}
+	if err := os.Rename(path, rotated); err != nil {
+		return err
+	}
+	log.Info().Str("path", rotated).Msg("Rotated output file")
+
+	if r.keep == 0 {
+		return nil
+	}
+	old, err := filepath.Glob(base + "-[0-9]*T*Z*" + ext)
+	if err != nil {
+		return err
+	}
+	sortRotated(old, ext)
+	for len(old) > r.keep {
+		if err := os.Remove(old[0]); err != nil {
+			log.Warn().Str("path", old[0]).Msgf("unable to remove rotated output file: %v", err)
+		}
+		old = old[1:]
+	}
+	return nil
+}
+
+// Sorts rotated file names chronologically. The timestamps and counters sort as strings without the extension,
+// with it the "." would sort a file without counter after those of the same second with one.
+func sortRotated(names []string, ext string) {
+	sort.Slice(names, func(i, j int) bool {
+		return strings.TrimSuffix(names[i], ext) < strings.TrimSuffix(names[j], ext)
+	})
+}
+
+// Counts the bytes that reach the file, the size of the file that is appended to is added when it is opened
+type countingWriter struct {
+	file *os.File
+	n    int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotateKeepsNewest(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "energy.csv")
+	rotation := fileRotation{maxBytes: 1, keep: 3}
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	// More rotations than the counter has digits in the same second, and one in the next second
+	for i := 0; i < 12; i++ {
+		if i == 11 {
+			now = now.Add(time.Second)
+		}
+		if err := os.WriteFile(path, []byte("sample\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := rotation.rotate(path, now); err != nil {
+			t.Fatalf("rotate %d: %v", i, err)
+		}
+	}
+
+	kept, err := filepath.Glob(filepath.Join(dir, "energy-*.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		filepath.Join(dir, "energy-20240501T100000Z-009.csv"),
+		filepath.Join(dir, "energy-20240501T100000Z-010.csv"),
+		filepath.Join(dir, "energy-20240501T100001Z.csv"),
+	}
+	if len(kept) != len(want) {
+		t.Fatalf("kept %v, want %v", kept, want)
+	}
+	for i := range want {
+		if kept[i] != want[i] {
+			t.Errorf("kept %v, want %v", kept, want)
+			break
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Extracts the value that a threshold rule compares, and whether it is valid in the sample
+type ruleMetric func(sample *CurrentSensorOutput) (float64, bool)
+
+// The metrics that threshold rules can compare, the current and power as magnitudes
+var ruleMetrics = map[string]ruleMetric{
+	"current": func(s *CurrentSensorOutput) (float64, bool) {
+		return math.Abs(s.CurrentAmps), s.ValidFields.Has(FieldCurrent)
+	},
+	"voltage": func(s *CurrentSensorOutput) (float64, bool) {
+		return s.SupplyVoltage, s.ValidFields.Has(FieldVoltage)
+	},
+	"power": func(s *CurrentSensorOutput) (float64, bool) {
+		return s.PowerWatts, s.ValidFields.Has(FieldPower)
+	},
+}
+
+// Dispatched to the actions of a rule when it triggers or clears
+type ruleEvent struct {
+	Rule      string    `json:"rule"`
+	Triggered bool      `json:"triggered"`
+	Metric    string    `json:"metric"`
+	Value     float64   `json:"value"`
+	Limit     float64   `json:"limit"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Triggers when its metric is above (or below) the limit for the debounce time, and clears when it no longer is
+// for the debounce time
+type thresholdRule struct {
+	name     string
+	metric   string
+	value    ruleMetric
+	below    bool
+	limit    float64
+	debounce time.Duration
+	actions  []func(ruleEvent)
+	active   bool
+	pending  bool
+	since    time.Time
+}
+
+// Evaluates the threshold rules for every sample and dispatches their actions
+type ruleEngine struct {
+	rules []*thresholdRule
+}
+
+// Parses the threshold-rules, separated by semicolons. Each rule is name:metric:above|below:limit:debounce-ms:actions,
+// e.g. "motor-overcurrent:current:above:12:500:log,status". The actions are looked up by name.
+func parseThresholdRules(spec string, actions map[string]func(ruleEvent)) (*ruleEngine, error) {
+	engine := &ruleEngine{}
+	for _, s := range strings.Split(spec, ";") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		fields := strings.Split(s, ":")
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("invalid rule %q, must be name:metric:above|below:limit:debounce-ms:actions", s)
+		}
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+
+		rule := &thresholdRule{name: fields[0], metric: fields[1]}
+		if rule.name == "" {
+			return nil, fmt.Errorf("rule %q has no name", s)
+		}
+		if slices.ContainsFunc(engine.rules, func(r *thresholdRule) bool { return r.name == rule.name }) {
+			return nil, fmt.Errorf("rule %q is defined more than once", rule.name)
+		}
+		var ok bool
+		if rule.value, ok = ruleMetrics[rule.metric]; !ok {
+			return nil, fmt.Errorf("rule %q: unknown metric %q, must be current, voltage or power", rule.name, rule.metric)
+		}
+		switch fields[2] {
+		case "above":
+		case "below":
+			rule.below = true
+		default:
+			return nil, fmt.Errorf("rule %q: invalid comparison %q, must be above or below", rule.name, fields[2])
+		}
+		limit, err := strconv.ParseFloat(fields[3], 64)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: invalid limit: %v", rule.name, err)
+		}
+		rule.limit = limit
+		debounce, err := strconv.ParseFloat(fields[4], 64)
+		if err != nil || debounce < 0 {
+			return nil, fmt.Errorf("rule %q: the debounce must be a non-negative number of milliseconds, got %q", rule.name, fields[4])
+		}
+		rule.debounce = time.Duration(debounce * float64(time.Millisecond))
+		for _, name := range strings.Split(fields[5], ",") {
+			action, ok := actions[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("rule %q: unknown action %q", rule.name, name)
+			}
+			rule.actions = append(rule.actions, action)
+		}
+		engine.rules = append(engine.rules, rule)
+	}
+	return engine, nil
+}
+
+// Evaluates all rules against the sample. This runs for every sample, so it does not allocate unless a rule
+// changes state.
+func (e *ruleEngine) observe(sample *CurrentSensorOutput) {
+	for _, r := range e.rules {
+		value, ok := r.value(sample)
+		if !ok {
+			continue
+		}
+		matched := value > r.limit
+		if r.below {
+			matched = value < r.limit
+		}
+		if matched == r.active {
+			r.pending = false
+			continue
+		}
+		if !r.pending {
+			r.pending = true
+			r.since = sample.Timestamp
+		}
+		if sample.Timestamp.Sub(r.since) < r.debounce {
+			continue
+		}
+
+		r.active = matched
+		r.pending = false
+		event := ruleEvent{Rule: r.name, Triggered: matched, Metric: r.metric, Value: value, Limit: r.limit, Timestamp: sample.Timestamp}
+		for _, action := range r.actions {
+			action(event)
+		}
+	}
+}
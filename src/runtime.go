@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	roverlib "github.com/VU-ASE/roverlib-go/src"
+)
+
+// How the remaining runtime estimate is smoothed
+type runtimeSmoothing string
+
+const (
+	// Exponential moving average of the estimates from the mean power of the last minute
+	runtimeSmoothingEMA runtimeSmoothing = "ema"
+	// Linear regression of the cumulative energy over the smoothing window, the slope is the power trend
+	runtimeSmoothingTrend runtimeSmoothing = "trend"
+)
+
+// Minimum spacing of the points of the trend regression, relative to the window, which bounds their number
+const runtimeTrendPoints = 120
+
+// A point of the cumulative energy over time, for the trend regression
+type energyPoint struct {
+	t        time.Time
+	energyWh float64
+}
+
+// Estimates the remaining runtime from the battery energy that is left and the recent power, together with an
+// uncertainty band of one standard deviation. The estimate is smoothed, so that it does not jump around with
+// every change in power.
+type runtimeEstimator struct {
+	capacityWh float64
+	method     runtimeSmoothing
+	// Time constant of the exponential smoothing, or the window of the trend regression
+	smoothing time.Duration
+	// Estimates above this are unbounded for practical purposes (e.g. while the power is near zero), 0 disables
+	maxMinutes float64
+	minutes    float64
+	variance   float64   // exponentially weighted variance of the estimates (ema)
+	low, high  float64   // uncertainty band
+	valid      bool      // false while there is no estimate (e.g. while charging)
+	last       time.Time // timestamp of the previous estimate
+	points     []energyPoint
+}
+
+func newRuntimeEstimator(capacityWh float64, method runtimeSmoothing, smoothing time.Duration, maxMinutes float64) *runtimeEstimator {
+	return &runtimeEstimator{capacityWh: capacityWh, method: method, smoothing: smoothing, maxMinutes: maxMinutes}
+}
+
+// Reads the runtime options, returns nil when no battery-capacity-wh is configured
+func readRuntimeEstimator(configuration *roverlib.ServiceConfiguration) (*runtimeEstimator, error) {
+	capacity := getFloatOr(configuration, "battery-capacity-wh", 0)
+	if capacity <= 0 {
+		return nil, nil
+	}
+	method := runtimeSmoothing(getStringOr(configuration, "runtime-smoothing", string(runtimeSmoothingEMA)))
+	smoothing := time.Duration(getFloatOr(configuration, "runtime-smoothing-seconds", 30) * float64(time.Second))
+	switch method {
+	case runtimeSmoothingEMA:
+	case runtimeSmoothingTrend:
+		if smoothing <= 0 {
+			return nil, fmt.Errorf("runtime-smoothing %q needs a positive runtime-smoothing-seconds window", method)
+		}
+	default:
+		return nil, fmt.Errorf("invalid runtime-smoothing %q, must be %q or %q", method, runtimeSmoothingEMA, runtimeSmoothingTrend)
+	}
+	return newRuntimeEstimator(capacity, method, smoothing, getFloatOr(configuration, "runtime-max-minutes", 1440)), nil
+}
+
+// Fills in the remaining runtime of the sample and its uncertainty band, which needs its cumulative energy
+// (and mean power for ema). While the power is zero or negative (idle or charging), or the estimate exceeds
+// maxMinutes, the runtime is unbounded, so it is left empty.
+func (e *runtimeEstimator) add(sample *CurrentSensorOutput) {
+	sample.RemainingRuntimeMinutes = nil
+	sample.RemainingRuntimeMinutesLow = nil
+	sample.RemainingRuntimeMinutesHigh = nil
+
+	remainingWh := math.Max(e.capacityWh-sample.EnergyWh, 0)
+	if e.method == runtimeSmoothingTrend {
+		e.valid = e.trend(sample, remainingWh)
+	} else {
+		e.valid = e.ema(sample, remainingWh)
+	}
+	e.last = sample.Timestamp
+	if !e.valid || (e.maxMinutes > 0 && e.minutes > e.maxMinutes) {
+		return
+	}
+
+	// Points into the estimator, which overwrites it with the next estimate (see detachSample)
+	sample.RemainingRuntimeMinutes = &e.minutes
+	sample.RemainingRuntimeMinutesLow = &e.low
+	if !math.IsInf(e.high, 1) && (e.maxMinutes <= 0 || e.high <= e.maxMinutes) {
+		sample.RemainingRuntimeMinutesHigh = &e.high
+	}
+}
+
+func (e *runtimeEstimator) ema(sample *CurrentSensorOutput, remainingWh float64) bool {
+	if sample.AvgPowerWattsLastMinute <= 0 {
+		return false
+	}
+
+	estimate := remainingWh / sample.AvgPowerWattsLastMinute * 60
+	if !e.valid || e.smoothing <= 0 {
+		e.minutes = estimate
+		e.variance = 0
+	} else {
+		dt := sample.Timestamp.Sub(e.last).Seconds()
+		alpha := dt / (e.smoothing.Seconds() + dt)
+		diff := estimate - e.minutes
+		e.minutes += alpha * diff
+		e.variance = (1 - alpha) * (e.variance + alpha*diff*diff)
+	}
+	stddev := math.Sqrt(e.variance)
+	e.low = math.Max(e.minutes-stddev, 0)
+	e.high = e.minutes + stddev
+	return true
+}
+
+func (e *runtimeEstimator) trend(sample *CurrentSensorOutput, remainingWh float64) bool {
+	if n := len(e.points); n == 0 || sample.Timestamp.Sub(e.points[n-1].t) >= e.smoothing/runtimeTrendPoints {
+		e.points = append(e.points, energyPoint{t: sample.Timestamp, energyWh: sample.EnergyWh})
+	}
+	for len(e.points) > 0 && sample.Timestamp.Sub(e.points[0].t) > e.smoothing {
+		e.points = e.points[1:]
+	}
+	n := float64(len(e.points))
+	if n < 3 {
+		return false
+	}
+
+	// Least squares fit of the energy (Wh) over the time (h) since the first point
+	var sumT, sumE, sumTT, sumTE float64
+	for _, p := range e.points {
+		t := p.t.Sub(e.points[0].t).Hours()
+		sumT += t
+		sumE += p.energyWh
+		sumTT += t * t
+		sumTE += t * p.energyWh
+	}
+	sxx := sumTT - sumT*sumT/n
+	if sxx <= 0 {
+		return false
+	}
+	slope := (sumTE - sumT*sumE/n) / sxx // W
+	if slope <= 0 {
+		return false
+	}
+	intercept := (sumE - slope*sumT) / n
+	residuals := 0.0
+	for _, p := range e.points {
+		r := p.energyWh - (intercept + slope*p.t.Sub(e.points[0].t).Hours())
+		residuals += r * r
+	}
+	slopeError := math.Sqrt(residuals / (n - 2) / sxx)
+
+	e.minutes = remainingWh / slope * 60
+	e.low = remainingWh / (slope + slopeError) * 60
+	e.high = math.Inf(1)
+	if slope > slopeError {
+		e.high = remainingWh / (slope - slopeError) * 60
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+package main
+
+import "fmt"
+
+// Versions of the JSON sample schema, published in the schemaVersion field of every JSON sample so that
+// consumers can tell them apart. The protobuf messages on the energy stream are defined in rovercom and carry no
+// schema version, so they are not covered.
+const (
+	// Only the fields that existed when the samples were first published as JSON
+	legacySchemaVersion = 1
+	// All fields of CurrentSensorOutput
+	currentSchemaVersion = 2
+)
+
+// The fields of the legacy schema, besides the keyframe flag and sequence number in delta mode
+var legacySchemaFields = map[string]bool{
+	"keyframe":      true,
+	"sequence":      true,
+	"timestamp":     true,
+	"supplyVoltage": true,
+	"currentAmps":   true,
+	"powerWatts":    true,
+	"energyWh":      true,
+	"chargeAh":      true,
+}
+
+// The schema version of the published JSON samples, set from schema-version
+var sampleSchemaVersion = currentSchemaVersion
+
+func readSchemaVersion(version float64) (int, error) {
+	switch version {
+	case legacySchemaVersion, currentSchemaVersion:
+		return int(version), nil
+	default:
+		return 0, fmt.Errorf("invalid schema-version %v, must be %d (legacy) or %d (current)", version, legacySchemaVersion, currentSchemaVersion)
+	}
+}
+
+// Leaves only the fields that exist in the schema version
+func applySchemaVersion(fields map[string]any, version int) {
+	if version == legacySchemaVersion {
+		for name := range fields {
+			if !legacySchemaFields[name] {
+				delete(fields, name)
+			}
+		}
+	}
+	fields["schemaVersion"] = version
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// A shunt voltage within 2% of the ADC full scale is considered saturated
+const shuntFullScaleFraction = 0.98
+
+// Detects when the shunt voltage ADC saturates at +-81.92 mV. Depending on the calibration, the shunt channel
+// can saturate before the current register does, so this is checked separately from clipped current readings.
+type shuntSaturationDetector struct {
+	warnFraction float64 // fraction of saturated samples in a window that triggers a warning, 0 disables
+	window       detectorWindow
+	saturated    int
+	peakFraction float64
+}
+
+func newShuntSaturationDetector(warnFraction float64) *shuntSaturationDetector {
+	return &shuntSaturationDetector{warnFraction: warnFraction}
+}
+
+func (d *shuntSaturationDetector) enabled() bool {
+	return d.warnFraction > 0
+}
+
+// Records a shunt voltage reading and warns once per window when too many readings were near full scale
+func (d *shuntSaturationDetector) observe(now time.Time, shuntVolts float64, cal Calibration) {
+	fraction := math.Abs(shuntVolts) / shuntVoltageFullScale
+	log.Debug().Float64("shuntVolts", shuntVolts).Float64("shuntFullScaleFraction", fraction).Msg("Shunt voltage")
+
+	d.peakFraction = math.Max(d.peakFraction, fraction)
+	if fraction >= shuntFullScaleFraction {
+		d.saturated++
+	}
+	if !d.window.add(now) {
+		return
+	}
+
+	if float64(d.saturated)/float64(d.window.samples) < d.warnFraction {
+		faults.clear(faultShuntSaturated)
+	} else {
+		faults.raise(faultShuntSaturated)
+		log.Warn().
+			Float64("saturatedFraction", float64(d.saturated)/float64(d.window.samples)).
+			Float64("peakFullScaleFraction", d.peakFraction).
+			Float64("maxMeasurableAmps", shuntVoltageFullScale/cal.ShuntOhms).
+			Msgf("Shunt voltage is saturating at the +-81.92 mV ADC full scale, currents above %.3f A cannot be measured with this shunt. Use a smaller shunt resistor", shuntVoltageFullScale/cal.ShuntOhms)
+	}
+
+	d.window.reset()
+	d.saturated = 0
+	d.peakFraction = 0
+}
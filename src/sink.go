@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	pb_outputs "github.com/VU-ASE/rovercom/packages/go/outputs"
+	roverlib "github.com/VU-ASE/roverlib-go/src"
+	"github.com/rs/zerolog/log"
+)
+
+// A destination of the published samples. Every enabled sink receives the same samples, after the corrections
+// and markers were applied, so new outputs only need to implement this and be added in readSampleSinks.
+type SampleSink interface {
+	// Short name for the logs, e.g. "mqtt"
+	Name() string
+	// Writes or queues the sample. The sample is reused after the call, so it must be copied when it is kept.
+	Write(sample *CurrentSensorOutput) error
+}
+
+// Optional sink, shared with onTerminate to flush it on shutdown
+var csvSink *csvFileSink
+
+// Collects the enabled sinks, starting with the stream (nil when it is disabled). The mqtt, sqlite, socket and
+// influx sinks are set up before, since they need more of the setup, the csv file is opened here. The tags
+// identify the sensor in the line protocol.
+func readSampleSinks(configuration *roverlib.ServiceConfiguration, stream *streamSink, tags []label) ([]SampleSink, error) {
+	sinks := []SampleSink{}
+	if stream != nil {
+		sinks = append(sinks, stream)
+	}
+	if mqttPublisher != nil {
+		sinks = append(sinks, mqttPublisher)
+	}
+	if sqlite != nil {
+		sinks = append(sinks, sqlite)
+	}
+	if socketSink != nil {
+		sinks = append(sinks, socketSink)
+	}
+	if influx != nil {
+		sinks = append(sinks, influx)
+	}
+	if getFloatOr(configuration, "log-samples", 0) != 0 {
+		sinks = append(sinks, logSink{})
+	}
+	jsonStdout := getFloatOr(configuration, "json-stdout", 0) != 0
+	if jsonStdout {
+		sinks = append(sinks, stdoutSink{})
+	}
+	if getFloatOr(configuration, "grafana-stdout", 0) != 0 {
+		if jsonStdout {
+			return nil, fmt.Errorf("json-stdout and grafana-stdout both write to stdout, enable only one of them")
+		}
+		sinks = append(sinks, &grafanaStdoutSink{series: influxSeries(getStringOr(configuration, "influx-measurement", "energy"), tags)})
+	}
+	if path := getStringOr(configuration, "csv-path", ""); path != "" {
+		var err error
+		rotation, err := readFileRotation(configuration)
+		if err != nil {
+			return nil, err
+		}
+		csvSink, err = newCSVFileSink(path, rotation)
+		if err != nil {
+			return nil, err
+		}
+		log.Info().Str("path", path).Bool("rotate", rotation.enabled()).Msg("Writing samples to csv")
+		sinks = append(sinks, csvSink)
+	}
+	return sinks, nil
+}
+
+// Publishes the samples as EnergySensorOutput protobuf messages on the energy stream, or in the fixed-width
+// binary encoding (see BinarySample) with stream-encoding
+type streamSink struct {
+	stream   *roverlib.WriteStream
+	sensorID uint32
+	battery  *lowBatteryDetector // sets the status of the messages, nil when not monitored
+	binary   bool
+	sequence uint32
+	buf      [binarySampleSize]byte
+}
+
+func (s *streamSink) Name() string {
+	return "stream"
+}
+
+func (s *streamSink) Write(sample *CurrentSensorOutput) error {
+	// We build the output message that that is serialized with protobuf
+	status := statusOK
+	if s.battery != nil {
+		status = s.battery.status()
+	}
+	if sample.Stale {
+		status = statusStale
+	}
+	if s.binary {
+		return s.writeBinary(sample, status)
+	}
+	outputMsg := pb_outputs.SensorOutput{
+		Timestamp: uint64(sample.Timestamp.UnixMilli()),
+		Status:    status,
+		SensorId:  s.sensorID,
+		SensorOutput: &pb_outputs.SensorOutput_EnergyOutput{
+			EnergyOutput: &pb_outputs.EnergySensorOutput{
+				CurrentAmps:   float32(sample.CurrentAmps),
+				SupplyVoltage: float32(sample.SupplyVoltage),
+				PowerWatts:    float32(sample.PowerWatts),
+			},
+		},
+	}
+
+	if sample.Stale && sample.ValidFields == 0 {
+		// The stream has no validity flags, so the gap is marked with NaN
+		nan := float32(math.NaN())
+		outputMsg.GetEnergyOutput().CurrentAmps = nan
+		outputMsg.GetEnergyOutput().SupplyVoltage = nan
+		outputMsg.GetEnergyOutput().PowerWatts = nan
+	}
+
+	return writeOutput(s.stream, &outputMsg)
+}
+
+func (s *streamSink) writeBinary(sample *CurrentSensorOutput, status uint32) error {
+	encoded := BinarySample{
+		Status:        uint8(status),
+		SensorID:      s.sensorID,
+		Sequence:      s.sequence,
+		Timestamp:     sample.Timestamp,
+		CurrentAmps:   float32(sample.CurrentAmps),
+		SupplyVoltage: float32(sample.SupplyVoltage),
+		PowerWatts:    float32(sample.PowerWatts),
+	}
+	s.sequence++
+	if sample.Stale {
+		encoded.Flags |= binaryFlagStale
+	}
+	if sample.ValidFields.Has(FieldVoltage) {
+		encoded.Flags |= binaryFlagVoltageValid
+	}
+	if sample.ValidFields.Has(FieldCurrent) {
+		encoded.Flags |= binaryFlagCurrentValid
+	}
+	if sample.ValidFields.Has(FieldPower) {
+		encoded.Flags |= binaryFlagPowerValid
+	}
+	return writeOutputBytes(s.stream, encodeBinarySample(s.buf[:], encoded))
+}
+
+// Logs every sample as a structured log line, for quick inspection without any consumer
+type logSink struct{}
+
+func (logSink) Name() string {
+	return "log"
+}
+
+func (logSink) Write(sample *CurrentSensorOutput) error {
+	log.Info().
+		Time("sampled", sample.Timestamp).
+		Float64("supplyVoltage", sample.SupplyVoltage).
+		Float64("currentAmps", sample.CurrentAmps).
+		Float64("powerWatts", sample.PowerWatts).
+		Float64("energyWh", sample.EnergyWh).
+		Float64("chargeAh", sample.ChargeAh).
+		Bool("stale", sample.Stale).
+		Msg("Sample")
+	return nil
+}
+
+// Writes every sample as a JSON line to stdout (the logs go to stderr), e.g. to pipe into other tools
+type stdoutSink struct{}
+
+func (stdoutSink) Name() string {
+	return "stdout"
+}
+
+func (stdoutSink) Write(sample *CurrentSensorOutput) error {
+	line, err := marshalSample(sample)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(append(line, '\n'))
+	return err
+}
+
+// Writes every sample as a line of the InfluxDB line protocol to stdout, which is the format that the push
+// endpoint of Grafana Live accepts, so that the output can be piped into a local Grafana for live graphs
+type grafanaStdoutSink struct {
+	series string
+	line   []byte // reused, the sinks are only written from the sensor loop
+}
+
+func (s *grafanaStdoutSink) Name() string {
+	return "grafana-stdout"
+}
+
+// Gap samples are left out, like in the InfluxDB sink
+func (s *grafanaStdoutSink) Write(sample *CurrentSensorOutput) error {
+	if sample.Stale {
+		return nil
+	}
+	s.line = append(appendInfluxLine(s.line[:0], s.series, sample), '\n')
+	_, err := os.Stdout.Write(s.line)
+	return err
+}
+
+// The columns of the CSV file, in order
+var csvColumns = []string{"timestamp", "supplyVoltage", "currentAmps", "powerWatts", "signedPowerWatts", "shuntVoltage", "energyWh", "chargeAh", "stale", "tag"}
+
+// Appends every sample as a row to a CSV file, with a header when the file is new. Rows are written through
+// a buffer that is flushed at most every csvFlushInterval, and on Close. With rotation, the file is renamed
+// when it grows too large or old, and a new one is started.
+type csvFileSink struct {
+	lock      sync.Mutex
+	path      string
+	rotation  fileRotation
+	file      *os.File
+	counter   *countingWriter
+	opened    time.Time
+	writer    *csv.Writer
+	lastFlush time.Time
+	row       []string
+	closed    bool
+}
+
+const csvFlushInterval = time.Second
+
+func newCSVFileSink(path string, rotation fileRotation) (*csvFileSink, error) {
+	s := &csvFileSink{path: path, rotation: rotation, row: make([]string, len(csvColumns))}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Opens (or creates) the file at the path, writing the header when it is new
+func (s *csvFileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open csv file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open csv file: %v", err)
+	}
+
+	s.file = file
+	s.counter = &countingWriter{file: file, n: info.Size()}
+	s.writer = csv.NewWriter(s.counter)
+	s.opened = time.Now()
+	s.lastFlush = s.opened
+	if info.Size() == 0 {
+		if err := s.writer.Write(csvColumns); err != nil {
+			file.Close()
+			s.file = nil
+			return fmt.Errorf("failed to write csv header: %v", err)
+		}
+	}
+	return nil
+}
+
+// Closes the file, renames it and starts a new one. When the rename fails, the rows are appended to the old
+// file, so that nothing is lost.
+func (s *csvFileSink) rotate() error {
+	s.writer.Flush()
+	err := s.writer.Error()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	s.file = nil
+	if err != nil {
+		log.Warn().Str("path", s.path).Msgf("unable to flush csv file before rotating: %v", err)
+	}
+	if err := s.rotation.rotate(s.path, time.Now()); err != nil {
+		log.Warn().Str("path", s.path).Msgf("unable to rotate csv file, appending to it: %v", err)
+	}
+	return s.open()
+}
+
+func (s *csvFileSink) Name() string {
+	return "csv"
+}
+
+func (s *csvFileSink) Write(sample *CurrentSensorOutput) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("csv file is closed")
+	}
+	if s.file == nil {
+		// A rotation could not open the new file, try again
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.rotation.due(s.counter.n, s.opened, time.Now()) {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	formatFloat := func(value float64) string {
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+	s.row[0] = sample.Timestamp.Format(time.RFC3339Nano)
+	s.row[1] = formatFloat(sample.SupplyVoltage)
+	s.row[2] = formatFloat(sample.CurrentAmps)
+	s.row[3] = formatFloat(sample.PowerWatts)
+	s.row[4] = formatFloat(sample.SignedPowerWatts)
+	s.row[5] = formatFloat(sample.ShuntVoltage)
+	s.row[6] = formatFloat(sample.EnergyWh)
+	s.row[7] = formatFloat(sample.ChargeAh)
+	s.row[8] = strconv.FormatBool(sample.Stale)
+	s.row[9] = sample.Tag
+	if err := s.writer.Write(s.row); err != nil {
+		return fmt.Errorf("failed to write csv row: %v", err)
+	}
+
+	if time.Since(s.lastFlush) >= csvFlushInterval {
+		s.lastFlush = time.Now()
+		s.writer.Flush()
+		return s.writer.Error()
+	}
+	return nil
+}
+
+// Flushes the buffered rows and closes the file
+func (s *csvFileSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+	if s.file == nil {
+		return nil
+	}
+	s.writer.Flush()
+	err := s.writer.Error()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	s.file = nil
+	return err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Constants from linux/i2c-dev.h and linux/i2c.h
+const (
+	ioctlI2CSlave          = 0x0703
+	ioctlI2CFuncs          = 0x0705
+	ioctlI2CSMBus          = 0x0720
+	smbusRead              = 1
+	smbusI2CBlockData      = 8
+	funcSMBusReadI2CBlock  = 0x04000000
+	smbusBlockMax          = 32
+	smbusDataSize          = smbusBlockMax + 2 // length byte, data and a PEC byte
+	i2cDevicePathTemplate  = "/dev/i2c-%s"
+	registerReadBlockBytes = 2
+)
+
+// Returned by openSMBus when the adapter does not support SMBus I2C block reads
+var errSMBusUnsupported = errors.New("the I2C adapter does not support SMBus I2C block reads")
+
+// Reads registers with SMBus I2C block reads through the Linux i2c-dev interface, since periph only exposes
+// raw transactions. Some (USB) I2C adapters handle the combined SMBus transaction better than a separate
+// write and read.
+type smbusDevice struct {
+	file *os.File
+}
+
+// Mirrors struct i2c_smbus_ioctl_data
+type smbusIoctlData struct {
+	readWrite uint8
+	command   uint8
+	size      uint32
+	data      *[smbusDataSize]byte
+}
+
+func openSMBus(path string, addr uint16) (*smbusDevice, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	d := &smbusDevice{file: file}
+
+	var funcs uint64
+	if err := d.ioctlPointer(ioctlI2CFuncs, unsafe.Pointer(&funcs)); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to query the adapter functionality: %w", err)
+	}
+	if funcs&funcSMBusReadI2CBlock == 0 {
+		file.Close()
+		return nil, errSMBusUnsupported
+	}
+	if err := d.ioctl(ioctlI2CSlave, uintptr(addr)); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to select address 0x%02x: %w", addr, err)
+	}
+	return d, nil
+}
+
+func (d *smbusDevice) ioctl(request uintptr, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, d.file.Fd(), request, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// The pointer is only converted in the syscall itself, as required by the unsafe.Pointer rules
+func (d *smbusDevice) ioctlPointer(request uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, d.file.Fd(), request, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Reads a 16-bit register, which the INA226 sends MSB first. The errno is wrapped, so that classifyBusError
+// recognizes it.
+func (d *smbusDevice) readRegister(reg uint8, order binary.ByteOrder) (uint16, error) {
+	var data [smbusDataSize]byte
+	data[0] = registerReadBlockBytes
+	args := smbusIoctlData{readWrite: smbusRead, command: reg, size: smbusI2CBlockData, data: &data}
+	if err := d.ioctlPointer(ioctlI2CSMBus, unsafe.Pointer(&args)); err != nil {
+		return 0, fmt.Errorf("smbus: %w", err)
+	}
+	if data[0] != registerReadBlockBytes {
+		return 0, fmt.Errorf("smbus: %w", &ShortReadError{Read: int(data[0]), Expected: registerReadBlockBytes})
+	}
+	return order.Uint16(data[1:3]), nil
+}
+
+func (d *smbusDevice) Close() error {
+	return d.file.Close()
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	roverlib "github.com/VU-ASE/roverlib-go/src"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	metricStateOfCharge    = metrics.gauge("rover_energy_state_of_charge_percent", "Blended state of charge of the battery in percent, -1 when unknown")
+	metricOCVStateOfCharge = metrics.gauge("rover_energy_ocv_state_of_charge_percent", "State of charge from the last open-circuit voltage measurement in percent, -1 when unknown")
+)
+
+// A point of the open-circuit voltage (OCV) curve of the battery
+type ocvPoint struct {
+	volts   float64
+	percent float64
+}
+
+// Parses an OCV curve of "volts:percent" points separated by commas, e.g. "11.8:0,12.2:50,12.7:100"
+func parseOCVTable(s string) ([]ocvPoint, error) {
+	table := []ocvPoint{}
+	for _, point := range strings.Split(s, ",") {
+		point = strings.TrimSpace(point)
+		if point == "" {
+			continue
+		}
+		v, p, ok := strings.Cut(point, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid point %q, must be volts:percent", point)
+		}
+		volts, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid voltage in point %q: %v", point, err)
+		}
+		percent, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid percentage in point %q: %v", point, err)
+		}
+		if percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("percentage in point %q must be between 0 and 100", point)
+		}
+		table = append(table, ocvPoint{volts: volts, percent: percent})
+	}
+	if len(table) < 2 {
+		return nil, fmt.Errorf("at least two points are needed")
+	}
+
+	slices.SortFunc(table, func(a, b ocvPoint) int { return cmp.Compare(a.volts, b.volts) })
+	for i := 1; i < len(table); i++ {
+		if table[i].volts == table[i-1].volts {
+			return nil, fmt.Errorf("voltage %v occurs more than once", table[i].volts)
+		}
+		if table[i].percent < table[i-1].percent {
+			return nil, fmt.Errorf("the percentage must not decrease with the voltage (at %v V)", table[i].volts)
+		}
+	}
+	return table, nil
+}
+
+// Looks up the state of charge at the given open-circuit voltage, interpolating linearly between the points and
+// clamping to the ends of the curve
+func ocvPercent(table []ocvPoint, volts float64) float64 {
+	if volts <= table[0].volts {
+		return table[0].percent
+	}
+	for i := 1; i < len(table); i++ {
+		if volts <= table[i].volts {
+			lo, hi := table[i-1], table[i]
+			return lo.percent + (volts-lo.volts)/(hi.volts-lo.volts)*(hi.percent-lo.percent)
+		}
+	}
+	return table[len(table)-1].percent
+}
+
+// Estimates the state of charge by blending coulomb counting with open-circuit voltage measurements.
+// Coulomb counting is precise in the short term but drifts, the OCV is absolute but only meaningful after the
+// battery rested (no current) long enough for the voltage to relax. Between measurements the estimate follows
+// the counted energy and its uncertainty grows with it; every measurement corrects it, weighted by the
+// uncertainties of both (a one-dimensional Kalman filter).
+type socEstimator struct {
+	table      []ocvPoint
+	capacityWh float64
+	// The battery is rested while the current magnitude stays at or below restAmps, and the voltage is
+	// averaged over averageTime once it rested for restTime
+	restAmps    float64
+	restTime    time.Duration
+	averageTime time.Duration
+	// Standard deviation of an OCV measurement, and the error of coulomb counting as a fraction of the counted change
+	ocvStddev     float64
+	driftFraction float64
+	// Blended estimate (in percent) and its standard deviation, valid from the first OCV measurement on
+	percent float64
+	stddev  float64
+	valid   bool
+	// The last OCV measurement
+	ocv      float64
+	ocvValid bool
+	// The cumulative energy of the previous sample
+	lastEnergyWh float64
+	started      bool
+	// The current rest period
+	resting      bool
+	restSince    time.Time
+	measured     bool
+	averageSince time.Time
+	voltSum      float64
+	voltCount    int
+}
+
+// Reads the OCV options, returns nil when no ocv-table is configured
+func readSOCEstimator(configuration *roverlib.ServiceConfiguration) (*socEstimator, error) {
+	spec := getStringOr(configuration, "ocv-table", "")
+	if spec == "" {
+		return nil, nil
+	}
+	table, err := parseOCVTable(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ocv-table: %v", err)
+	}
+	capacity := getFloatOr(configuration, "battery-capacity-wh", 0)
+	if capacity <= 0 {
+		return nil, fmt.Errorf("ocv-table needs battery-capacity-wh for coulomb counting")
+	}
+	e := &socEstimator{
+		table:         table,
+		capacityWh:    capacity,
+		restAmps:      getFloatOr(configuration, "ocv-rest-amps", 0.05),
+		restTime:      time.Duration(getFloatOr(configuration, "ocv-rest-seconds", 60) * float64(time.Second)),
+		averageTime:   time.Duration(getFloatOr(configuration, "ocv-average-seconds", 5) * float64(time.Second)),
+		ocvStddev:     getFloatOr(configuration, "ocv-stddev-percent", 5),
+		driftFraction: getFloatOr(configuration, "coulomb-drift-percent", 2) / 100,
+	}
+	if e.ocvStddev <= 0 {
+		return nil, fmt.Errorf("ocv-stddev-percent must be positive, got %v", e.ocvStddev)
+	}
+	metricStateOfCharge.Set(-1)
+	metricOCVStateOfCharge.Set(-1)
+	log.Info().Int("points", len(table)).Float64("restAmps", e.restAmps).Dur("restTime", e.restTime).Msg("Estimating the state of charge")
+	return e, nil
+}
+
+// Fills in the state of charge of the sample, which needs its cumulative energy
+func (e *socEstimator) add(sample *CurrentSensorOutput) {
+	first := !e.started
+	if e.started && e.valid {
+		counted := (sample.EnergyWh - e.lastEnergyWh) / e.capacityWh * 100
+		e.percent = min(max(e.percent-counted, 0), 100)
+		// The counting error is mostly systematic (e.g. a gain error), so it accumulates linearly
+		e.stddev += e.driftFraction * math.Abs(counted)
+	}
+	e.lastEnergyWh = sample.EnergyWh
+	e.started = true
+	e.observeRest(sample, first)
+
+	// Points into the estimator, which overwrites it with the next estimate (see detachSample)
+	sample.StateOfChargePercent = nil
+	sample.OCVStateOfChargePercent = nil
+	if e.valid {
+		sample.StateOfChargePercent = &e.percent
+		metricStateOfCharge.Set(e.percent)
+	}
+	if e.ocvValid {
+		sample.OCVStateOfChargePercent = &e.ocv
+		metricOCVStateOfCharge.Set(e.ocv)
+	}
+}
+
+// Tracks the rest periods of the battery, and makes one OCV measurement per rest period
+func (e *socEstimator) observeRest(sample *CurrentSensorOutput, first bool) {
+	if math.Abs(sample.CurrentAmps) > e.restAmps || !sample.ValidFields.Has(FieldVoltage) {
+		e.resting = false
+		return
+	}
+	if !e.resting {
+		e.resting = true
+		e.restSince = sample.Timestamp
+		if first {
+			// The battery is assumed to have rested before the service started, so that the startup
+			// baseline is measured right away
+			e.restSince = sample.Timestamp.Add(-e.restTime)
+		}
+		e.measured = false
+		e.voltSum = 0
+		e.voltCount = 0
+	}
+	if e.measured || sample.Timestamp.Sub(e.restSince) < e.restTime {
+		return
+	}
+
+	if e.voltCount == 0 {
+		e.averageSince = sample.Timestamp
+	}
+	e.voltSum += sample.SupplyVoltage
+	e.voltCount++
+	if sample.Timestamp.Sub(e.averageSince) < e.averageTime {
+		return
+	}
+	e.measured = true
+	e.correct(ocvPercent(e.table, e.voltSum/float64(e.voltCount)))
+}
+
+// Corrects the estimate with an OCV measurement
+func (e *socEstimator) correct(ocv float64) {
+	e.ocv = ocv
+	e.ocvValid = true
+	if !e.valid {
+		e.percent = ocv
+		e.stddev = e.ocvStddev
+		e.valid = true
+		log.Info().Float64("percent", ocv).Msg("Initialized the state of charge from the open-circuit voltage")
+		return
+	}
+
+	variance := e.stddev * e.stddev
+	gain := variance / (variance + e.ocvStddev*e.ocvStddev)
+	log.Debug().Float64("counted", e.percent).Float64("ocv", ocv).Float64("gain", gain).Msg("Correcting the state of charge")
+	e.percent += gain * (ocv - e.percent)
+	e.stddev = math.Sqrt((1 - gain) * variance)
+}
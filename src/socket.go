@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Samples waiting to be written to a single client, if the client cannot keep up newer samples are dropped
+const socketClientQueueSize = 64
+
+// Streams samples as JSON lines to every client that connects to a Unix domain socket, for local tooling
+// that does not speak roverlib or MQTT. Every client has its own queue and writer goroutine, so that a slow
+// or disconnecting client never stalls the sensor loop or the other clients.
+type unixSocketSink struct {
+	path     string
+	listener net.Listener
+	// Clients are added by the accept goroutine and removed by their writer goroutines
+	lock    sync.Mutex
+	clients map[*socketClient]struct{}
+	closed  bool
+}
+
+type socketClient struct {
+	conn    net.Conn
+	queue   chan []byte
+	dropped int
+}
+
+func newUnixSocketSink(path string) (*unixSocketSink, error) {
+	// A socket file left behind by a previous run would make listening fail
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove stale unix socket %s: %v", path, err)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on unix socket %s: %v", path, err)
+	}
+
+	s := &unixSocketSink{
+		path:     path,
+		listener: listener,
+		clients:  map[*socketClient]struct{}{},
+	}
+	go s.accept()
+	return s, nil
+}
+
+func (s *unixSocketSink) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Warn().Msgf("unable to accept unix socket client: %v", err)
+			continue
+		}
+
+		client := &socketClient{conn: conn, queue: make(chan []byte, socketClientQueueSize)}
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			conn.Close()
+			return
+		}
+		s.clients[client] = struct{}{}
+		// Every client first receives the capabilities, as {"capabilities":{...}}
+		if payload := announcedCapabilities.get(); payload != nil {
+			client.queue <- append(append([]byte(`{"capabilities":`), payload...), "}\n"...)
+		}
+		s.lock.Unlock()
+
+		log.Debug().Msg("Unix socket client connected")
+		go s.serve(client)
+	}
+}
+
+// Writes the queued samples to the client until it disconnects or the sink is closed
+func (s *unixSocketSink) serve(client *socketClient) {
+	defer client.conn.Close()
+
+	for line := range client.queue {
+		if _, err := client.conn.Write(line); err != nil {
+			log.Debug().Msgf("Unix socket client disconnected: %v", err)
+			s.lock.Lock()
+			if _, ok := s.clients[client]; ok {
+				delete(s.clients, client)
+				close(client.queue)
+			}
+			s.lock.Unlock()
+			// Drain the queue, so that no samples are written to the closed connection
+			for range client.queue {
+			}
+			return
+		}
+	}
+}
+
+func (s *unixSocketSink) Name() string {
+	return "unix-socket"
+}
+
+// Queues the sample for every connected client, never blocks
+func (s *unixSocketSink) Write(sample *CurrentSensorOutput) error {
+	line, err := marshalSample(sample)
+	if err != nil {
+		return err
+	}
+	s.WriteLine(append(line, '\n'))
+	return nil
+}
+
+// Queues a line (including the newline) for every connected client, never blocks
+func (s *unixSocketSink) WriteLine(line []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for client := range s.clients {
+		select {
+		case client.queue <- line:
+		default:
+			client.dropped++
+			if client.dropped%socketClientQueueSize == 1 {
+				log.Warn().Int("dropped", client.dropped).Msg("Unix socket client cannot keep up, dropping samples")
+			}
+		}
+	}
+}
+
+// Disconnects all clients and removes the socket file
+func (s *unixSocketSink) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	for client := range s.clients {
+		delete(s.clients, client)
+		close(client.queue)
+	}
+	s.lock.Unlock()
+
+	err := s.listener.Close()
+	os.Remove(s.path)
+	return err
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS samples (
+	timestamp INTEGER NOT NULL, -- unix milliseconds
+	volts     REAL NOT NULL,
+	amps      REAL NOT NULL,
+	watts     REAL NOT NULL,
+	wh        REAL NOT NULL,
+	ah        REAL NOT NULL
+);
+CREATE INDEX IF NOT EXISTS samples_timestamp ON samples (timestamp);`
+
+const sqliteInsert = `INSERT INTO samples (timestamp, volts, amps, watts, wh, ah) VALUES (?, ?, ?, ?, ?, ?)`
+
+// Writes samples to an SQLite database. Inserts are batched in transactions that are committed
+// every batchRows rows or batchInterval, whichever comes first, because a transaction per row
+// cannot keep up with high sample rates
+type sqliteSink struct {
+	db            *sql.DB
+	insert        *sql.Stmt
+	tx            *sql.Tx
+	txInsert      *sql.Stmt // insert statement bound to the open transaction
+	pending       int
+	batchRows     int
+	batchInterval time.Duration
+	lastCommit    time.Time
+	// The sink is flushed from the termination handler, which runs concurrently with the loop
+	lock sync.Mutex
+}
+
+func newSQLiteSink(path string, batchRows int, batchInterval time.Duration) (*sqliteSink, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database %s: %v", path, err)
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create sqlite schema: %v", err)
+	}
+	insert, err := db.Prepare(sqliteInsert)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to prepare sqlite insert: %v", err)
+	}
+
+	if batchRows < 1 {
+		batchRows = 1
+	}
+	return &sqliteSink{
+		db:            db,
+		insert:        insert,
+		batchRows:     batchRows,
+		batchInterval: batchInterval,
+		lastCommit:    time.Now(),
+	}, nil
+}
+
+func (s *sqliteSink) Name() string {
+	return "sqlite"
+}
+
+// Inserts the sample, the database only records real readings so gap samples are left out
+func (s *sqliteSink) Write(sample *CurrentSensorOutput) error {
+	if sample.Stale {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.tx == nil {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin sqlite transaction: %v", err)
+		}
+		s.tx = tx
+		s.txInsert = tx.Stmt(s.insert)
+	}
+
+	_, err := s.txInsert.Exec(
+		sample.Timestamp.UnixMilli(),
+		sample.SupplyVoltage,
+		sample.CurrentAmps,
+		sample.PowerWatts,
+		sample.EnergyWh,
+		sample.ChargeAh,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert sample: %v", err)
+	}
+	s.pending++
+
+	if s.pending >= s.batchRows || time.Since(s.lastCommit) >= s.batchInterval {
+		return s.commit()
+	}
+	return nil
+}
+
+// Commits all pending rows
+func (s *sqliteSink) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.commit()
+}
+
+func (s *sqliteSink) commit() error {
+	s.lastCommit = time.Now()
+	if s.tx == nil {
+		return nil
+	}
+
+	err := s.tx.Commit()
+	s.tx = nil
+	s.txInsert = nil
+	s.pending = 0
+	if err != nil {
+		return fmt.Errorf("failed to commit sqlite transaction: %v", err)
+	}
+	return nil
+}
+
+// Commits all pending rows and closes the database
+func (s *sqliteSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.commit()
+	s.insert.Close()
+	if closeErr := s.db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The accumulated values that survive a restart, so that the totals reflect the whole mission
+type accumulatorState struct {
+	EnergyWh  float64   `json:"energyWh"`
+	ChargeAh  float64   `json:"chargeAh"`
+	PeakAmps  float64   `json:"peakAmps"`
+	PeakWatts float64   `json:"peakWatts"`
+	SavedAt   time.Time `json:"savedAt"`
+}
+
+// Persists the accumulator state to a file, periodically from the loop and once more on termination
+type statePersister struct {
+	path     string
+	interval time.Duration
+	state    accumulatorState
+	// Whether state holds the totals to keep, only then it is saved. Before, saving would overwrite the saved
+	// totals with zeros, e.g. when the service exits on a configuration error before the first sample.
+	haveState bool
+	lastSave  time.Time
+	// The state is saved from the termination handler, which runs concurrently with the loop
+	lock sync.Mutex
+}
+
+func newStatePersister(path string, interval time.Duration) *statePersister {
+	return &statePersister{path: path, interval: interval, lastSave: time.Now()}
+}
+
+// Loads the saved state. A missing or corrupt file is not fatal, the totals then start from zero. An unreadable
+// or corrupt file is only overwritten once the totals were updated.
+func (p *statePersister) load() accumulatorState {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	data, err := os.ReadFile(p.path)
+	if os.IsNotExist(err) {
+		log.Info().Str("path", p.path).Msg("No saved accumulator state, starting from zero")
+		p.state, p.haveState = accumulatorState{}, true
+		return p.state
+	}
+	if err != nil {
+		log.Warn().Str("path", p.path).Msgf("unable to read accumulator state, starting from zero: %v", err)
+		return accumulatorState{}
+	}
+
+	state := accumulatorState{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Warn().Str("path", p.path).Msgf("accumulator state is corrupt, starting from zero: %v", err)
+		return accumulatorState{}
+	}
+	log.Info().Str("path", p.path).Float64("energyWh", state.EnergyWh).Float64("chargeAh", state.ChargeAh).Time("savedAt", state.SavedAt).Msg("Restored accumulator state")
+	p.state, p.haveState = state, true
+	return state
+}
+
+// Records the latest state and saves it when the save interval has passed
+func (p *statePersister) update(state accumulatorState) {
+	p.lock.Lock()
+	p.state = state
+	p.haveState = true
+	due := time.Since(p.lastSave) >= p.interval
+	p.lock.Unlock()
+
+	if due {
+		if err := p.save(); err != nil {
+			log.Warn().Msgf("unable to save accumulator state: %v", err)
+		}
+	}
+}
+
+// Writes the latest state to a temporary file first and then renames it, so that a crash
+// while saving never leaves a truncated state file behind. Does nothing before a state was loaded or updated.
+func (p *statePersister) save() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !p.haveState {
+		return nil
+	}
+	p.lastSave = time.Now()
+	p.state.SavedAt = p.lastSave
+	data, err := json.Marshal(p.state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p.path), filepath.Base(p.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary state file: %v", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write state: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), p.path)
+}
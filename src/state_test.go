@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStatePersisterKeepsSavedTotals(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte(`{"energyWh":12.5,"chargeAh":1}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The service exits right after loading, e.g. on a configuration error
+	p := newStatePersister(path, time.Hour)
+	if state := p.load(); state.EnergyWh != 12.5 {
+		t.Fatalf("loaded %+v, want 12.5 Wh", state)
+	}
+	if err := p.save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if state := newStatePersister(path, time.Hour).load(); state.EnergyWh != 12.5 || state.ChargeAh != 1 {
+		t.Errorf("saved %+v after the load, want the loaded totals", state)
+	}
+
+	// A corrupt file is left alone until the totals are updated
+	if err := os.WriteFile(path, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p = newStatePersister(path, time.Hour)
+	p.load()
+	if err := p.save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "{" {
+		t.Errorf("the corrupt state was overwritten with %s before an update", data)
+	}
+	p.update(accumulatorState{EnergyWh: 1})
+	if err := p.save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if state := newStatePersister(path, time.Hour).load(); state.EnergyWh != 1 {
+		t.Errorf("saved %+v after the update, want 1 Wh", state)
+	}
+}
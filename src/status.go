@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	pb_outputs "github.com/VU-ASE/rovercom/packages/go/outputs"
+	roverlib "github.com/VU-ASE/roverlib-go/src"
+	"github.com/rs/zerolog/log"
+)
+
+// Identifies this sensor in all published messages, set from sensor-id
+var sensorID uint32 = 1
+
+// Status codes that are published in the status field of the output messages (0 means no error)
+const (
+	statusOK              uint32 = 0
+	statusSensorLost      uint32 = 1
+	statusBatteryLow      uint32 = 2
+	statusBatteryCritical uint32 = 3
+	statusStale           uint32 = 4 // the values were held or invalidated because a read failed
+)
+
+// The output stream is a ZeroMQ socket, which must not be written from multiple goroutines at once (e.g. the
+// sensor loop and the heartbeat)
+var streamLock sync.Mutex
+
+func writeOutput(stream *roverlib.WriteStream, msg *pb_outputs.SensorOutput) error {
+	streamLock.Lock()
+	defer streamLock.Unlock()
+
+	return stream.Write(msg)
+}
+
+// Writes an already encoded message (e.g. a binary sample) to the output stream
+func writeOutputBytes(stream *roverlib.WriteStream, data []byte) error {
+	streamLock.Lock()
+	defer streamLock.Unlock()
+
+	return stream.WriteBytes(data)
+}
+
+// Publishes a status event (e.g. a sensor swap) as a string scalar on the output stream, so that
+// consumers can tell events apart from regular measurements
+func publishStatus(stream *roverlib.WriteStream, status uint32, event string) {
+	if stream == nil {
+		return
+	}
+
+	msg := pb_outputs.SensorOutput{
+		Timestamp: uint64(time.Now().UnixMilli()),
+		Status:    status,
+		SensorId:  sensorID,
+		SensorOutput: &pb_outputs.SensorOutput_GenericStringScalar{
+			GenericStringScalar: &pb_outputs.GenericStringScalar{
+				Key:   "event",
+				Value: event,
+			},
+		},
+	}
+	if err := writeOutput(stream, &msg); err != nil {
+		log.Warn().Str("event", event).Msgf("unable to publish status event: %v", err)
+	}
+}
+
+// Publishes a JSON document (e.g. the capabilities) as a string scalar with the given key on the output stream
+func publishJSON(stream *roverlib.WriteStream, key string, payload []byte) {
+	if stream == nil {
+		return
+	}
+
+	msg := pb_outputs.SensorOutput{
+		Timestamp: uint64(time.Now().UnixMilli()),
+		Status:    statusOK,
+		SensorId:  sensorID,
+		SensorOutput: &pb_outputs.SensorOutput_GenericStringScalar{
+			GenericStringScalar: &pb_outputs.GenericStringScalar{
+				Key:   key,
+				Value: string(payload),
+			},
+		},
+	}
+	if err := writeOutput(stream, &msg); err != nil {
+		log.Warn().Str("key", key).Msgf("unable to publish %s: %v", key, err)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	roverlib "github.com/VU-ASE/roverlib-go/src"
+	"github.com/rs/zerolog/log"
+)
+
+// Registers that the stress test reads in turn: those of a sample, and the manufacturer ID, whose constant value
+// shows corrupted transfers that the bus does not report as an error
+var stressRegisters = []uint8{shuntVoltReg, busVoltReg, powerReg, currentReg, manufIDReg}
+
+// Interval of the progress log during a stress test
+const stressProgressInterval = 10 * time.Second
+
+// The stress test report as it is written to stress-test-report-path
+type stressReport struct {
+	Start             time.Time `json:"start"`
+	DurationSeconds   float64   `json:"durationSeconds"`
+	Reads             uint64    `json:"reads"`
+	ReadsPerSecond    float64   `json:"readsPerSecond"`
+	Errors            uint64    `json:"errors"`
+	Corrupted         uint64    `json:"corrupted"`
+	Retries           uint64    `json:"retries"`
+	MinLatencyMs      float64   `json:"minLatencyMs"`
+	MaxLatencyMs      float64   `json:"maxLatencyMs"`
+	AvgLatencyMs      float64   `json:"avgLatencyMs"`
+	ErrorPercent      float64   `json:"errorPercent"`
+	RetryPercent      float64   `json:"retryPercent"`
+	MaxErrorPercent   float64   `json:"maxErrorPercent"`
+	MaxRetryPercent   float64   `json:"maxRetryPercent"`
+	MaxLatencyLimitMs float64   `json:"maxLatencyLimitMs"`
+	Passed            bool      `json:"passed"`
+}
+
+// Qualifies the I2C bus of a sensor by reading its registers back-to-back, as fast as the bus allows, for a
+// fixed duration. The publish rate is ignored. The bus passes when the failed (or corrupted) reads, the retries
+// after lost arbitration or a busy bus, and the slowest read stay within their limits.
+type stressTest struct {
+	duration        time.Duration
+	maxErrorPercent float64
+	maxRetryPercent float64
+	maxLatency      time.Duration // 0 does not check the latency
+	path            string
+}
+
+// Reads the stress test configuration, nil when stress-test-seconds is 0
+func readStressTest(configuration *roverlib.ServiceConfiguration) (*stressTest, error) {
+	seconds := getFloatOr(configuration, "stress-test-seconds", 0)
+	if seconds <= 0 {
+		return nil, nil
+	}
+	s := &stressTest{
+		duration:        time.Duration(seconds * float64(time.Second)),
+		maxErrorPercent: getFloatOr(configuration, "stress-test-max-error-percent", 0),
+		maxRetryPercent: getFloatOr(configuration, "stress-test-max-retry-percent", 1),
+		maxLatency:      time.Duration(getFloatOr(configuration, "stress-test-max-latency-ms", 10) * float64(time.Millisecond)),
+		path:            getStringOr(configuration, "stress-test-report-path", ""),
+	}
+	if s.maxErrorPercent < 0 || s.maxRetryPercent < 0 {
+		return nil, fmt.Errorf("stress-test-max-error-percent and stress-test-max-retry-percent must not be negative")
+	}
+	if s.maxLatency < 0 {
+		return nil, fmt.Errorf("stress-test-max-latency-ms must not be negative, got %v", s.maxLatency.Seconds()*1000)
+	}
+	return s, nil
+}
+
+// Runs the stress test, logs the statistics and the verdict, and writes them to the report path if configured
+func (s *stressTest) run(ina *INA226) bool {
+	log.Info().Dur("duration", s.duration).Msg("Starting the I2C stress test, the sensor is read as fast as the bus allows")
+
+	// The reference value of the manufacturer ID, which is not necessarily the TI one with verify-id 0
+	reference, err := ina.readRegister(manufIDReg)
+	if err != nil {
+		log.Error().Msgf("unable to read the manufacturer ID before the stress test: %v", err)
+		return false
+	}
+
+	report := stressReport{Start: time.Now()}
+	retriesBefore := ina.ArbitrationErrors() + ina.BusBusyErrors()
+	var total, minLatency, maxLatency time.Duration
+	lastProgress := report.Start
+	for time.Since(report.Start) < s.duration {
+		for _, reg := range stressRegisters {
+			start := time.Now()
+			value, err := ina.readRegister(reg)
+			latency := time.Since(start)
+
+			report.Reads++
+			total += latency
+			if report.Reads == 1 || latency < minLatency {
+				minLatency = latency
+			}
+			maxLatency = max(maxLatency, latency)
+			if err != nil {
+				report.Errors++
+			} else if reg == manufIDReg && value != reference {
+				report.Corrupted++
+			}
+		}
+		if time.Since(lastProgress) >= stressProgressInterval {
+			lastProgress = time.Now()
+			log.Info().Uint64("reads", report.Reads).Uint64("errors", report.Errors).Uint64("corrupted", report.Corrupted).
+				Dur("maxLatency", maxLatency).Msg("Stress test in progress")
+		}
+	}
+
+	elapsed := time.Since(report.Start)
+	report.DurationSeconds = elapsed.Seconds()
+	report.ReadsPerSecond = float64(report.Reads) / elapsed.Seconds()
+	report.Retries = ina.ArbitrationErrors() + ina.BusBusyErrors() - retriesBefore
+	report.MinLatencyMs = float64(minLatency) / float64(time.Millisecond)
+	report.MaxLatencyMs = float64(maxLatency) / float64(time.Millisecond)
+	report.MaxErrorPercent = s.maxErrorPercent
+	report.MaxRetryPercent = s.maxRetryPercent
+	report.MaxLatencyLimitMs = float64(s.maxLatency) / float64(time.Millisecond)
+	if report.Reads > 0 {
+		report.AvgLatencyMs = float64(total) / float64(report.Reads) / float64(time.Millisecond)
+		report.ErrorPercent = float64(report.Errors+report.Corrupted) / float64(report.Reads) * 100
+		report.RetryPercent = float64(report.Retries) / float64(report.Reads) * 100
+	}
+	report.Passed = report.Reads > 0 &&
+		report.ErrorPercent <= s.maxErrorPercent &&
+		report.RetryPercent <= s.maxRetryPercent &&
+		(s.maxLatency == 0 || maxLatency <= s.maxLatency)
+
+	event := log.Info()
+	if !report.Passed {
+		event = log.Error()
+	}
+	event.
+		Uint64("reads", report.Reads).
+		Float64("readsPerSecond", report.ReadsPerSecond).
+		Uint64("errors", report.Errors).
+		Uint64("corrupted", report.Corrupted).
+		Uint64("retries", report.Retries).
+		Float64("minLatencyMs", report.MinLatencyMs).
+		Float64("avgLatencyMs", report.AvgLatencyMs).
+		Float64("maxLatencyMs", report.MaxLatencyMs).
+		Bool("passed", report.Passed)
+	if report.Passed {
+		event.Msg("Stress test passed")
+	} else {
+		event.Msg("Stress test failed, the bus exceeded the error, retry or latency limits")
+	}
+
+	if s.path != "" {
+		payload, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			log.Warn().Msgf("unable to encode stress test report: %v", err)
+			return report.Passed
+		}
+		if err := os.WriteFile(s.path, append(payload, '\n'), 0o644); err != nil {
+			log.Warn().Str("path", s.path).Msgf("unable to write stress test report: %v", err)
+			return report.Passed
+		}
+		log.Info().Str("path", s.path).Msg("Wrote stress test report")
+	}
+	return report.Passed
+}
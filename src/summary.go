@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Totals and extremes over the whole run, reported when the run ends
+type runStats struct {
+	start      time.Time
+	samples    int
+	peakAmps   float64
+	minAmps    float64
+	sumAmps    float64 // of the magnitudes, like the peak and minimum
+	peakWatts  float64
+	peakVolts  float64
+	minVolts   float64
+	haveVolts  bool
+	energyWh   float64
+	chargeAh   float64
+	readErrors int
+	reconnects int
+	busReopens func() uint64
+	path       string
+	reported   bool
+	lock       sync.Mutex
+}
+
+// The run summary as it is written to run-summary-path
+type runSummary struct {
+	Start           time.Time `json:"start"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	Samples         int       `json:"samples"`
+	EnergyWh        float64   `json:"energyWh"`
+	ChargeAh        float64   `json:"chargeAh"`
+	PeakAmps        float64   `json:"peakAmps"`
+	MinAmps         float64   `json:"minAmps"`
+	AvgAmps         float64   `json:"avgAmps"`
+	PeakWatts       float64   `json:"peakWatts"`
+	PeakVolts       float64   `json:"peakVolts"`
+	MinVolts        float64   `json:"minVolts"`
+	ReadErrors      int       `json:"readErrors"`
+	Reconnects      int       `json:"reconnects"`
+	BusReopens      uint64    `json:"busReopens"`
+}
+
+// The summary is written to path when it is not empty. busReopens reports the number of bus reopens of the sensor.
+func newRunStats(path string, busReopens func() uint64) *runStats {
+	return &runStats{start: time.Now(), path: path, busReopens: busReopens}
+}
+
+// Continues from previously recorded peaks (e.g. restored after a restart)
+func (s *runStats) restorePeaks(peakAmps float64, peakWatts float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.peakAmps = peakAmps
+	s.peakWatts = peakWatts
+}
+
+func (s *runStats) add(sample *CurrentSensorOutput) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	amps := math.Abs(sample.CurrentAmps)
+	if s.samples == 0 {
+		s.minAmps = amps
+	}
+	s.samples++
+	s.peakAmps = math.Max(s.peakAmps, amps)
+	s.minAmps = math.Min(s.minAmps, amps)
+	s.sumAmps += amps
+	s.peakWatts = math.Max(s.peakWatts, sample.PowerWatts)
+	if sample.ValidFields.Has(FieldVoltage) {
+		if !s.haveVolts {
+			s.peakVolts = sample.SupplyVoltage
+			s.minVolts = sample.SupplyVoltage
+			s.haveVolts = true
+		}
+		s.peakVolts = math.Max(s.peakVolts, sample.SupplyVoltage)
+		s.minVolts = math.Min(s.minVolts, sample.SupplyVoltage)
+	}
+	s.energyWh = sample.EnergyWh
+	s.chargeAh = sample.ChargeAh
+}
+
+func (s *runStats) readFailed() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.readErrors++
+}
+
+// Counts a sensor that was re-attached after it was lost
+func (s *runStats) reconnected() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.reconnects++
+}
+
+// Logs the final summary of the run, and writes it to the path if configured. Only the first call reports,
+// since the run can end both by itself and by a signal.
+func (s *runStats) report() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.reported {
+		return
+	}
+	s.reported = true
+
+	summary := runSummary{
+		Start:           s.start,
+		DurationSeconds: time.Since(s.start).Seconds(),
+		Samples:         s.samples,
+		EnergyWh:        s.energyWh,
+		ChargeAh:        s.chargeAh,
+		PeakAmps:        s.peakAmps,
+		MinAmps:         s.minAmps,
+		PeakWatts:       s.peakWatts,
+		PeakVolts:       s.peakVolts,
+		MinVolts:        s.minVolts,
+		ReadErrors:      s.readErrors,
+		Reconnects:      s.reconnects,
+		BusReopens:      s.busReopens(),
+	}
+	if s.samples > 0 {
+		summary.AvgAmps = s.sumAmps / float64(s.samples)
+	}
+	log.Info().
+		Dur("duration", time.Since(s.start)).
+		Int("samples", summary.Samples).
+		Float64("energyWh", summary.EnergyWh).
+		Float64("chargeAh", summary.ChargeAh).
+		Float64("peakAmps", summary.PeakAmps).
+		Float64("minAmps", summary.MinAmps).
+		Float64("avgAmps", summary.AvgAmps).
+		Float64("peakWatts", summary.PeakWatts).
+		Float64("peakVolts", summary.PeakVolts).
+		Float64("minVolts", summary.MinVolts).
+		Int("readErrors", summary.ReadErrors).
+		Int("reconnects", summary.Reconnects).
+		Uint64("busReopens", summary.BusReopens).
+		Msg("Run summary")
+
+	if s.path == "" {
+		return
+	}
+	payload, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		log.Warn().Msgf("unable to encode run summary: %v", err)
+		return
+	}
+	if err := os.WriteFile(s.path, append(payload, '\n'), 0o644); err != nil {
+		log.Warn().Str("path", s.path).Msgf("unable to write run summary: %v", err)
+		return
+	}
+	log.Info().Str("path", s.path).Msg("Wrote run summary")
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunSummaryCurrentMagnitudes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "summary.json")
+	s := newRunStats(path, func() uint64 { return 0 })
+	for _, amps := range []float64{-3, 1, -2} {
+		s.add(&CurrentSensorOutput{CurrentAmps: amps})
+	}
+	s.report()
+
+	payload, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("the summary was not written: %v", err)
+	}
+	var summary runSummary
+	if err := json.Unmarshal(payload, &summary); err != nil {
+		t.Fatalf("invalid summary %s: %v", payload, err)
+	}
+	if summary.PeakAmps != 3 || summary.MinAmps != 1 || summary.AvgAmps != 2 {
+		t.Errorf("peak %v A, min %v A, average %v A, want the magnitudes 3 A, 1 A and 2 A", summary.PeakAmps, summary.MinAmps, summary.AvgAmps)
+	}
+}
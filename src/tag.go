@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Maximum length of an event tag, tags are short markers and not free-form annotations
+const maxTagLength = 64
+
+// Holds the event tag that is set externally (e.g. "start maneuver") and added to the next published samples,
+// so that energy spikes can be correlated with test events without a separate synchronized logger
+type eventTagger struct {
+	tag       string
+	remaining int
+	samples   int // the number of samples that a new tag is added to
+	lock      sync.Mutex
+}
+
+func newEventTagger(samples int) *eventTagger {
+	return &eventTagger{samples: samples}
+}
+
+// Sets the tag for the next samples, replacing a tag that is still pending. An empty tag clears it.
+func (t *eventTagger) set(tag string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.tag = tag
+	t.remaining = t.samples
+	if tag == "" {
+		t.remaining = 0
+	}
+}
+
+// Returns the tag for the sample that is about to be published, or an empty string if there is none
+func (t *eventTagger) next() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.remaining == 0 {
+		return ""
+	}
+	t.remaining--
+	return t.tag
+}
+
+// Registers the endpoints to set (PUT /tag?value=...) and clear (DELETE /tag) the event tag. Setting a tag
+// is also announced as a status event, since the protobuf output has no field for it.
+func registerTagEndpoints(tagger *eventTagger, announce func(event string)) {
+	httpMux.HandleFunc("PUT /tag", func(w http.ResponseWriter, r *http.Request) {
+		tag := strings.TrimSpace(r.URL.Query().Get("value"))
+		if tag == "" {
+			http.Error(w, "missing tag, set it with ?value=...", http.StatusBadRequest)
+			return
+		}
+		if len(tag) > maxTagLength {
+			http.Error(w, fmt.Sprintf("tag is longer than %d characters", maxTagLength), http.StatusBadRequest)
+			return
+		}
+		tagger.set(tag)
+		announce("tag:" + tag)
+		log.Info().Str("tag", tag).Msg("Tagging the next samples")
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	httpMux.HandleFunc("DELETE /tag", func(w http.ResponseWriter, _ *http.Request) {
+		tagger.set("")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
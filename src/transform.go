@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Selects the published quantity that a transform stage operates on, and whether it is valid in the sample
+type transformQuantity func(sample *CurrentSensorOutput) (*float64, bool)
+
+var transformQuantities = map[string]transformQuantity{
+	"current": func(s *CurrentSensorOutput) (*float64, bool) {
+		return &s.CurrentAmps, s.ValidFields.Has(FieldCurrent)
+	},
+	"voltage": func(s *CurrentSensorOutput) (*float64, bool) {
+		return &s.SupplyVoltage, s.ValidFields.Has(FieldVoltage)
+	},
+	"power": func(s *CurrentSensorOutput) (*float64, bool) {
+		return &s.PowerWatts, s.ValidFields.Has(FieldPower)
+	},
+}
+
+// A single step of the transform pipeline
+type transformStage struct {
+	kind     string
+	quantity string
+	value    transformQuantity
+	param    float64
+	// State of the low-pass filter
+	filtered float64
+	last     time.Time
+}
+
+func (t *transformStage) apply(sample *CurrentSensorOutput) {
+	value, ok := t.value(sample)
+	if !ok {
+		return
+	}
+	switch t.kind {
+	case "offset":
+		*value += t.param
+	case "scale":
+		*value *= t.param
+	case "deadband":
+		if math.Abs(*value) < t.param {
+			*value = 0
+		}
+	case "filter":
+		// First-order low-pass with a time constant, so that it behaves the same at any sample rate
+		if !t.last.IsZero() {
+			alpha := 1 - math.Exp(-sample.Timestamp.Sub(t.last).Seconds()/t.param)
+			*value = t.filtered + alpha*(*value-t.filtered)
+		}
+		t.filtered = *value
+		t.last = sample.Timestamp
+	}
+}
+
+// An explicitly ordered list of transforms that is applied to every published sample
+type transformPipeline struct {
+	stages []*transformStage
+}
+
+// Parses the transforms, separated by semicolons and applied in that order. Each stage is kind:quantity:parameter,
+// e.g. "offset:current:-0.012;scale:current:0.98;filter:current:0.5;deadband:current:0.005". The kinds are offset
+// (added), scale (multiplied), filter (low-pass with the time constant in seconds) and deadband (magnitudes below
+// it become zero), and the quantities current, voltage and power.
+func parseTransforms(spec string) (*transformPipeline, error) {
+	pipeline := &transformPipeline{}
+	for _, s := range strings.Split(spec, ";") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		fields := strings.Split(s, ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid transform %q, must be kind:quantity:parameter", s)
+		}
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+
+		stage := &transformStage{kind: fields[0], quantity: fields[1]}
+		var ok bool
+		if stage.value, ok = transformQuantities[stage.quantity]; !ok {
+			return nil, fmt.Errorf("transform %q: unknown quantity %q, must be current, voltage or power", s, stage.quantity)
+		}
+		param, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("transform %q: invalid parameter: %v", s, err)
+		}
+		stage.param = param
+		switch stage.kind {
+		case "offset", "scale":
+		case "filter":
+			if param <= 0 {
+				return nil, fmt.Errorf("transform %q: the filter time constant must be positive", s)
+			}
+		case "deadband":
+			if param < 0 {
+				return nil, fmt.Errorf("transform %q: the deadband must not be negative", s)
+			}
+		default:
+			return nil, fmt.Errorf("transform %q: unknown kind %q, must be offset, scale, filter or deadband", s, stage.kind)
+		}
+		pipeline.stages = append(pipeline.stages, stage)
+	}
+	return pipeline, nil
+}
+
+// Returns a transformed copy of the sample. The signed power follows the transformed power, keeping its sign.
+func (p *transformPipeline) apply(sample *CurrentSensorOutput) CurrentSensorOutput {
+	out := *sample
+	for _, stage := range p.stages {
+		stage.apply(&out)
+	}
+	out.SignedPowerWatts = math.Copysign(out.PowerWatts, sample.SignedPowerWatts)
+	return out
+}
+
+// Describes the stages in order, for the startup log
+func (p *transformPipeline) String() string {
+	stages := make([]string, len(p.stages))
+	for i, stage := range p.stages {
+		stages[i] = fmt.Sprintf("%s:%s:%g", stage.kind, stage.quantity, stage.param)
+	}
+	return strings.Join(stages, " -> ")
+}
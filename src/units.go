@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A presentation unit for a cumulative quantity, as a factor relative to the internally tracked base unit
+type unit struct {
+	symbol string
+	factor float64
+}
+
+// Energy is tracked internally in Wh
+var energyUnits = map[string]unit{
+	"wh":     {symbol: "Wh", factor: 1},
+	"kwh":    {symbol: "kWh", factor: 0.001},
+	"joules": {symbol: "J", factor: 3600},
+}
+
+// Charge is tracked internally in Ah
+var chargeUnits = map[string]unit{
+	"ah":       {symbol: "Ah", factor: 1},
+	"mah":      {symbol: "mAh", factor: 1000},
+	"coulombs": {symbol: "C", factor: 3600},
+}
+
+// Converts the cumulative energy and charge to the configured units for publishing and logging
+type unitConverter struct {
+	energy unit
+	charge unit
+}
+
+func newUnitConverter(energyUnit string, chargeUnit string) (unitConverter, error) {
+	energy, ok := energyUnits[strings.ToLower(energyUnit)]
+	if !ok {
+		return unitConverter{}, fmt.Errorf("invalid energy-unit %q, valid units are: %s", energyUnit, strings.Join(unitNames(energyUnits), ", "))
+	}
+	charge, ok := chargeUnits[strings.ToLower(chargeUnit)]
+	if !ok {
+		return unitConverter{}, fmt.Errorf("invalid charge-unit %q, valid units are: %s", chargeUnit, strings.Join(unitNames(chargeUnits), ", "))
+	}
+	return unitConverter{energy: energy, charge: charge}, nil
+}
+
+// Fills in the presentation fields of the sample from its base unit values
+func (u unitConverter) apply(sample *CurrentSensorOutput) {
+	sample.Energy = sample.EnergyWh * u.energy.factor
+	sample.EnergyUnit = u.energy.symbol
+	sample.Charge = sample.ChargeAh * u.charge.factor
+	sample.ChargeUnit = u.charge.symbol
+}
+
+func unitNames(units map[string]unit) []string {
+	names := make([]string, 0, len(units))
+	for name := range units {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
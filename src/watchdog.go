@@ -0,0 +1,43 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Turns a silent hang of the sensor loop (e.g. an I2C transaction that blocks forever) into an observable
+// event, by exiting the service when the loop has not completed an iteration for too long
+type watchdog struct {
+	stall    time.Duration
+	deadline atomic.Int64 // unix nanoseconds before which the next iteration must complete
+}
+
+func newWatchdog(stall time.Duration) *watchdog {
+	w := &watchdog{stall: stall}
+	w.kick(0)
+	return w
+}
+
+// Marks an iteration as completed. The next iteration is expected to take the given period (e.g. the
+// sleep between samples), on top of which the stall threshold is allowed.
+func (w *watchdog) kick(period time.Duration) {
+	w.deadline.Store(time.Now().Add(period + w.stall).UnixNano())
+}
+
+// Checks the deadline periodically until the process exits
+func (w *watchdog) run() {
+	interval := min(w.stall/2, time.Second)
+	for range time.Tick(interval) {
+		deadline := time.Unix(0, w.deadline.Load())
+		if time.Now().After(deadline) {
+			// Nothing is published from here, since the stalled loop may be in the middle of a write
+			log.Fatal().
+				Str("fault", string(faultLoopStalled)).
+				Dur("stallThreshold", w.stall).
+				Time("deadline", deadline).
+				Msg("Sensor loop stalled, exiting so that the service can be restarted")
+		}
+	}
+}
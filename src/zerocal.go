@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Time between readings while determining the zero offset, which is longer than a conversion with the default configuration
+const zeroCalibrationInterval = 5 * time.Millisecond
+
+// Runs the zero-current offset calibration. Because it assumes that no current flows, the operator is asked
+// to confirm this when running in a terminal, and offsets that are too large to be noise are rejected.
+func runZeroCalibration(ina *INA226, samples int, maxOffsetAmps float64) error {
+	log.Warn().Msg("Zero-current calibration is enabled. Make sure that NO current flows through the shunt (load disconnected)")
+	if isTerminal(os.Stdin) && !confirm("Is the load disconnected, so that no current flows? [y/N] ") {
+		return fmt.Errorf("zero-current calibration was not confirmed")
+	}
+
+	offset, err := ina.ZeroCalibrate(samples, zeroCalibrationInterval)
+	if err != nil {
+		return fmt.Errorf("zero-current calibration failed: %v", err)
+	}
+	if math.Abs(offset) > maxOffsetAmps {
+		// A current flowed during calibration, subtracting it would make all readings wrong
+		ina.currentOffset = 0
+		return fmt.Errorf("measured zero offset of %.4f A exceeds zero-calibrate-max-amps (%.4f A), is the load really disconnected?", offset, maxOffsetAmps)
+	}
+
+	log.Info().Float64("offsetAmps", offset).Int("samples", samples).Msg("Zero-current calibration done")
+	return nil
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func confirm(prompt string) bool {
+	fmt.Print(prompt)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}